@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+)
+
+// pendingMessage is the admin representation of a pending message, the webhook
+// url is a secret so only its host is included
+type pendingMessage struct {
+	Channel     string `json:"channel"`
+	WebhookHost string `json:"webhookHost"`
+	Source      string `json:"source"`
+	Fallback    string `json:"fallback"`
+}
+
+type adminAPI struct {
+	client  *gerrit.Client
+	configs project.Provider
+	// sshc is nil unless events are streamed over ssh
+	sshc  *gerritssh.Client
+	state *slackState
+	prefs *prefStore
+	// changes is nil unless state-path is set
+	changes *store.Store
+	queues  *changeQueues
+	sub     *submitter
+	reload  func() error
+
+	streamDownThreshold time.Duration
+	// started is used in place of when the stream went down until it first
+	// connects
+	started time.Time
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		llog.Error("error writing admin response", llog.ErrKV(err))
+	}
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// pending handles GET /pending
+func (a adminAPI) pending(w http.ResponseWriter, r *http.Request) {
+	ps := a.sub.Pending()
+	msgs := make([]pendingMessage, 0, len(ps))
+	for _, s := range ps {
+		var host string
+		if u, err := url.Parse(s.WebhookURL); err == nil {
+			host = u.Host
+		}
+		msgs = append(msgs, pendingMessage{
+			Channel:     s.Channel,
+			WebhookHost: host,
+			Source:      s.SourceType,
+			Fallback:    s.Fallback,
+		})
+	}
+	writeJSON(w, msgs)
+}
+
+// flush handles POST /pending/flush
+func (a adminAPI) flush(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	a.sub.Flush()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// clear handles POST /pending/clear
+func (a adminAPI) clear(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	n := a.sub.Clear()
+	llog.Info("cleared pending messages from admin api", llog.KV{"numMessages": n})
+	writeJSON(w, map[string]int{"cleared": n})
+}
+
+// mute handles GET and POST /mute, POST takes a muted form value
+func (a adminAPI) mute(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		muted, err := strconv.ParseBool(r.FormValue("muted"))
+		if err != nil {
+			http.Error(w, "invalid muted value", http.StatusBadRequest)
+			return
+		}
+		a.sub.SetMuted(muted)
+		llog.Info("set muted from admin api", llog.KV{"muted": muted})
+	}
+	writeJSON(w, map[string]bool{"muted": a.sub.Muted()})
+}
+
+// reloadCredentials handles POST /reload
+func (a adminAPI) reloadCredentials(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if err := a.reload(); err != nil {
+		llog.Error("error reloading credentials from admin api", llog.ErrKV(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// projectConfig handles GET /projects/<name>/config
+func (a adminAPI) projectConfig(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/projects/")
+	if !strings.HasSuffix(name, "/config") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/config")
+	pcfg, err := a.configs.LoadConfig(name)
+	if err != nil {
+		llog.Error("error loading config for admin api", llog.ErrKV(err), llog.KV{"project": name})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the webhook url is a secret
+	if pcfg.WebhookURL != "" {
+		pcfg.WebhookURL = "<redacted>"
+	}
+	for i := range pcfg.Destinations {
+		if pcfg.Destinations[i].WebhookURL != "" {
+			pcfg.Destinations[i].WebhookURL = "<redacted>"
+		}
+	}
+	writeJSON(w, pcfg)
+}
+
+// preferences handles GET and PUT /preferences/<email>, PUT takes the user's
+// preferences as json and replaces them
+func (a adminAPI) preferences(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimPrefix(r.URL.Path, "/preferences/")
+	if email == "" || strings.Contains(email, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var p userPrefs
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "invalid preferences", http.StatusBadRequest)
+			return
+		}
+		if err := a.prefs.Set(email, p); err != nil {
+			llog.Error("error setting preferences from admin api", llog.ErrKV(err), llog.KV{"email": email})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		llog.Info("set preferences from admin api", llog.KV{"email": email})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.prefs.Get(email))
+}
+
+// stateStats handles GET /state
+func (a adminAPI) stateStats(w http.ResponseWriter, r *http.Request) {
+	st, err := a.changes.Stats()
+	if err != nil {
+		llog.Error("error getting state store stats for admin api", llog.ErrKV(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, st)
+}
+
+// streamHealthy returns the health of the ssh stream and false if it's been
+// down for longer than the threshold
+func (a adminAPI) streamHealthy() (map[string]interface{}, bool) {
+	if a.sshc == nil {
+		return nil, true
+	}
+	h := a.sshc.Health()
+	res := map[string]interface{}{
+		"connected": h.Connected,
+		"since":     h.Since,
+		"lastEvent": h.LastEvent,
+	}
+	downSince := h.Since
+	if downSince.IsZero() {
+		// we haven't connected yet
+		downSince = a.started
+	}
+	return res, h.Connected || time.Since(downSince) < a.streamDownThreshold
+}
+
+// healthz handles GET /healthz which fails if the ssh stream has been down for
+// longer than stream-down-threshold
+func (a adminAPI) healthz(w http.ResponseWriter, r *http.Request) {
+	stream, ok := a.streamHealthy()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	handling, queued := a.queues.Depth()
+	writeJSON(w, map[string]interface{}{
+		"ok":       ok,
+		"stream":   stream,
+		"pending":  len(a.sub.Pending()),
+		"handling": handling,
+		"queued":   queued,
+	})
+}
+
+// readyz handles GET /readyz which also fails if gerrit's REST api or slack's
+// api aren't reachable
+func (a adminAPI) readyz(w http.ResponseWriter, r *http.Request) {
+	stream, ok := a.streamHealthy()
+	res := map[string]interface{}{
+		"stream": stream,
+	}
+	errStr := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		ok = false
+		return err.Error()
+	}
+	_, _, err := a.client.Config.GetVersion()
+	res["gerritError"] = errStr(err)
+	res["slackError"] = errStr(a.state.ping())
+	res["ok"] = ok
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, res)
+}
+
+// adminUnixPrefix is the prefix of an admin-address that's a unix socket
+const adminUnixPrefix = "unix:"
+
+// adminListen listens on the admin-address which is either a host:port or a
+// path to a unix socket prefixed with unix:
+func adminListen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, adminUnixPrefix); path != addr {
+		// remove the socket left behind if we didn't shut down cleanly
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// adminServer serves the admin api on the admin-address until the context is
+// cancelled
+func adminServer(ctx context.Context, cfg config, a adminAPI) {
+	addr := cfg.AdminAddress
+	a.streamDownThreshold = cfg.StreamDownThreshold
+	a.started = time.Now()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/readyz", a.readyz)
+	mux.HandleFunc("/pending", a.pending)
+	mux.HandleFunc("/pending/flush", a.flush)
+	mux.HandleFunc("/pending/clear", a.clear)
+	mux.HandleFunc("/mute", a.mute)
+	mux.HandleFunc("/projects/", a.projectConfig)
+	mux.HandleFunc("/reload", a.reloadCredentials)
+	mux.HandleFunc("/preferences/", a.preferences)
+	mux.HandleFunc("/state", a.stateStats)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+	l, err := adminListen(addr)
+	if err != nil {
+		llog.Error("error listening for admin api", llog.ErrKV(err), llog.KV{"addr": addr})
+		return
+	}
+	llog.Info("serving admin api", llog.KV{"addr": addr})
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		llog.Error("error serving admin api", llog.ErrKV(err), llog.KV{"addr": addr})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// reviewerWindow is how long the reviewer-added events for a change are
+// collected after its patchset-created event, since gerrit sends an event for
+// each reviewer that's added along with the patch set
+var reviewerWindow = 5 * time.Second
+
+// reviewerAggregationTTL is how long the reviewers are kept after the window
+// ends for handlers that were slow to wait for them
+var reviewerAggregationTTL = time.Minute
+
+// reviewerAggregation is the reviewers collected for a single patch set
+type reviewerAggregation struct {
+	// done is closed once the window ends
+	done      chan struct{}
+	reviewers []gerritssh.EventAccount
+}
+
+// reviewerAggregator collects the reviewer-added events that arrive within the
+// reviewerWindow after a patchset-created event so they can be merged into the
+// patch set's message instead of each being posted. Open and Add must be called
+// in the order that events are received.
+type reviewerAggregator struct {
+	l    sync.Mutex
+	aggs map[string]*reviewerAggregation
+}
+
+func newReviewerAggregator() *reviewerAggregator {
+	return &reviewerAggregator{aggs: map[string]*reviewerAggregation{}}
+}
+
+func aggregationKey(e gerritssh.Event) string {
+	return fmt.Sprintf("%s~%d~%d", e.Change.Project, e.Change.Number, e.PatchSet.Number)
+}
+
+// Open starts collecting reviewers for the patchset-created event
+func (ra *reviewerAggregator) Open(e gerritssh.Event) {
+	key := aggregationKey(e)
+	agg := &reviewerAggregation{done: make(chan struct{})}
+	ra.l.Lock()
+	ra.aggs[key] = agg
+	ra.l.Unlock()
+	time.AfterFunc(reviewerWindow, func() {
+		ra.l.Lock()
+		close(agg.done)
+		ra.l.Unlock()
+	})
+	time.AfterFunc(reviewerWindow+reviewerAggregationTTL, func() {
+		ra.l.Lock()
+		// a newer event for the same patch set might have replaced it
+		if ra.aggs[key] == agg {
+			delete(ra.aggs, key)
+		}
+		ra.l.Unlock()
+	})
+}
+
+// Add adds the reviewer-added event's reviewer to its patch set's aggregation
+// and returns false if the window for the patch set isn't open
+func (ra *reviewerAggregator) Add(e gerritssh.Event) bool {
+	ra.l.Lock()
+	defer ra.l.Unlock()
+	agg, ok := ra.aggs[aggregationKey(e)]
+	if !ok {
+		return false
+	}
+	select {
+	case <-agg.done:
+		return false
+	default:
+	}
+	agg.reviewers = append(agg.reviewers, e.Reviewer)
+	return true
+}
+
+// Wait waits for the window of the patchset-created event to end and returns
+// the reviewers that were added during it, in the order they were added
+func (ra *reviewerAggregator) Wait(e gerritssh.Event) []gerritssh.EventAccount {
+	ra.l.Lock()
+	agg, ok := ra.aggs[aggregationKey(e)]
+	ra.l.Unlock()
+	if !ok {
+		return nil
+	}
+	<-agg.done
+	ra.l.Lock()
+	defer ra.l.Unlock()
+	return append([]gerritssh.EventAccount(nil), agg.reviewers...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// sourceAMQP consumes events from an AMQP queue
+const sourceAMQP = "amqp"
+
+// consumeAMQP consumes from the queue until the connection is closed or the
+// context is cancelled
+func consumeAMQP(ctx context.Context, cfg config, ech chan<- gerritssh.Event, kv llog.KV) error {
+	conn, err := amqp.Dial(cfg.AMQPURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(cfg.AMQPQueue, "gerrit-slack", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	llog.Info("consuming events from amqp", kv)
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			e, err := parseBrokerEvent(d.Body)
+			if err != nil {
+				llog.Error("error unmarshalling event", llog.ErrKV(err), kv)
+				// there's no point in redelivering it
+				d.Reject(false)
+				continue
+			}
+			llog.Info("gerrit event", e.KV())
+			select {
+			case ech <- e:
+			case <-ctx.Done():
+				// it's redelivered since it wasn't acked
+				return nil
+			}
+			d.Ack(false)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// amqpSource consumes events from the configured queue and sends them to ech
+// until the context is cancelled
+func amqpSource(ctx context.Context, cfg config, ech chan<- gerritssh.Event) {
+	kv := llog.KV{"queue": cfg.AMQPQueue}
+	b := backoff{min: sshRetryMinDelay, max: sshRetryMaxDelay}
+	for ctx.Err() == nil {
+		start := time.Now()
+		if err := consumeAMQP(ctx, cfg, ech, kv); err != nil {
+			llog.Error("error consuming from amqp", llog.ErrKV(err), kv)
+		}
+		if time.Since(start) > sshRetryMaxDelay {
+			b.reset()
+		}
+		select {
+		case <-time.After(b.next()):
+		case <-ctx.Done():
+		}
+	}
+}
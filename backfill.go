@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+)
+
+var (
+	// heartbeatInterval is how often the state store records that we're
+	// running so the downtime can be determined on startup
+	heartbeatInterval = time.Minute
+
+	// backfillMaxChanges is the most changes listed in a single summary
+	backfillMaxChanges = 20
+)
+
+// heartbeatLoop records that we're running in the state store until the
+// context is cancelled
+func heartbeatLoop(ctx context.Context, changes *store.Store) {
+	tick := time.NewTicker(heartbeatInterval)
+	defer tick.Stop()
+	for {
+		if err := changes.SetHeartbeat(time.Now()); err != nil {
+			llog.Error("error recording heartbeat", llog.ErrKV(err))
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// backfillSummary posts a summary of the changes updated while we were down to
+// each channel they would have been posted to, if we were down for longer than
+// the threshold according to the last heartbeat
+func (eh eventHandler) backfillSummary(last time.Time, threshold time.Duration) {
+	now := time.Now()
+	if last.IsZero() || threshold <= 0 || now.Sub(last) < threshold {
+		return
+	}
+	llog.Info("summarizing changes updated while down", llog.KV{"since": last})
+	cs, err := gerritssh.ChangesUpdated(eh.client, last, now)
+	if err != nil {
+		llog.Error("error querying changes updated while down", llog.ErrKV(err), llog.KV{"since": last})
+		return
+	}
+
+	// group the changes by where their messages would've been delivered
+	type summary struct {
+		s       webhookSubmit
+		changes []gerritssh.EventChange
+	}
+	summaries := map[string]*summary{}
+	var keys []string
+	for _, c := range cs {
+		if eh.optedOut(gerritssh.Event{Change: c}) {
+			continue
+		}
+		pcfg, err := eh.configs.LoadConfig(c.Project)
+		if err == nil {
+			pcfg, err = pcfg.ForBranch(c.Branch)
+		}
+		if err != nil {
+			llog.Error("error loading config for summary", llog.ErrKV(err), llog.KV{"project": c.Project})
+			eh.alerts.alert(err)
+			continue
+		}
+		if (pcfg.IgnorePrivatePatchSet && c.Private) || (pcfg.IgnoreWipPatchSet && c.WIP) {
+			continue
+		}
+		for _, dcfg := range pcfg.DestinationConfigs() {
+			// emails are only sent to the change's owner and reviewers
+			if !dcfg.Enabled || dcfg.Sink == project.SinkEmail {
+				continue
+			}
+			key := strings.Join([]string{dcfg.Sink, dcfg.WebhookURL, dcfg.WebhookURLSecret, dcfg.Channel}, " ")
+			sm, ok := summaries[key]
+			if !ok {
+				sm = &summary{s: webhookSubmit{
+					Message:       events.Message{Channel: dcfg.Channel},
+					WebhookURL:    dcfg.WebhookURL,
+					SourceType:    "backfill",
+					ProjectConfig: dcfg,
+				}}
+				summaries[key] = sm
+				keys = append(keys, key)
+			}
+			sm.changes = append(sm.changes, c)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sm := summaries[key]
+		sm.s.Attachment = backfillAttachment(last, sm.changes)
+		eh.sch <- sm.s
+	}
+}
+
+// backfillAttachment lists the changes that were updated since
+func backfillAttachment(since time.Time, cs []gerritssh.EventChange) events.Attachment {
+	var a events.Attachment
+	a.Pretext = fmt.Sprintf("While I was away since %s, %d changes were updated:",
+		since.UTC().Format("2006-01-02 15:04 MST"),
+		len(cs),
+	)
+	a.Fallback = a.Pretext
+	lines := make([]string, 0, backfillMaxChanges+1)
+	for i, c := range cs {
+		if i == backfillMaxChanges {
+			lines = append(lines, fmt.Sprintf("and %d more…", len(cs)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("<%s|%s: %s> (%s)",
+			c.URL,
+			c.Project,
+			c.Subject,
+			strings.ToLower(string(c.Status)),
+		))
+	}
+	a.Text = strings.Join(lines, "\n")
+	return a
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially increasing delays with jitter between
+// reconnect attempts
+type backoff struct {
+	min time.Duration
+	max time.Duration
+
+	attempt uint
+}
+
+// next returns the delay to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	d := b.min << b.attempt
+	if d > b.max || d <= 0 {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	// wait somewhere between half and all of the delay so reconnects from
+	// multiple instances don't line up
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reset starts the delays over from min
+func (b *backoff) reset() {
+	b.attempt = 0
+}
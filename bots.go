@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+// botRefreshInterval is how often the members of the ignore-group are fetched
+var botRefreshInterval = 10 * time.Minute
+
+// botFilter drops events caused by bot accounts, like CI, before any handler
+// runs so they don't need to be ignored in every project's config
+type botFilter struct {
+	client *gerrit.Client
+	group  string
+	users  map[string]bool
+
+	l       sync.RWMutex
+	members map[string]bool
+}
+
+// newBotFilter returns a botFilter for the comma separated usernames and the
+// members of the group, either of which can be empty
+func newBotFilter(client *gerrit.Client, users, group string) *botFilter {
+	b := &botFilter{
+		client:  client,
+		group:   group,
+		users:   map[string]bool{},
+		members: map[string]bool{},
+	}
+	for _, u := range strings.Split(users, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			b.users[u] = true
+		}
+	}
+	return b
+}
+
+// refresh fetches the members of the group
+func (b *botFilter) refresh() error {
+	as, _, err := b.client.Groups.ListGroupMembers(url.PathEscape(b.group), &gerrit.ListGroupMembersOptions{
+		Recursive: true,
+	})
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"group": b.group})
+	}
+	members := make(map[string]bool, len(*as))
+	for _, a := range *as {
+		members[a.Username] = true
+	}
+	b.l.Lock()
+	b.members = members
+	b.l.Unlock()
+	return nil
+}
+
+// refreshLoop fetches the members of the group until the context is cancelled
+func (b *botFilter) refreshLoop(ctx context.Context) {
+	if b.group == "" {
+		return
+	}
+	tick := time.NewTicker(botRefreshInterval)
+	defer tick.Stop()
+	for {
+		if err := b.refresh(); err != nil {
+			llog.Error("error fetching ignore-group members", llog.ErrKV(err))
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ignore returns true if the event was caused by a bot account
+func (b *botFilter) ignore(e gerritssh.Event) bool {
+	return b.isBot(e.Actor().Username)
+}
+
+// isBot returns true if the username is one of the ignore-users or a member of
+// the ignore-group
+func (b *botFilter) isBot(u string) bool {
+	if u == "" {
+		return false
+	}
+	if b.users[u] {
+		return true
+	}
+	b.l.RLock()
+	defer b.l.RUnlock()
+	return b.members[u]
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// maxQueuedEvents is the most events that can be waiting for a worker before
+// Run blocks, which stops reading events until the workers catch up
+var maxQueuedEvents = 1000
+
+// changeQueues runs the handling of events on a bounded number of workers so a
+// burst of events doesn't make too many concurrent requests to gerrit. Each
+// change's events are handled one at a time, in the order they were received,
+// so that a change's messages are sent in order even though different changes
+// are handled concurrently.
+type changeQueues struct {
+	// workers has a slot for each event that can be handled at once and
+	// queued has a slot for each event that can be waiting
+	workers chan struct{}
+	queued  chan struct{}
+
+	// numRunning and numQueued are for Depth
+	numRunning int64
+	numQueued  int64
+
+	l sync.Mutex
+	// queues holds the functions waiting to run for each change, a change is
+	// only in queues while its worker is running
+	queues map[string][]func()
+}
+
+func newChangeQueues(workers int) *changeQueues {
+	if workers < 1 {
+		workers = 1
+	}
+	return &changeQueues{
+		workers: make(chan struct{}, workers),
+		queued:  make(chan struct{}, maxQueuedEvents),
+		queues:  map[string][]func(){},
+	}
+}
+
+// Depth returns how many events are being handled and how many are waiting
+func (cq *changeQueues) Depth() (int, int) {
+	return int(atomic.LoadInt64(&cq.numRunning)), int(atomic.LoadInt64(&cq.numQueued))
+}
+
+// run runs fn once there's a free worker
+func (cq *changeQueues) run(fn func()) {
+	cq.workers <- struct{}{}
+	atomic.AddInt64(&cq.numQueued, -1)
+	<-cq.queued
+	atomic.AddInt64(&cq.numRunning, 1)
+	defer func() {
+		atomic.AddInt64(&cq.numRunning, -1)
+		<-cq.workers
+	}()
+	fn()
+}
+
+// Run runs fn after every function that was already queued for the event's
+// change, once there's a free worker. Events that aren't for a change only
+// wait for a worker. Run blocks if too many events are already waiting.
+func (cq *changeQueues) Run(e gerritssh.Event, fn func()) {
+	cq.queued <- struct{}{}
+	atomic.AddInt64(&cq.numQueued, 1)
+	if e.Change.Number == 0 {
+		go cq.run(fn)
+		return
+	}
+	key := fmt.Sprintf("%s~%d", e.Change.Project, e.Change.Number)
+	cq.l.Lock()
+	defer cq.l.Unlock()
+	if q, ok := cq.queues[key]; ok {
+		cq.queues[key] = append(q, fn)
+		return
+	}
+	cq.queues[key] = nil
+	go cq.work(key, fn)
+}
+
+// work runs fn and then the change's queued functions until there are none
+func (cq *changeQueues) work(key string, fn func()) {
+	for {
+		cq.run(fn)
+		cq.l.Lock()
+		q := cq.queues[key]
+		if len(q) == 0 {
+			delete(cq.queues, key)
+			cq.l.Unlock()
+			return
+		}
+		fn = q[0]
+		cq.queues[key] = q[1:]
+		cq.l.Unlock()
+	}
+}
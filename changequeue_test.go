@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+func TestChangeQueuesOrder(t *testing.T) {
+	cq := newChangeQueues(2)
+	changes := []gerritssh.EventChange{
+		{Project: "a", Number: 1},
+		{Project: "a", Number: 2},
+		{Project: "b", Number: 1},
+	}
+	var (
+		wg  sync.WaitGroup
+		l   sync.Mutex
+		got = make([][]int, 3)
+	)
+	for i := 0; i < 20; i++ {
+		for j, c := range changes {
+			i, j := i, j
+			wg.Add(1)
+			cq.Run(gerritssh.Event{Change: c}, func() {
+				defer wg.Done()
+				// the earlier events take longer so they'd finish last if
+				// they weren't run in order
+				time.Sleep(time.Duration(20-i) * 100 * time.Microsecond)
+				l.Lock()
+				got[j] = append(got[j], i)
+				l.Unlock()
+			})
+		}
+	}
+	wg.Wait()
+	for j, c := range changes {
+		if len(got[j]) != 20 {
+			t.Fatalf("change %s~%d ran %d events, want 20", c.Project, c.Number, len(got[j]))
+		}
+		for i, n := range got[j] {
+			if n != i {
+				t.Errorf("change %s~%d ran events in order %v", c.Project, c.Number, got[j])
+				break
+			}
+		}
+	}
+}
+
+func TestChangeQueuesWorkers(t *testing.T) {
+	cq := newChangeQueues(3)
+	var (
+		wg            sync.WaitGroup
+		l             sync.Mutex
+		running, most int
+	)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		// each event is for a different change so only the workers limit them
+		cq.Run(gerritssh.Event{Change: gerritssh.EventChange{Project: "a", Number: int64(i + 1)}}, func() {
+			defer wg.Done()
+			l.Lock()
+			if running++; running > most {
+				most = running
+			}
+			l.Unlock()
+			time.Sleep(time.Millisecond)
+			l.Lock()
+			running--
+			l.Unlock()
+		})
+	}
+	wg.Wait()
+	if most > 3 {
+		t.Errorf("%d events ran at once, want at most 3", most)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+)
+
+// handleCIFailure notifies the change's owner if the event is CI failing, as
+// set by notify-owner-on-ci-failure
+func (eh eventHandler) handleCIFailure(ctx context.Context, e gerritssh.Event, pcfg project.Config) {
+	buildURL, ok := events.CIFailure(e, pcfg)
+	if !ok {
+		return
+	}
+	eh.notifyOwner(ctx, e.Type, e.Change, pcfg, pcfg.NotifyOwnerOnCIFailure, func(mention string) events.Message {
+		return events.CIFailureMessage(e, pcfg, buildURL, mention)
+	})
+}
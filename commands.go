@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/go-llog"
+)
+
+// slashCommand is the payload of a slack slash command, like /gerrit
+type slashCommand struct {
+	Command     string `json:"command"`
+	Text        string `json:"text"`
+	UserID      string `json:"user_id"`
+	ChannelID   string `json:"channel_id"`
+	ResponseURL string `json:"response_url"`
+}
+
+// slackUserRegexp matches an escaped user mention in a slash command, like
+// <@U123|alice>
+var slackUserRegexp = regexp.MustCompile(`^<@([A-Z0-9]+)(\|[^>]*)?>$`)
+
+// commandUsage is the reply to a slash command that isn't understood
+const commandUsage = "Usage: `/gerrit review <change number> @user`, " +
+	"`/gerrit abandon <change number> [reason]`, `/gerrit restore <change number> [reason]` " +
+	"or `/gerrit rebase <change number>`"
+
+// commandHandler runs the /gerrit slash command's subcommands and replies to
+// whoever ran it with the result, which only they can see. The subcommands are
+// run as the service's gerrit account so they can only be run by members of
+// group.
+type commandHandler struct {
+	client     *gerrit.Client
+	state      *slackState
+	httpClient *http.Client
+	group      string
+}
+
+// handle runs the command and replies with its result
+func (ch commandHandler) handle(cmd slashCommand) {
+	kv := llog.KV{"command": cmd.Command, "text": cmd.Text, "user": cmd.UserID}
+	args := strings.Fields(cmd.Text)
+	var reply string
+	var err error
+	switch {
+	case len(args) == 0:
+		reply = commandUsage
+	case args[0] == "review":
+		reply, err = ch.review(cmd.UserID, args[1:])
+	case guardedPastTense[args[0]] != "":
+		reply, err = ch.guarded(cmd.UserID, args[0], args[1:])
+	default:
+		reply = commandUsage
+	}
+	if err != nil {
+		llog.Warn("error running slash command", llog.ErrKV(err), kv)
+		reply = "Error: " + err.Error()
+	} else {
+		llog.Info("ran slash command", kv)
+	}
+	if err := ch.respond(cmd.ResponseURL, reply); err != nil {
+		llog.Error("error responding to slash command", llog.ErrKV(err), kv)
+	}
+}
+
+// review adds the slack user as a reviewer of the change if the user that ran
+// the command is a member of the group
+func (ch commandHandler) review(userID string, args []string) (string, error) {
+	if len(args) != 2 {
+		return commandUsage, nil
+	}
+	number, ok := parseChangeNumber(args[0])
+	if !ok {
+		return commandUsage, nil
+	}
+	if _, err := ch.allowed(userID); err != nil {
+		return "", err
+	}
+	email, err := ch.userEmail(args[1])
+	if err != nil {
+		return "", err
+	}
+	res, _, err := ch.client.Changes.AddReviewer(strconv.FormatInt(number, 10), &gerrit.ReviewerInput{Reviewer: email})
+	if err != nil {
+		return "", err
+	} else if res.Error != "" {
+		return "", errors.New(res.Error)
+	}
+	return fmt.Sprintf("Added %s as a reviewer of change %d", email, number), nil
+}
+
+// guardedPastTense is how the guarded subcommands are described once they're
+// done
+var guardedPastTense = map[string]string{
+	"abandon": "Abandoned",
+	"restore": "Restored",
+	"rebase":  "Rebased",
+}
+
+// guarded runs the abandon, restore or rebase subcommand if the user is a
+// member of the group. The reason, if any, is added to the change's message
+// along with who ran the command since it's run as the service's account.
+func (ch commandHandler) guarded(userID, sub string, args []string) (string, error) {
+	if len(args) == 0 || (sub == "rebase" && len(args) > 1) {
+		return commandUsage, nil
+	}
+	number, ok := parseChangeNumber(args[0])
+	if !ok {
+		return commandUsage, nil
+	}
+	email, err := ch.allowed(userID)
+	if err != nil {
+		return "", err
+	}
+	changeID := strconv.FormatInt(number, 10)
+	msg := fmt.Sprintf("%s from Slack by %s", guardedPastTense[sub], email)
+	if reason := strings.Join(args[1:], " "); reason != "" {
+		msg += ": " + reason
+	}
+	switch sub {
+	case "abandon":
+		_, _, err = ch.client.Changes.AbandonChange(changeID, &gerrit.AbandonInput{Message: msg, Notify: "ALL"})
+	case "restore":
+		_, _, err = ch.client.Changes.RestoreChange(changeID, &gerrit.RestoreInput{Message: msg})
+	case "rebase":
+		_, _, err = ch.client.Changes.RebaseChange(changeID, &gerrit.RebaseInput{})
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s change %d", guardedPastTense[sub], number), nil
+}
+
+// allowed returns the email of the slack user if their gerrit account, found
+// by that email, is a member of the group, otherwise an error is returned
+func (ch commandHandler) allowed(userID string) (string, error) {
+	if ch.group == "" {
+		return "", errors.New("this command is disabled since command-group isn't set")
+	}
+	email, err := ch.state.Email(userID)
+	if err != nil {
+		return "", err
+	} else if email == "" {
+		return "", llog.ErrWithKV(errors.New("slack user has no email"), llog.KV{"user": userID})
+	}
+	as, _, err := ch.client.Groups.ListGroupMembers(url.PathEscape(ch.group), &gerrit.ListGroupMembersOptions{
+		Recursive: true,
+	})
+	if err != nil {
+		return "", llog.ErrWithKV(err, llog.KV{"group": ch.group})
+	}
+	for _, a := range *as {
+		if strings.EqualFold(a.Email, email) {
+			return email, nil
+		}
+	}
+	return "", llog.ErrWithKV(errors.New("you're not allowed to run this command"), llog.KV{"user": userID, "group": ch.group})
+}
+
+// parseChangeNumber parses a change number, like 12345 or #12345
+func parseChangeNumber(s string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.TrimPrefix(s, "#"), 10, 64)
+	return n, err == nil && n > 0
+}
+
+// userEmail returns the email of the user mentioned in a slash command. Slack
+// only sends the user's id if the command escapes users, otherwise an email
+// has to be given instead.
+func (ch commandHandler) userEmail(arg string) (string, error) {
+	m := slackUserRegexp.FindStringSubmatch(arg)
+	if m == nil {
+		if strings.Contains(arg, "@") && !strings.HasPrefix(arg, "@") {
+			return arg, nil
+		}
+		return "", llog.ErrWithKV(errors.New("unknown user, mention them or use their email"), llog.KV{"user": arg})
+	}
+	email, err := ch.state.Email(m[1])
+	if err != nil {
+		return "", err
+	} else if email == "" {
+		return "", llog.ErrWithKV(errors.New("slack user has no email"), llog.KV{"user": m[1]})
+	}
+	return email, nil
+}
+
+// respond sends the reply to the response url, only the user that ran the
+// command sees it
+func (ch commandHandler) respond(u, text string) error {
+	if u == "" {
+		return errors.New("slash command has no response url")
+	}
+	b, err := json.Marshal(struct {
+		ResponseType string `json:"response_type"`
+		Text         string `json:"text"`
+	}{"ephemeral", text})
+	if err != nil {
+		return err
+	}
+	resp, err := ch.httpClient.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return llog.ErrWithKV(errors.New("unexpected status responding to slash command"), llog.KV{"status": resp.StatusCode})
+	}
+	return nil
+}
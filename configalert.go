@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/go-llog"
+)
+
+// configAlertInterval is how long to wait before posting the same broken config
+// to the admin channel again
+var configAlertInterval = 6 * time.Hour
+
+// configAlerter posts broken project configs to the admin channel, if it's
+// configured, so they get fixed instead of silently dropping messages
+type configAlerter struct {
+	webhookURL string
+	channel    string
+	sch        chan<- webhookSubmit
+
+	l sync.Mutex
+	// sent is when each error was last posted
+	sent map[string]time.Time
+}
+
+func newConfigAlerter(cfg config, sch chan<- webhookSubmit) *configAlerter {
+	return &configAlerter{
+		webhookURL: cfg.AdminWebhookURL,
+		channel:    cfg.AdminChannel,
+		sch:        sch,
+		sent:       map[string]time.Time{},
+	}
+}
+
+// configErrorFields returns the fields describing the broken config
+func configErrorFields(cerr project.ConfigError) []events.MessageField {
+	fs := []events.MessageField{
+		{Title: "Project", Value: cerr.Project, Short: true},
+	}
+	if cerr.Section != "" {
+		fs = append(fs, events.MessageField{Title: "Section", Value: cerr.Section, Short: true})
+	}
+	if cerr.Option != "" {
+		fs = append(fs,
+			events.MessageField{Title: "Option", Value: cerr.Option, Short: true},
+			events.MessageField{Title: "Value", Value: cerr.Value, Short: true},
+		)
+	}
+	return append(fs, events.MessageField{Title: "Error", Value: cerr.Err.Error()})
+}
+
+// alert posts the error if it's a project.ConfigError that hasn't been posted
+// recently
+func (a *configAlerter) alert(err error) {
+	var cerr project.ConfigError
+	if a == nil || a.webhookURL == "" || !errors.As(err, &cerr) {
+		return
+	}
+	key := cerr.Error()
+	a.l.Lock()
+	if time.Since(a.sent[key]) < configAlertInterval {
+		a.l.Unlock()
+		return
+	}
+	a.sent[key] = time.Now()
+	a.l.Unlock()
+
+	llog.Info("posting broken config to admin channel", llog.KV{"project": cerr.Project})
+	var msg events.Message
+	msg.Pretext = "Invalid gerrit-slack config for " + cerr.Project
+	msg.Fallback = msg.Pretext
+	msg.Color = "danger"
+	msg.Channel = a.channel
+	msg.Fields = configErrorFields(cerr)
+	a.sch <- webhookSubmit{
+		Message:    msg,
+		WebhookURL: a.webhookURL,
+		SourceType: "config",
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/go-llog"
+)
+
+// configWarmWorkers is how many project configs are loaded at once when
+// warming the config cache
+var configWarmWorkers = 10
+
+// metaConfigRef is the ref that holds each project's project.config
+const metaConfigRef = "refs/meta/config"
+
+// warmConfigCache loads the config of every active project so that they're
+// cached before the first events for them are handled
+func warmConfigCache(client *gerrit.Client, configs project.Provider) {
+	start := time.Now()
+	ps, _, err := client.Projects.ListProjects(&gerrit.ProjectOptions{})
+	if err != nil {
+		llog.Error("error listing projects to warm config cache", llog.ErrKV(err))
+		return
+	}
+	names := make(chan string)
+	var wg sync.WaitGroup
+	var failed int64
+	for i := 0; i < configWarmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if _, err := configs.LoadConfig(name); err != nil {
+					// it'll be alerted when an event for the project is handled
+					llog.Debug("error loading config to warm cache", llog.ErrKV(err), llog.KV{"project": name})
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+	var n int
+	for name, p := range *ps {
+		// read-only and hidden projects don't get any events
+		if p.State != "" && p.State != "ACTIVE" {
+			continue
+		}
+		names <- name
+		n++
+	}
+	close(names)
+	wg.Wait()
+	llog.Info("warmed config cache", llog.KV{
+		"numProjects": n,
+		"numFailed":   failed,
+		"duration":    time.Since(start),
+	})
+}
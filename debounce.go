@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+)
+
+// debouncedMessages are the messages for a change waiting for its project's
+// debounce window to end
+type debouncedMessages struct {
+	subs  []webhookSubmit
+	timer *time.Timer
+}
+
+// debouncer combines the messages for the same change and destination that are
+// sent within the project's debounce window into a single message
+type debouncer struct {
+	sch chan<- webhookSubmit
+
+	l       sync.Mutex
+	pending map[string]*debouncedMessages
+	// wg tracks the timers so Flush can wait for any that are sending
+	wg sync.WaitGroup
+}
+
+func newDebouncer(sch chan<- webhookSubmit) *debouncer {
+	return &debouncer{
+		sch:     sch,
+		pending: map[string]*debouncedMessages{},
+	}
+}
+
+// Add holds the message until the debounce window of its change's first
+// message ends
+func (d *debouncer) Add(s webhookSubmit) {
+	key := fmt.Sprintf("%s~%d~%s", s.Change.Project, s.Change.Number, s.ProjectConfig.DestinationName())
+	d.l.Lock()
+	defer d.l.Unlock()
+	if dm, ok := d.pending[key]; ok {
+		dm.subs = append(dm.subs, s)
+		return
+	}
+	dm := &debouncedMessages{subs: []webhookSubmit{s}}
+	d.wg.Add(1)
+	dm.timer = time.AfterFunc(s.ProjectConfig.Debounce, func() {
+		defer d.wg.Done()
+		d.l.Lock()
+		// it might have already been flushed
+		if d.pending[key] != dm {
+			d.l.Unlock()
+			return
+		}
+		delete(d.pending, key)
+		d.l.Unlock()
+		d.sch <- combineSubmits(dm.subs)
+	})
+	d.pending[key] = dm
+}
+
+// Flush sends all of the held messages now, it's called when shutting down
+func (d *debouncer) Flush() {
+	d.l.Lock()
+	pending := d.pending
+	d.pending = map[string]*debouncedMessages{}
+	d.l.Unlock()
+	for _, dm := range pending {
+		// if the timer already fired it won't send since it was removed
+		if dm.timer.Stop() {
+			d.wg.Done()
+		}
+		d.sch <- combineSubmits(dm.subs)
+	}
+	d.wg.Wait()
+}
+
+// combineSubmits combines the messages into one that's delivered like the
+// first one
+func combineSubmits(subs []webhookSubmit) webhookSubmit {
+	s := subs[0]
+	msgs := make([]events.Message, len(subs))
+	seen := map[string]bool{}
+	var recipients []string
+	for i, sub := range subs {
+		msgs[i] = sub.Message
+		for _, r := range sub.Recipients {
+			if !seen[r] {
+				seen[r] = true
+				recipients = append(recipients, r)
+			}
+		}
+	}
+	s.Message = events.Combine(msgs)
+	s.Recipients = recipients
+	if len(subs) > 1 {
+		s.SourceType = "debounced"
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+var (
+	// dedupSize is the most events that are remembered
+	dedupSize = 10000
+
+	// dedupTTL is how long an event is remembered, duplicates from other
+	// sources arrive within seconds of each other
+	dedupTTL = 10 * time.Minute
+)
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// eventDedup drops events that were already received, like when each primary
+// of a multi-site gerrit sends the same event. It's a small LRU of the events
+// that were recently seen.
+type eventDedup struct {
+	l    sync.Mutex
+	lru  *list.List
+	keys map[string]*list.Element
+}
+
+func newEventDedup() *eventDedup {
+	return &eventDedup{
+		lru:  list.New(),
+		keys: map[string]*list.Element{},
+	}
+}
+
+// dedupKey identifies the event. The actor and reviewer are included since
+// gerrit's timestamps are in seconds and, for example, several reviewers can be
+// added to the same patch set at once.
+func dedupKey(e gerritssh.Event) string {
+	return fmt.Sprintf("%s %s~%d %d %d %s %s %s %s",
+		e.Type,
+		e.Change.Project,
+		e.Change.Number,
+		e.PatchSet.Number,
+		e.TSCreated,
+		e.Actor().Username,
+		e.Reviewer.Email,
+		e.RefUpdate.RefName,
+		e.RefUpdate.NewRevision,
+	)
+}
+
+// duplicate returns true if the event was already seen and otherwise remembers
+// it. Events without a timestamp are never duplicates.
+func (d *eventDedup) duplicate(e gerritssh.Event) bool {
+	if e.TSCreated == 0 {
+		return false
+	}
+	key := dedupKey(e)
+	now := time.Now()
+	d.l.Lock()
+	defer d.l.Unlock()
+	if el, ok := d.keys[key]; ok && now.Sub(el.Value.(dedupEntry).seen) < dedupTTL {
+		d.lru.MoveToFront(el)
+		return true
+	} else if ok {
+		d.lru.Remove(el)
+	}
+	d.keys[key] = d.lru.PushFront(dedupEntry{key: key, seen: now})
+	for d.lru.Len() > dedupSize {
+		el := d.lru.Back()
+		d.lru.Remove(el)
+		delete(d.keys, el.Value.(dedupEntry).key)
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+func TestDedupKey(t *testing.T) {
+	base := gerritssh.Event{
+		Type:      gerritssh.EventTypeCommentAdded,
+		Change:    gerritssh.EventChange{Project: "proj", Number: 1},
+		PatchSet:  gerritssh.EventPatchSet{Number: 2},
+		Author:    gerritssh.EventAccount{Username: "alice"},
+		TSCreated: 1000,
+	}
+	tests := []struct {
+		name string
+		edit func(e *gerritssh.Event)
+		same bool
+	}{
+		{"identical", func(e *gerritssh.Event) {}, true},
+		{"comment", func(e *gerritssh.Event) { e.Comment = "different" }, true},
+		{"type", func(e *gerritssh.Event) { e.Type = gerritssh.EventTypeReviewerAdded }, false},
+		{"project", func(e *gerritssh.Event) { e.Change.Project = "other" }, false},
+		{"number", func(e *gerritssh.Event) { e.Change.Number = 10 }, false},
+		{"patch set", func(e *gerritssh.Event) { e.PatchSet.Number = 3 }, false},
+		{"timestamp", func(e *gerritssh.Event) { e.TSCreated = 1001 }, false},
+		{"actor", func(e *gerritssh.Event) { e.Author.Username = "bob" }, false},
+		{"reviewer", func(e *gerritssh.Event) { e.Reviewer.Email = "bob@example.com" }, false},
+		{"ref", func(e *gerritssh.Event) { e.RefUpdate.RefName = "refs/heads/main" }, false},
+		{"revision", func(e *gerritssh.Event) { e.RefUpdate.NewRevision = "abc" }, false},
+	}
+	for _, test := range tests {
+		e := base
+		test.edit(&e)
+		if same := dedupKey(base) == dedupKey(e); same != test.same {
+			t.Errorf("%s: dedupKey equal = %v, want %v", test.name, same, test.same)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// maxQueuedMessages is the most messages that can be waiting to be posted to a
+// single destination before sending it more blocks
+var maxQueuedMessages = 100
+
+// destination is somewhere messages are posted, like a webhook url. Each one
+// has its own workers and pending messages so one that's slow or failing
+// doesn't hold up the messages for the others.
+type destination struct {
+	queue   chan webhookSubmit
+	retryCh chan struct{}
+
+	// retryL is held while retrying so the spilled messages are only sent once
+	retryL sync.Mutex
+
+	l       sync.Mutex
+	pending []webhookSubmit
+	// spill holds the oldest pending messages once there are more than
+	// maxPending, it's nil unless pending-spill-dir is set
+	spill      *pendingSpill
+	maxPending int
+}
+
+// destinationKey identifies the destination of the message. Sinks that don't
+// use a webhook url, like slack-api, are a single destination.
+func destinationKey(s webhookSubmit) string {
+	if name := s.ProjectConfig.WebhookURLSecret; name != "" {
+		return sinkName(s) + " secret:" + name
+	}
+	return sinkName(s) + " " + s.WebhookURL
+}
+
+// destination returns the message's destination, starting its workers if it's
+// new
+func (sub *submitter) destination(s webhookSubmit) *destination {
+	key := destinationKey(s)
+	sub.l.Lock()
+	defer sub.l.Unlock()
+	if d, ok := sub.dests[key]; ok {
+		return d
+	}
+	d := &destination{
+		queue:      make(chan webhookSubmit, maxQueuedMessages),
+		retryCh:    make(chan struct{}, 1),
+		maxPending: sub.maxPending,
+	}
+	if sub.spillDir != "" {
+		d.spill = newPendingSpill(sub.spillDir, key)
+	}
+	sub.dests[key] = d
+	sub.destKeys = append(sub.destKeys, key)
+	sub.startWorkers(d)
+	return d
+}
+
+// destinations returns every destination in the order they were created
+func (sub *submitter) destinations() []*destination {
+	sub.l.Lock()
+	defer sub.l.Unlock()
+	ds := make([]*destination, len(sub.destKeys))
+	for i, key := range sub.destKeys {
+		ds[i] = sub.dests[key]
+	}
+	return ds
+}
+
+// startWorkers starts the workers that post the destination's messages, at
+// most concurrency of them are posted at once
+func (sub *submitter) startWorkers(d *destination) {
+	n := sub.concurrency
+	if n < 1 {
+		n = 1
+	}
+	sub.workers.Add(n)
+	for i := 0; i < n; i++ {
+		go sub.work(d)
+	}
+}
+
+// work posts the destination's messages until its queue is closed or the
+// submitter is stopped
+func (sub *submitter) work(d *destination) {
+	defer sub.workers.Done()
+	for {
+		select {
+		case s, ok := <-d.queue:
+			if !ok {
+				return
+			}
+			select {
+			case <-sub.stopping:
+				d.add(s)
+				return
+			default:
+			}
+			if !sub.publish(s) {
+				d.add(failed(s))
+			}
+		case <-d.retryCh:
+			sub.retryDestination(d, false)
+		}
+	}
+}
+
+func (d *destination) add(s webhookSubmit) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.pending = append(d.pending, s)
+	if d.spill == nil || len(d.pending) <= d.maxPending {
+		return
+	}
+	// the oldest are spilled since they're sent first
+	n := len(d.pending) - d.maxPending
+	if err := d.spill.write(d.pending[:n]); err != nil {
+		llog.Error("error spilling pending messages", llog.ErrKV(err), llog.KV{"numMessages": n})
+		return
+	}
+	d.pending = append([]webhookSubmit(nil), d.pending[n:]...)
+}
+
+// drain moves the destination's queued messages to its pending messages
+func (d *destination) drain() {
+	for {
+		select {
+		case s, ok := <-d.queue:
+			if !ok {
+				return
+			}
+			d.add(s)
+		default:
+			return
+		}
+	}
+}
+
+// allPending returns the destination's spilled and pending messages, oldest
+// first
+func (d *destination) allPending() []webhookSubmit {
+	d.l.Lock()
+	defer d.l.Unlock()
+	var ss []webhookSubmit
+	if d.spill != nil {
+		var err error
+		if ss, err = d.spill.all(); err != nil {
+			llog.Error("error reading spilled messages", llog.ErrKV(err))
+		}
+	}
+	return append(ss, d.pending...)
+}
+
+// clear drops the destination's spilled and pending messages and returns how
+// many were dropped
+func (d *destination) clear() int {
+	d.l.Lock()
+	defer d.l.Unlock()
+	n := len(d.pending)
+	d.pending = nil
+	if d.spill != nil {
+		n += d.spill.n
+		d.spill.clear()
+	}
+	return n
+}
+
+// replaySpill sends the spilled messages in order and returns false if one of
+// them couldn't be sent, in which case it and the rest stay spilled
+func (sub *submitter) replaySpill(d *destination) bool {
+	if d.spill == nil {
+		return true
+	}
+	for {
+		d.l.Lock()
+		s, size, ok, err := d.spill.peek()
+		if err != nil && size > 0 {
+			llog.Error("skipping invalid spilled message", llog.ErrKV(err))
+			d.spill.advance(size)
+		} else if err != nil {
+			llog.Error("error reading spilled messages, dropping them", llog.ErrKV(err), llog.KV{"numMessages": d.spill.n})
+			d.spill.clear()
+		}
+		d.l.Unlock()
+		if err != nil {
+			continue
+		} else if !ok {
+			return true
+		}
+		if !sub.publish(s) {
+			return false
+		}
+		d.l.Lock()
+		d.spill.advance(size)
+		d.l.Unlock()
+	}
+}
+
+// signalRetry makes one of the destination's workers retry its pending
+// messages
+func (d *destination) signalRetry() {
+	select {
+	case d.retryCh <- struct{}{}:
+	default:
+		// a retry is already queued
+	}
+}
+
+// retryDestination attempts to post all of the destination's pending messages.
+// Messages held for quiet hours are kept unless force is true.
+func (sub *submitter) retryDestination(d *destination, force bool) {
+	d.retryL.Lock()
+	defer d.retryL.Unlock()
+	// the spilled messages are older than the ones in memory so those wait
+	// until they're all sent
+	if !sub.replaySpill(d) {
+		return
+	}
+
+	d.l.Lock()
+	pending := d.pending
+	d.pending = nil
+	d.l.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	var newPend []webhookSubmit
+	for _, s := range pending {
+		if !force && s.ProjectConfig.Quiet(time.Now()) {
+			newPend = append(newPend, s)
+		} else if !sub.publish(s) {
+			newPend = append(newPend, failed(s))
+		}
+	}
+	d.l.Lock()
+	// anything added while we were retrying goes after what's still pending
+	d.pending = append(newPend, d.pending...)
+	d.l.Unlock()
+}
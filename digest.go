@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/digest"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/report"
+	"github.com/levenlabs/go-llog"
+)
+
+var (
+	// digestCheckInterval is how often we check if a digest needs to be posted
+	digestCheckInterval = time.Minute
+
+	// digestProjectsInterval is how often the list of projects with digests is
+	// reloaded
+	digestProjectsInterval = time.Hour
+)
+
+// scheduledProjects returns the configs of all enabled projects that want
+// returns true for. Since it loads every project's config, broken configs are
+// alerted.
+func scheduledProjects(client *gerrit.Client, configs project.Provider, alerts *configAlerter, want func(project.Config) bool) (map[string]project.Config, error) {
+	ps, _, err := client.Projects.ListProjects(&gerrit.ProjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	cfgs := map[string]project.Config{}
+	for name := range *ps {
+		pcfg, err := configs.LoadConfig(name)
+		if err != nil {
+			llog.Error("error loading config for scheduled messages", llog.ErrKV(err), llog.KV{"project": name})
+			alerts.alert(err)
+			continue
+		}
+		if !pcfg.Enabled || !want(pcfg) {
+			continue
+		}
+		cfgs[name] = pcfg
+	}
+	return cfgs, nil
+}
+
+// digestProjects returns the configs of all projects that have a digest or a
+// weekly report enabled
+func digestProjects(client *gerrit.Client, configs project.Provider, alerts *configAlerter) (map[string]project.Config, error) {
+	return scheduledProjects(client, configs, alerts, func(pcfg project.Config) bool {
+		return pcfg.DigestTime != "" || pcfg.ReportTime != ""
+	})
+}
+
+// digestDue returns the date of the digest that should be sent for the config
+// at the given time
+func digestDue(pcfg project.Config, now time.Time) (string, bool) {
+	loc := pcfg.Location()
+	now = now.In(loc)
+	t, err := time.Parse(project.TimeFormat, pcfg.DigestTime)
+	if err != nil {
+		return "", false
+	}
+	due := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	return now.Format("2006-01-02"), !now.Before(due)
+}
+
+// reportDue returns when the config's most recent weekly report, as of the
+// given time, was due
+func reportDue(pcfg project.Config, now time.Time) (time.Time, bool) {
+	if pcfg.ReportTime == "" {
+		return time.Time{}, false
+	}
+	wd, t, err := project.ParseWeekdayTime(pcfg.ReportTime)
+	if err != nil {
+		return time.Time{}, false
+	}
+	loc := pcfg.Location()
+	now = now.In(loc)
+	days := (int(now.Weekday()) - int(wd) + 7) % 7
+	due := time.Date(now.Year(), now.Month(), now.Day()-days, t.Hour(), t.Minute(), 0, 0, loc)
+	if now.Before(due) {
+		due = due.AddDate(0, 0, -7)
+	}
+	return due, true
+}
+
+// sendReport posts the project's review statistics for the week before due
+func sendReport(client *gerrit.Client, name string, pcfg project.Config, due time.Time, sch chan<- webhookSubmit, bots *botFilter, optOutHashtag string) {
+	ignore := func(username string) bool {
+		return bots.isBot(username) || pcfg.IsCIAccount(username)
+	}
+	msg, ok, err := report.Message(client, name, due.AddDate(0, 0, -7), due, optOutHashtag, ignore)
+	if err != nil {
+		llog.Error("error building weekly report", llog.ErrKV(err), llog.KV{"project": name})
+		return
+	}
+	if !ok {
+		return
+	}
+	msg.Channel = pcfg.Channel
+	msg.Color = "good"
+	sch <- webhookSubmit{
+		Message:       msg,
+		WebhookURL:    pcfg.WebhookURL,
+		SourceType:    "report",
+		ProjectConfig: pcfg,
+	}
+}
+
+// digestScheduler posts digests and weekly reports until the context is
+// cancelled
+func digestScheduler(ctx context.Context, client *gerrit.Client, configs project.Provider, sch chan<- webhookSubmit, alerts *configAlerter, bots *botFilter, optOutHashtag string) {
+	var cfgs map[string]project.Config
+	var loaded time.Time
+	// lastSent holds the date of the last digest sent for each project and
+	// lastReport holds when the last weekly report sent for each was due
+	lastSent := map[string]string{}
+	lastReport := map[string]time.Time{}
+
+	tick := time.NewTicker(digestCheckInterval)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		if time.Since(loaded) > digestProjectsInterval {
+			newCfgs, err := digestProjects(client, configs, alerts)
+			if err != nil {
+				llog.Error("error loading projects for digest", llog.ErrKV(err))
+			} else {
+				for name, pcfg := range newCfgs {
+					// don't immediately send a digest for a project we just found
+					// if today's digest time already passed
+					if _, ok := lastSent[name]; !ok {
+						if date, due := digestDue(pcfg, now); due {
+							lastSent[name] = date
+						}
+					}
+					if _, ok := lastReport[name]; !ok {
+						if due, ok := reportDue(pcfg, now); ok {
+							lastReport[name] = due
+						}
+					}
+				}
+				cfgs = newCfgs
+				loaded = time.Now()
+			}
+		}
+		for name, pcfg := range cfgs {
+			if due, ok := reportDue(pcfg, now); ok && !due.Equal(lastReport[name]) {
+				lastReport[name] = due
+				sendReport(client, name, pcfg, due, sch, bots, optOutHashtag)
+			}
+			if pcfg.DigestTime == "" {
+				continue
+			}
+			date, due := digestDue(pcfg, now)
+			if !due || lastSent[name] == date {
+				continue
+			}
+			lastSent[name] = date
+			msg, ok, err := digest.Message(client, name, optOutHashtag)
+			if err != nil {
+				llog.Error("error building digest", llog.ErrKV(err), llog.KV{"project": name})
+				continue
+			}
+			if !ok {
+				continue
+			}
+			msg.Channel = pcfg.Channel
+			msg.Color = "good"
+			sch <- webhookSubmit{
+				Message:       msg,
+				WebhookURL:    pcfg.WebhookURL,
+				SourceType:    "digest",
+				ProjectConfig: pcfg,
+			}
+		}
+	}
+}
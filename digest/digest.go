@@ -0,0 +1,91 @@
+package digest
+
+import (
+	"fmt"
+	"strings"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// maxChanges is the most changes listed in a single section of the digest
+const maxChanges = 10
+
+type section struct {
+	title string
+	query string
+}
+
+var sections = []section{
+	{
+		title: "Ready to submit",
+		query: "is:submittable",
+	},
+	{
+		title: "Unresolved comments",
+		query: "-is:submittable has:unresolved",
+	},
+	{
+		title: "Awaiting review",
+		query: "-is:submittable -has:unresolved",
+	},
+}
+
+// Message builds a digest of the open changes in the given project. Owners are
+// not mentioned since that would ping everyone every day. If there are no open
+// changes then false is returned. Changes with the optOutHashtag, if it's set,
+// are left out.
+func Message(client *gerrit.Client, project, optOutHashtag string) (events.Message, bool, error) {
+	var m events.Message
+	m.Pretext = fmt.Sprintf("Daily digest for %s", project)
+	m.Fallback = m.Pretext
+	var optOut string
+	if optOutHashtag != "" {
+		optOut = fmt.Sprintf(` -hashtag:"%s"`, optOutHashtag)
+	}
+	var total int
+	for _, s := range sections {
+		cs, _, err := client.Changes.QueryChanges(&gerrit.QueryChangeOptions{
+			QueryOptions: gerrit.QueryOptions{
+				Query: []string{fmt.Sprintf(`project:"%s" status:open -is:wip -is:private%s %s`, project, optOut, s.query)},
+				Limit: maxChanges + 1,
+			},
+			ChangeOptions: gerrit.ChangeOptions{
+				AdditionalFields: []string{"DETAILED_ACCOUNTS"},
+			},
+		})
+		if err != nil {
+			return m, false, err
+		}
+		if len(*cs) == 0 {
+			continue
+		}
+		total += len(*cs)
+		m.Fields = append(m.Fields, changesField(client, s.title, *cs))
+	}
+	return m, total > 0, nil
+}
+
+func changesField(client *gerrit.Client, title string, cs []gerrit.ChangeInfo) events.MessageField {
+	var more bool
+	if len(cs) > maxChanges {
+		cs = cs[:maxChanges]
+		more = true
+	}
+	lines := make([]string, 0, len(cs)+1)
+	for _, c := range cs {
+		lines = append(lines, fmt.Sprintf("<%s|%s> (%s)",
+			gerritssh.ChangeURL(gerritssh.WebURL(client), c.Project, int64(c.Number)),
+			c.Subject,
+			c.Owner.Name,
+		))
+	}
+	if more {
+		lines = append(lines, "and more…")
+	}
+	return events.MessageField{
+		Title: title,
+		Value: strings.Join(lines, "\n"),
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/levenlabs/gerrit-slack/project"
+)
+
+// configValue formats a config field's value, dereferencing pointers
+func configValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// runEffectiveConfig prints every option of the project's config, for the
+// branch if it's not empty, along with where it was set and returns the exit
+// code
+func runEffectiveConfig(configs project.Provider, name, branch string) int {
+	if name == "" {
+		fmt.Println("usage: gerrit-slack effective-config <project> [branch]")
+		return 2
+	}
+	pcfg, err := configs.LoadConfig(name)
+	if err == nil && branch != "" {
+		pcfg, err = pcfg.ForBranch(branch)
+	}
+	if err != nil {
+		fmt.Printf("error loading config: %s\n", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	v := reflect.ValueOf(pcfg)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		option := t.Field(i).Tag.Get("ini")
+		if option == "" || option == "-" {
+			continue
+		}
+		value := configValue(v.Field(i))
+		// the webhook url is a secret
+		if option == "webhookurl" && value != "" {
+			value = "<redacted>"
+		}
+		source := pcfg.Source(option)
+		if source == "" {
+			source = "(default)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", option, value, source)
+	}
+	w.Flush()
+
+	for _, d := range pcfg.Destinations {
+		fmt.Printf("\ndestination %q:\n", d.Name)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		dv := reflect.ValueOf(d)
+		dt := dv.Type()
+		for i := 0; i < dt.NumField(); i++ {
+			option := dt.Field(i).Tag.Get("ini")
+			value := configValue(dv.Field(i))
+			if option == "" || option == "-" || value == "" {
+				continue
+			}
+			if option == "webhookurl" {
+				value = "<redacted>"
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", option, strings.TrimSpace(value))
+		}
+		w.Flush()
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+)
+
+var (
+	// escalationCheckInterval is how often unreviewed changes are checked
+	escalationCheckInterval = 15 * time.Minute
+
+	// escalationMaxChanges is the most unreviewed changes in a project that
+	// are checked at once, the oldest are escalated first
+	escalationMaxChanges = 100
+)
+
+const (
+	// escalationReviewers is the level of a change whose reviewers were
+	// mentioned again
+	escalationReviewers = 1
+
+	// escalationUsergroup is the level of a change whose project's
+	// escalate-usergroup was mentioned
+	escalationUsergroup = 2
+)
+
+// escalationSourceType is the SourceType of the escalation messages
+const escalationSourceType = "escalation"
+
+// escalationLevel returns how far a change that has waited that long for a
+// review should be escalated
+func escalationLevel(pcfg project.Config, waited time.Duration) int {
+	switch {
+	case pcfg.EscalateUsergroupAfter > 0 && waited >= pcfg.EscalateUsergroupAfter:
+		return escalationUsergroup
+	case pcfg.EscalateReviewersAfter > 0 && waited >= pcfg.EscalateReviewersAfter:
+		return escalationReviewers
+	default:
+		return 0
+	}
+}
+
+// escalationScheduler escalates unreviewed changes, as set by the escalate-*
+// options, until the context is cancelled
+func (eh eventHandler) escalationScheduler(ctx context.Context) {
+	var cfgs map[string]project.Config
+	var loaded time.Time
+	// escalated holds the level of each project's unreviewed changes
+	escalated := map[string]map[int64]int{}
+
+	tick := time.NewTicker(escalationCheckInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		if time.Since(loaded) > digestProjectsInterval {
+			newCfgs, err := scheduledProjects(eh.client, eh.configs, eh.alerts, project.Config.Escalates)
+			if err != nil {
+				llog.Error("error loading projects for escalation", llog.ErrKV(err))
+			} else {
+				cfgs = newCfgs
+				loaded = time.Now()
+			}
+		}
+		for name, pcfg := range cfgs {
+			levels, err := eh.escalate(ctx, name, pcfg, escalated[name])
+			if err != nil {
+				llog.Error("error escalating unreviewed changes", llog.ErrKV(err), llog.KV{"project": name})
+				continue
+			}
+			escalated[name] = levels
+		}
+	}
+}
+
+// escalate mentions the reviewers or the usergroup of the project's changes
+// that have waited too long for a review. It returns the level of each of the
+// project's unreviewed changes, which is passed back in as levels the next
+// time so changes that were already escalated aren't escalated again.
+func (eh eventHandler) escalate(ctx context.Context, name string, pcfg project.Config, levels map[int64]int) (map[int64]int, error) {
+	es, err := gerritssh.UnreviewedChanges(eh.client, name, escalationMaxChanges)
+	if err != nil {
+		return levels, err
+	}
+	newLevels := make(map[int64]int, len(es))
+	for _, e := range es {
+		waited := time.Since(time.Unix(e.Change.TSCreated, 0))
+		level := escalationLevel(pcfg, waited)
+		if level == 0 {
+			continue
+		}
+		change := store.Change{Project: e.Change.Project, Number: e.Change.Number}
+		prev, ok := levels[e.Change.Number]
+		if !ok {
+			// the last level is only in the store if we restarted
+			r, _, err := eh.changes.Get(change)
+			if err != nil {
+				llog.Error("error getting change's escalation", llog.ErrKV(err), e.KV())
+			}
+			prev = r.Escalation
+		}
+		newLevels[e.Change.Number] = prev
+		if level <= prev || eh.optedOut(e) {
+			continue
+		}
+		newLevels[e.Change.Number] = level
+		if err := eh.changes.SetEscalation(change, level); err != nil {
+			llog.Error("error recording change's escalation", llog.ErrKV(err), e.KV())
+		}
+
+		mentions := eh.escalationMentions(e, pcfg, level)
+		if len(mentions) == 0 {
+			llog.Debug("nobody to mention for escalation", e.KV(), llog.KV{"level": level})
+			continue
+		}
+		msg := events.EscalationMessage(e, waited, mentions)
+		if eh.replyInThread(ctx, escalationSourceType, e.Change, pcfg, msg) {
+			continue
+		}
+		msg.Channel = pcfg.Channel
+		eh.sch <- webhookSubmit{
+			Message:       msg,
+			WebhookURL:    pcfg.WebhookURL,
+			SourceType:    escalationSourceType,
+			ProjectConfig: pcfg,
+			ctx:           ctx,
+		}
+	}
+	return newLevels, nil
+}
+
+// escalationMentions returns who to mention for the change at the level. The
+// reviewers are mentioned by name if they can't be looked up or if the
+// project's mention-policy is never.
+func (eh eventHandler) escalationMentions(e gerritssh.Event, pcfg project.Config, level int) []string {
+	if level == escalationUsergroup {
+		return []string{fmt.Sprintf("<!subteam^%s>", pcfg.EscalateUsergroup)}
+	}
+	var mentions []string
+	for _, a := range e.Reviewers[gerritssh.ReviewerStateReviewer] {
+		if a.Email == e.Change.Owner.Email {
+			continue
+		}
+		var id string
+		if pcfg.MentionPolicy != project.MentionPolicyNever {
+			id = eh.state.UserID(a.Email)
+		}
+		if id != "" {
+			mentions = append(mentions, fmt.Sprintf("<@%s>", id))
+		} else if a.Name != "" {
+			mentions = append(mentions, a.Name)
+		}
+	}
+	return mentions
+}
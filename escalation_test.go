@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/project"
+)
+
+func TestEscalationLevel(t *testing.T) {
+	both := project.Config{
+		EscalateReviewersAfter: 24 * time.Hour,
+		EscalateUsergroupAfter: 72 * time.Hour,
+		EscalateUsergroup:      "S123",
+	}
+	tests := []struct {
+		pcfg   project.Config
+		waited time.Duration
+		level  int
+	}{
+		{project.Config{}, 1000 * time.Hour, 0},
+		{both, time.Hour, 0},
+		{both, 24 * time.Hour, escalationReviewers},
+		{both, 48 * time.Hour, escalationReviewers},
+		{both, 72 * time.Hour, escalationUsergroup},
+		{both, 100 * time.Hour, escalationUsergroup},
+		{project.Config{EscalateReviewersAfter: time.Hour}, 100 * time.Hour, escalationReviewers},
+		{project.Config{EscalateUsergroupAfter: time.Hour, EscalateUsergroup: "S123"}, 30 * time.Minute, 0},
+		{project.Config{EscalateUsergroupAfter: time.Hour, EscalateUsergroup: "S123"}, time.Hour, escalationUsergroup},
+	}
+	for _, test := range tests {
+		if level := escalationLevel(test.pcfg, test.waited); level != test.level {
+			t.Errorf("escalationLevel(reviewers after %v, usergroup after %v, %v) = %d, want %d",
+				test.pcfg.EscalateReviewersAfter, test.pcfg.EscalateUsergroupAfter, test.waited, level, test.level)
+		}
+	}
+}
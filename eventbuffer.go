@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+const (
+	// overflowBlock stops reading events from the source until the handlers
+	// catch up
+	overflowBlock = "block"
+
+	// overflowDropOldest drops the oldest buffered event to make room
+	overflowDropOldest = "drop-oldest"
+
+	// overflowSpill writes events to the event-spill-path file until the
+	// handlers catch up
+	overflowSpill = "spill"
+)
+
+// spilledEvent is an event as it's written to the spill file. The raw json
+// isn't marshaled with the event so it's kept separately.
+type spilledEvent struct {
+	Event gerritssh.Event `json:"event"`
+	Raw   json.RawMessage `json:"raw,omitempty"`
+}
+
+// eventSpill is a file that events are appended to and read back from in order
+type eventSpill struct {
+	path string
+	f    *os.File
+	r    *bufio.Reader
+	// end is where the next event is written, it's tracked separately since
+	// seeking would move the reader
+	end int64
+	// n is how many events are in the file that haven't been read
+	n int
+}
+
+func newEventSpill(path string) (*eventSpill, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	return &eventSpill{path: path, f: f, r: bufio.NewReader(f)}, nil
+}
+
+// write appends the event to the end of the file
+func (es *eventSpill) write(e gerritssh.Event) error {
+	b, err := json.Marshal(spilledEvent{Event: e, Raw: e.Raw})
+	if err != nil {
+		return err
+	}
+	n, err := es.f.WriteAt(append(b, '\n'), es.end)
+	es.end += int64(n)
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": es.path})
+	}
+	es.n++
+	return nil
+}
+
+// read returns the oldest event that hasn't been read yet. Once every event was
+// read, or if the file can't be read, the file is truncated.
+func (es *eventSpill) read() (gerritssh.Event, error) {
+	var se spilledEvent
+	if es.n == 0 {
+		return se.Event, errors.New("no spilled events")
+	}
+	b, err := es.r.ReadBytes('\n')
+	if err != nil {
+		// the rest of the file can't be trusted so drop it
+		llog.Warn("dropping spilled events", llog.KV{"path": es.path, "numEvents": es.n})
+		es.n = 0
+		if rerr := es.reset(); rerr != nil {
+			llog.Error("error resetting event spill file", llog.ErrKV(rerr))
+		}
+		return se.Event, llog.ErrWithKV(err, llog.KV{"path": es.path})
+	}
+	es.n--
+	if es.n == 0 {
+		if err := es.reset(); err != nil {
+			return se.Event, err
+		}
+	}
+	if err := json.Unmarshal(b, &se); err != nil {
+		return se.Event, llog.ErrWithKV(err, llog.KV{"path": es.path})
+	}
+	se.Event.Raw = se.Raw
+	return se.Event, nil
+}
+
+// reset truncates the file and starts reading from its beginning
+func (es *eventSpill) reset() error {
+	if err := es.f.Truncate(0); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": es.path})
+	}
+	if _, err := es.f.Seek(0, io.SeekStart); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": es.path})
+	}
+	es.r.Reset(es.f)
+	es.end = 0
+	return nil
+}
+
+// close closes and removes the file
+func (es *eventSpill) close() {
+	es.f.Close()
+	if err := os.Remove(es.path); err != nil {
+		llog.Warn("error removing event spill file", llog.ErrKV(err), llog.KV{"path": es.path})
+	}
+}
+
+// bufferEvents sends the events from in to out, buffering up to size of them
+// so that the source isn't blocked by slow handlers. Once size events are
+// buffered the oldest is dropped or, if spill is set, events are written to it
+// until the handlers catch up. out is closed once in is closed and every
+// buffered event was sent.
+func bufferEvents(in <-chan gerritssh.Event, out chan<- gerritssh.Event, size int, spill *eventSpill) {
+	defer close(out)
+	if spill != nil {
+		defer spill.close()
+	}
+	if size < 1 {
+		size = 1
+	}
+	buf := make([]gerritssh.Event, 0, size)
+	for in != nil || len(buf) > 0 {
+		var sendCh chan<- gerritssh.Event
+		var next gerritssh.Event
+		if len(buf) > 0 {
+			sendCh = out
+			next = buf[0]
+		}
+		select {
+		case e, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			// once events are spilled the rest have to be too so they stay
+			// in order
+			if len(buf) < size && (spill == nil || spill.n == 0) {
+				buf = append(buf, e)
+			} else if spill != nil {
+				if err := spill.write(e); err != nil {
+					llog.Error("error spilling event, dropping it", llog.ErrKV(err), e.KV())
+				} else if spill.n == 1 {
+					llog.Warn("event buffer is full, spilling events to disk", llog.KV{"path": spill.path})
+				}
+			} else {
+				llog.Warn("event buffer is full, dropping oldest event", buf[0].KV(), llog.KV{"created": buf[0].TSCreated})
+				buf = append(buf[1:], e)
+			}
+		case sendCh <- next:
+			buf = buf[1:]
+			if spill == nil || spill.n == 0 {
+				continue
+			}
+			e, err := spill.read()
+			if err != nil {
+				llog.Error("error reading spilled event", llog.ErrKV(err))
+				continue
+			}
+			buf = append(buf, e)
+			if spill.n == 0 {
+				llog.Info("caught up on spilled events")
+			}
+		}
+	}
+}
+
+// newEventChannels returns the channel that the source sends events to and the
+// channel that they're handled from, with the buffer between them that's
+// configured by event-buffer-size and event-overflow
+func newEventChannels(cfg config) (chan gerritssh.Event, <-chan gerritssh.Event) {
+	var spill *eventSpill
+	switch cfg.EventOverflow {
+	case overflowBlock, "":
+		ech := make(chan gerritssh.Event, cfg.EventBufferSize)
+		return ech, ech
+	case overflowDropOldest:
+	case overflowSpill:
+		if cfg.EventSpillPath == "" {
+			llog.Fatal("event-spill-path is required to spill events", llog.KV{"event-overflow": cfg.EventOverflow})
+		}
+		var err error
+		if spill, err = newEventSpill(cfg.EventSpillPath); err != nil {
+			llog.Fatal("error creating event spill file", llog.ErrKV(err))
+		}
+	default:
+		llog.Fatal("unknown event-overflow", llog.KV{"event-overflow": cfg.EventOverflow})
+	}
+	ech := make(chan gerritssh.Event)
+	hch := make(chan gerritssh.Event)
+	go bufferEvents(ech, hch, cfg.EventBufferSize, spill)
+	return ech, hch
+}
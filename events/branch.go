@@ -0,0 +1,47 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// branchProtectionHint is added to branch messages to point at how to stop
+// branches from being created or deleted directly
+const branchProtectionHint = "Only grant the %s Reference permission on refs/heads/* to the accounts that should %s branches"
+
+// BranchMessage returns the message for the ref-updated event that created or
+// deleted a branch
+func BranchMessage(e gerritssh.Event, branch string, deleted bool) Message {
+	action, verb, permission := "created", "create", "Create"
+	rev := e.RefUpdate.NewRevision
+	if deleted {
+		action, verb, permission = "deleted", "delete", "Delete"
+		rev = e.RefUpdate.OldRevision
+	}
+	by := e.Submitter.Name
+	if by == "" {
+		by = e.Submitter.Username
+	}
+	if by == "" {
+		by = "someone"
+	}
+
+	var m Message
+	m.Pretext = fmt.Sprintf("%s %s branch %s in %s", by, action, branch, e.RefUpdate.Project)
+	m.Fallback = m.Pretext
+	m.Fields = []MessageField{
+		{Title: "Project", Value: e.RefUpdate.Project, Short: true},
+		{Title: "Branch", Value: branch, Short: true},
+		{Title: "Revision", Value: rev, Short: true},
+	}
+	if e.Submitter.Email != "" {
+		m.Fields = append(m.Fields, MessageField{Title: "Email", Value: e.Submitter.Email, Short: true})
+	}
+	m.Text = fmt.Sprintf(branchProtectionHint, permission, verb)
+	m.Color = "good"
+	if deleted {
+		m.Color = "danger"
+	}
+	return m
+}
@@ -27,7 +27,7 @@ func (ChangeMerged) Ignore(e gerritssh.Event, pcfg project.Config) (bool, error)
 }
 
 // Message implements the EventHandler interface
-func (ChangeMerged) Message(e gerritssh.Event, _ project.Config, _ *gerrit.Client, me MessageEnricher) (Message, error) {
+func (ChangeMerged) Message(e gerritssh.Event, pcfg project.Config, c *gerrit.Client, me MessageEnricher) (Message, error) {
 	// we let the owner know their change was merged
 	var m Message
 	m.Fallback = fmt.Sprintf("%s: merged %s: %s",
@@ -37,5 +37,10 @@ func (ChangeMerged) Message(e gerritssh.Event, _ project.Config, _ *gerrit.Clien
 	)
 	m.Pretext = DefaultPretext("Merged", e)
 	m.Fields = []MessageField{OwnerField(e, me), ProjectField(e)}
-	return m, nil
+	if pcfg.ShowChangeAge && e.Change.TSCreated > 0 {
+		m.Fields = append(m.Fields, AgeField(e))
+	}
+	m.Text = truncatedText(CommitMessageText(e.Change.CommitMessage, pcfg.ShowCommitMessage), pcfg, e.Change.URL, "commit message")
+	err := appendSubmitRequirements(&m, e, pcfg, c)
+	return m, err
 }
@@ -0,0 +1,64 @@
+package events
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+)
+
+// buildURLRegexp matches a link in a CI account's comment
+var buildURLRegexp = regexp.MustCompile(`https?://[^\s<>()\[\]]+`)
+
+// CIFailure returns true if the event is one of the project's ci-accounts
+// changing its vote on its ci-label to -1 or lower, along with the first link
+// in its comment, which is usually the failing build, if there is one. Comments
+// that leave the vote as it was, like a rerun that failed again, are ignored.
+func CIFailure(e gerritssh.Event, pcfg project.Config) (string, bool) {
+	if e.Type != gerritssh.EventTypeCommentAdded || !pcfg.IsCIAccount(e.Author.Username) || !changedVote(e) {
+		return "", false
+	}
+	for _, v := range e.Approvals {
+		if v.Type != pcfg.CILabel {
+			continue
+		}
+		if v.OldValue == "" || v.OldValue == v.Value {
+			return "", false
+		}
+		if n, err := strconv.Atoi(v.Value); err != nil || n >= 0 {
+			return "", false
+		}
+		return buildURLRegexp.FindString(e.Comment), true
+	}
+	return "", false
+}
+
+// CIFailureMessage returns the message telling the change's owner that CI
+// failed. The mention is prepended to it unless it's empty, like in a direct
+// message.
+func CIFailureMessage(e gerritssh.Event, pcfg project.Config, buildURL, mention string) Message {
+	var m Message
+	m.Fallback = fmt.Sprintf("%s failed on patch set %d of %s: %s",
+		pcfg.CILabel,
+		e.PatchSet.Number,
+		e.Change.URL,
+		e.Change.Subject,
+	)
+	m.Pretext = fmt.Sprintf("%s failed on patch set %d of %s: <%s|%s>",
+		pcfg.CILabel,
+		e.PatchSet.Number,
+		e.Change.Project,
+		e.Change.URL,
+		e.Change.Subject,
+	)
+	if mention != "" {
+		m.Pretext = mention + " " + m.Pretext
+	}
+	if buildURL != "" {
+		m.Text = fmt.Sprintf("<%s|View the failed build>", buildURL)
+	}
+	m.Color = "danger"
+	return m
+}
@@ -3,10 +3,12 @@ package events
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/andygrunwald/go-gerrit"
 	"github.com/levenlabs/gerrit-slack/gerritssh"
 	"github.com/levenlabs/gerrit-slack/project"
+	llog "github.com/levenlabs/go-llog"
 )
 
 func init() {
@@ -22,6 +24,17 @@ func (CommentAdded) Type() string {
 	return gerritssh.EventTypeCommentAdded
 }
 
+// changedVote returns true if the comment changed at least one vote
+func changedVote(e gerritssh.Event) bool {
+	// TODO: remove this once https://bugs.chromium.org/p/gerrit/issues/detail?id=8494
+	for _, v := range e.Approvals {
+		if v.OldValue != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Ignore implements the EventHandler interface
 func (CommentAdded) Ignore(e gerritssh.Event, pcfg project.Config) (bool, error) {
 	if !pcfg.PublishOnCommentAdded {
@@ -34,6 +47,9 @@ func (CommentAdded) Ignore(e gerritssh.Event, pcfg project.Config) (bool, error)
 	if ignore {
 		return true, nil
 	}
+	if pcfg.IgnoreOwnerComments && e.Author.Email == e.Change.Owner.Email && !changedVote(e) {
+		return true, nil
+	}
 	// if the comment contains 2 new-lines then there was a comment WITH the votes
 	// so there's no reason to check votes
 	if len(e.Approvals) == 0 || strings.Contains(e.Comment, "\n\n") {
@@ -48,14 +64,14 @@ func (CommentAdded) Ignore(e gerritssh.Event, pcfg project.Config) (bool, error)
 			if err != nil {
 				return false, err
 			}
-			// if we shouldn't ignore this label then immediately bail
-			if !ignore {
+			// if we shouldn't ignore this vote then immediately bail
+			if !ignore && pcfg.PublishVote(v.Type, v.Value) {
 				return false, nil
 			}
 		}
 	}
 	// if we found at least one vote then we should ignore because that means that
-	// IgnoreOnlyLabels matched all of the voted labels
+	// IgnoreOnlyLabels or PublishOnlyOnLabels filtered out all of the votes
 	if voted {
 		return true, nil
 	}
@@ -63,20 +79,10 @@ func (CommentAdded) Ignore(e gerritssh.Event, pcfg project.Config) (bool, error)
 }
 
 // Message implements the EventHandler interface
-func (CommentAdded) Message(e gerritssh.Event, _ project.Config, c *gerrit.Client, me MessageEnricher) (Message, error) {
+func (CommentAdded) Message(e gerritssh.Event, pcfg project.Config, c *gerrit.Client, me MessageEnricher) (Message, error) {
 	var m Message
-	var voted bool
-	if len(e.Approvals) > 0 {
-		// TODO: remove this once https://bugs.chromium.org/p/gerrit/issues/detail?id=8494
-		for _, v := range e.Approvals {
-			if v.OldValue != "" {
-				voted = true
-				break
-			}
-		}
-	}
 	action := "commented on"
-	if voted {
+	if changedVote(e) {
 		action = "voted on"
 	}
 	m.Fallback = fmt.Sprintf("%s %s %s: %s",
@@ -94,12 +100,26 @@ func (CommentAdded) Message(e gerritssh.Event, _ project.Config, c *gerrit.Clien
 	// if the author is the owner, then let reviewers know
 	if e.Author.Email == e.Change.Owner.Email {
 		// get the list of reviewers for the reviewers field
-		rs, _, err := c.Changes.ListReviewers(gerritssh.ChangeIDWithProjectNumber(e.Change.Project, e.Change.Number))
+		rs, err := e.ChangeReviewers(c)
 		if err != nil {
 			return m, err
 		}
-		m.Fields = append(m.Fields, ReviewersField(e, *rs, me))
+		m.Fields = append(m.Fields, ReviewersFields(e, rs, me)...)
+	}
+	url := e.Change.URL
+	if _, truncated := Truncate(e.Comment, pcfg.MaxTextLength); truncated {
+		// link directly to the comment if we can find it
+		id, err := gerritssh.MessageID(c, e.Change.Project, e.Change.Number, e.Author.Email, time.Unix(e.TSCreated, 0))
+		if err != nil {
+			llog.Warn("error finding comment", llog.ErrKV(err), e.KV())
+		} else if id != "" {
+			url = gerritssh.MessageURL(url, id)
+		}
+	}
+	if pcfg.ShowChangeAge && e.Change.TSCreated > 0 {
+		m.Fields = append(m.Fields, AgeField(e))
 	}
-	m.Text = e.Comment
-	return m, nil
+	m.Text = truncatedText(e.Comment, pcfg, url, "comment")
+	err := appendSubmitRequirements(&m, e, pcfg, c)
+	return m, err
 }
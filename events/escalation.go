@@ -0,0 +1,40 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// EscalationMessage returns the message reminding the mentions that the change
+// has waited that long without any reviews
+func EscalationMessage(e gerritssh.Event, waited time.Duration, mentions []string) Message {
+	var m Message
+	m.Fallback = fmt.Sprintf("%s has been waiting %s for a review: %s",
+		e.Change.URL,
+		formatWait(waited),
+		e.Change.Subject,
+	)
+	m.Pretext = fmt.Sprintf("%s %s has been waiting %s for a review: <%s|%s>",
+		strings.Join(mentions, " "),
+		e.Change.Project,
+		formatWait(waited),
+		e.Change.URL,
+		e.Change.Subject,
+	)
+	m.Color = "warning"
+	return m
+}
+
+// formatWait formats the duration in whole days or hours
+func formatWait(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+	if h := int(d.Hours()); h != 1 {
+		return fmt.Sprintf("%d hours", h)
+	}
+	return "1 hour"
+}
@@ -2,6 +2,8 @@ package events
 
 import (
 	"regexp"
+	"sort"
+	"strings"
 
 	gerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/levenlabs/gerrit-slack/gerritssh"
@@ -40,17 +42,128 @@ func Handler(e gerritssh.Event, _ project.Config) (EventHandler, bool) {
 	return h, ok
 }
 
+// Load fetches the detail of the event's change, which the handlers use instead
+// of fetching it themselves, and anything the project's config needs to decide
+// if the event should be ignored, like the changed files, and stores it on the
+// event so it's only fetched once
+func Load(e *gerritssh.Event, pcfg project.Config, c *gerrit.Client) error {
+	// the handlers of disabled projects don't need it
+	if anyDestination(pcfg, func(dcfg project.Config) bool { return dcfg.Enabled }) {
+		showSRs := anyDestination(pcfg, func(dcfg project.Config) bool { return dcfg.ShowSubmitRequirements })
+		if err := e.LoadDetail(c, showSRs); err != nil {
+			return err
+		}
+	}
+	if pcfg.IgnorePaths != "" {
+		if err := e.LoadFiles(c); err != nil {
+			return err
+		}
+	}
+	if pcfg.IgnoreCCAdded && e.Type == gerritssh.EventTypeReviewerAdded {
+		if err := e.LoadReviewers(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anyDestination returns true if f returns true for any of the project's
+// destination configs
+func anyDestination(pcfg project.Config, f func(project.Config) bool) bool {
+	for _, dcfg := range pcfg.DestinationConfigs() {
+		if f(dcfg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Types returns the event types that have a registered handler
+func Types() []string {
+	types := make([]string, 0, len(handlers))
+	for typ := range handlers {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// branchRef returns the full ref for a branch name
+func branchRef(branch string) string {
+	if strings.HasPrefix(branch, "refs/") {
+		return branch
+	}
+	return "refs/heads/" + branch
+}
+
+// regexMatch returns true if the val matches the regex, which is only compiled
+// the first time it's used
 func regexMatch(reg, val string) (bool, error) {
 	if reg == "" {
 		return false, nil
 	}
-	r, err := regexp.Compile(reg)
+	r, err := project.CompileRegexp(reg)
 	if err != nil {
 		return false, llog.ErrWithKV(err, llog.KV{"regex": reg})
 	}
 	return r.MatchString(val), nil
 }
 
+// globRegexp converts a glob into a regex. A * matches anything but a /, a **
+// matches anything, a **/ matches any number of directories, including none,
+// and a glob without a / is matched against the file's name in any directory.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	if !strings.Contains(glob, "/") {
+		b.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i+1:], "*/") {
+				b.WriteString("(.*/)?")
+				i += 2
+			} else if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// pathsMatch returns true if every file matches at least one of the comma
+// separated globs
+func pathsMatch(globs string, files []string) (bool, error) {
+	var regs []string
+	for _, g := range strings.Split(globs, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			regs = append(regs, globRegexp(g))
+		}
+	}
+	if len(regs) == 0 || len(files) == 0 {
+		return false, nil
+	}
+	r, err := project.CompileRegexp(strings.Join(regs, "|"))
+	if err != nil {
+		return false, llog.ErrWithKV(err, llog.KV{"globs": globs})
+	}
+	for _, f := range files {
+		if !r.MatchString(f) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 type globalWrapper struct {
 	EventHandler
 }
@@ -69,15 +182,64 @@ func (w globalWrapper) Ignore(e gerritssh.Event, pcfg project.Config) (bool, err
 	if pcfg.IgnoreWipPatchSet && e.Change.WIP {
 		return true, nil
 	}
+	if e.Change.Branch != "" {
+		ignore, err := regexMatch(pcfg.IgnoreBranches, branchRef(e.Change.Branch))
+		if err != nil || ignore {
+			return ignore, err
+		}
+	}
+	for _, h := range e.Change.Hashtags {
+		ignore, err := regexMatch(pcfg.IgnoreHashtags, h)
+		if err != nil || ignore {
+			return ignore, err
+		}
+	}
+	// the files are loaded before the handler is called, see Load
+	ignore, err := pathsMatch(pcfg.IgnorePaths, e.Files)
+	if err != nil || ignore {
+		return ignore, err
+	}
 	return w.EventHandler.Ignore(e, pcfg)
 }
 
 // Message implements the EventHandler interface
 func (w globalWrapper) Message(e gerritssh.Event, pcfg project.Config, c *gerrit.Client, me MessageEnricher) (Message, error) {
+	me = mentionPolicyEnricher{
+		MessageEnricher: me,
+		policy:          pcfg.MentionPolicy,
+		e:               e,
+	}
 	m, err := w.EventHandler.Message(e, pcfg, c, me)
+	if err == nil && pcfg.ShowTopic && e.Change.Topic != "" {
+		m.Fields = append(m.Fields, TopicField(e))
+	}
+	if err == nil && pcfg.ShowHashtags && len(e.Change.Hashtags) > 0 {
+		m.Fields = append(m.Fields, HashtagsField(e))
+	}
+	if err == nil && (pcfg.ShowCIStatus || pcfg.ShowVoteSummary) && e.Change.Number > 0 {
+		var labels map[string]gerrit.LabelInfo
+		labels, err = e.ChangeLabels(c)
+		if err == nil && pcfg.ShowCIStatus {
+			m.Fields = append(m.Fields, CIField(labels, pcfg.CILabel))
+		}
+		if err == nil && pcfg.ShowVoteSummary {
+			m.Fields = append(m.Fields, VotesField(labels))
+		}
+	}
+	if err == nil && pcfg.Verbosity == project.VerbosityCompact {
+		m.Text = ""
+		m.Fields = nil
+	}
+	if ts, ok := pcfg.TemplateSet(); err == nil && ok {
+		m, err = ApplyTemplateSet(m, e, ts)
+	}
 	if err == nil {
 		if m.Channel == "" {
-			m.Channel = pcfg.Channel
+			m.Channel = pcfg.ChannelFor(e.Type)
+		}
+		// the text has already been converted to mrkdwn, see Mrkdwn
+		if m.Text != "" && len(m.MrkdwnIn) == 0 {
+			m.MrkdwnIn = []string{"text"}
 		}
 		if m.Color == "" {
 			m.Color = "good"
@@ -88,3 +250,50 @@ func (w globalWrapper) Message(e gerritssh.Event, pcfg project.Config, c *gerrit
 	}
 	return m, err
 }
+
+// mentionPolicyEnricher wraps a MessageEnricher and only allows mentions that
+// are permitted by the project's mention-policy
+type mentionPolicyEnricher struct {
+	MessageEnricher
+	policy string
+	e      gerritssh.Event
+}
+
+// MentionUser implements the MessageEnricher interface
+func (m mentionPolicyEnricher) MentionUser(email string, name string) string {
+	var mention bool
+	switch m.policy {
+	case project.MentionPolicyNever:
+	case project.MentionPolicyOwnerOnly:
+		mention = email == m.e.Change.Owner.Email
+	case project.MentionPolicyActionNeeded:
+		mention = actionNeeded(m.e, email)
+	default:
+		mention = true
+	}
+	if !mention {
+		return name
+	}
+	return m.MessageEnricher.MentionUser(email, name)
+}
+
+// actionNeeded returns true if the user with the given email is expected to
+// act on the event
+func actionNeeded(e gerritssh.Event, email string) bool {
+	if email == "" {
+		return false
+	}
+	switch e.Type {
+	case gerritssh.EventTypeReviewerAdded:
+		// only the new reviewer needs to do something
+		return email == e.Reviewer.Email
+	case gerritssh.EventTypeCommentAdded:
+		// if a reviewer commented then the owner needs to respond and if the
+		// owner commented then the reviewers need to respond
+		return email != e.Author.Email
+	case gerritssh.EventTypePatchSetCreated:
+		// reviewers need to look at the new patchset
+		return email != e.Change.Owner.Email && email != e.Uploader.Email
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package events
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"*.md", "README.md", true},
+		{"*.md", "docs/guide/intro.md", true},
+		{"*.md", "README.mdx", false},
+		{"docs/*", "docs/intro.md", true},
+		{"docs/*", "docs/guide/intro.md", false},
+		{"docs/*", "src/docs/intro.md", false},
+		{"docs/**", "docs/guide/intro.md", true},
+		{"**/testdata/*", "pkg/testdata/a.json", true},
+		{"**/testdata/*", "testdata/a.json", true},
+		{"**/testdata/*", "pkg/mytestdata/a.json", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/pkg/sub/main.go", true},
+		{"file?.go", "file1.go", true},
+		{"file?.go", "file10.go", false},
+		{"file?.go", "file/.go", false},
+		{"a+b.txt", "a+b.txt", true},
+		{"a+b.txt", "aab.txt", false},
+	}
+	for _, test := range tests {
+		r := regexp.MustCompile(globRegexp(test.glob))
+		if m := r.MatchString(test.path); m != test.match {
+			t.Errorf("globRegexp(%q) matching %q = %v, want %v", test.glob, test.path, m, test.match)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// MergeConflictMessage returns the message telling the change's owner that it
+// can no longer be merged into its branch. The mention is prepended to it
+// unless it's empty, like in a direct message.
+func MergeConflictMessage(c gerritssh.EventChange, mention string) Message {
+	var m Message
+	m.Fallback = fmt.Sprintf("%s has a merge conflict with %s and needs to be rebased: %s",
+		c.URL,
+		c.Branch,
+		c.Subject,
+	)
+	m.Pretext = fmt.Sprintf("%s has a merge conflict with %s and needs to be rebased: <%s|%s>",
+		c.Project,
+		c.Branch,
+		c.URL,
+		c.Subject,
+	)
+	if mention != "" {
+		m.Pretext = mention + " " + m.Pretext
+	}
+	m.Color = "warning"
+	return m
+}
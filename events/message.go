@@ -1,12 +1,18 @@
 package events
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	gerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	llog "github.com/levenlabs/go-llog"
 )
 
 // MessageField is a slack field
@@ -25,26 +31,77 @@ type Attachment struct {
 	Text      string         `json:"text"`
 	Color     string         `json:"color"`
 	Fields    []MessageField `json:"fields"`
+	MrkdwnIn  []string       `json:"mrkdwn_in,omitempty"`
 }
 
 // Message is a single-attachment message
 type Message struct {
 	Attachment
 	Channel string
+	// ThreadTS is the ts of the message this is a reply to, if any, and
+	// ReplyBroadcast also sends the reply to the channel
+	ThreadTS       string
+	ReplyBroadcast bool
 }
 
 // MarshalJSON implements the json.Marshaler interface
 func (m Message) MarshalJSON() ([]byte, error) {
 	msg := struct {
-		Channel     string       `json:"channel"`
-		Attachments []Attachment `json:"attachments"`
+		Channel        string       `json:"channel"`
+		Attachments    []Attachment `json:"attachments"`
+		ThreadTS       string       `json:"thread_ts,omitempty"`
+		ReplyBroadcast bool         `json:"reply_broadcast,omitempty"`
 	}{
-		Channel:     m.Channel,
-		Attachments: []Attachment{m.Attachment},
+		Channel:        m.Channel,
+		Attachments:    []Attachment{m.Attachment},
+		ThreadTS:       m.ThreadTS,
+		ReplyBroadcast: m.ReplyBroadcast,
 	}
 	return json.Marshal(msg)
 }
 
+// Combine combines the messages for the same change into a single message. The
+// pretexts and texts are listed in order and fields with the same title are
+// replaced by the latest one. The first message's channel and thread are kept.
+func Combine(ms []Message) Message {
+	if len(ms) == 1 {
+		return ms[0]
+	}
+	m := ms[0]
+	var fallbacks, pretexts, texts []string
+	m.Fields = nil
+	fieldIndex := map[string]int{}
+	for _, cm := range ms {
+		fallbacks = append(fallbacks, cm.Fallback)
+		pretexts = append(pretexts, cm.Pretext)
+		if cm.Text != "" {
+			texts = append(texts, cm.Text)
+		}
+		if cm.Title != "" {
+			m.Title = cm.Title
+			m.TitleLink = cm.TitleLink
+		}
+		if cm.Color != "" {
+			m.Color = cm.Color
+		}
+		for _, f := range cm.Fields {
+			if i, ok := fieldIndex[f.Title]; ok {
+				m.Fields[i] = f
+				continue
+			}
+			fieldIndex[f.Title] = len(m.Fields)
+			m.Fields = append(m.Fields, f)
+		}
+	}
+	m.Fallback = strings.Join(fallbacks, "\n")
+	m.Pretext = strings.Join(pretexts, "\n")
+	m.Text = strings.Join(texts, "\n\n")
+	if m.Text != "" && len(m.MrkdwnIn) == 0 {
+		m.MrkdwnIn = []string{"text"}
+	}
+	return m
+}
+
 // DefaultPretext returns the default title with the given action
 func DefaultPretext(action string, e gerritssh.Event) string {
 	return fmt.Sprintf(`%s %s patchset: <%s|%s>`,
@@ -55,6 +112,98 @@ func DefaultPretext(action string, e gerritssh.Event) string {
 	)
 }
 
+// trailerRegexp matches a commit message trailer like Change-Id: I123
+var trailerRegexp = regexp.MustCompile(`^[A-Za-z0-9-]+: `)
+
+// CommitMessageText returns the body of the commit message, without the
+// subject and trailers, according to the show-commit-message mode
+func CommitMessageText(msg, mode string) string {
+	if mode == "" || mode == project.ShowCommitMessageNone {
+		return ""
+	}
+	paragraphs := strings.Split(strings.TrimSpace(strings.Replace(msg, "\r\n", "\n", -1)), "\n\n")
+	// the first paragraph is the subject which is already in the message
+	if len(paragraphs) < 2 {
+		return ""
+	}
+	paragraphs = paragraphs[1:]
+	trailers := true
+	for _, l := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		if !trailerRegexp.MatchString(l) {
+			trailers = false
+			break
+		}
+	}
+	if trailers {
+		paragraphs = paragraphs[:len(paragraphs)-1]
+	}
+	if len(paragraphs) == 0 {
+		return ""
+	}
+	if mode == project.ShowCommitMessageFirstParagraph {
+		return strings.TrimSpace(paragraphs[0])
+	}
+	return strings.TrimSpace(strings.Join(paragraphs, "\n\n"))
+}
+
+// Truncate shortens s to at most max characters, cutting on a word boundary
+// if possible. It returns true if s was truncated. If max is 0 then s is never
+// truncated.
+func Truncate(s string, max int) (string, bool) {
+	r := []rune(s)
+	if max <= 0 || len(r) <= max {
+		return s, false
+	}
+	t := string(r[:max])
+	// don't cut on a word boundary if it would lose more than half of the text
+	if i := strings.LastIndexAny(t, " \n\t"); i > len(t)/2 {
+		return strings.TrimSpace(t[:i]), true
+	}
+	return t, true
+}
+
+// truncatedText truncates s to pcfg.MaxTextLength, converts it to mrkdwn and,
+// if it was truncated, appends a link to url to read the rest
+func truncatedText(s string, pcfg project.Config, url, what string) string {
+	s, truncated := Truncate(s, pcfg.MaxTextLength)
+	s = Mrkdwn(s)
+	if truncated {
+		s += fmt.Sprintf("… <%s|read full %s>", url, what)
+	}
+	return s
+}
+
+// ApplyTemplateSet replaces the message's pretext, title and text with the
+// output of the set's templates for them, if it has any
+func ApplyTemplateSet(m Message, e gerritssh.Event, ts project.TemplateSet) (Message, error) {
+	t, err := ts.Parse()
+	if err != nil {
+		return m, llog.ErrWithKV(err, llog.KV{"template": ts.Name})
+	}
+	data := struct {
+		Event   gerritssh.Event
+		Message Message
+	}{e, m}
+	for _, part := range []struct {
+		name string
+		dst  *string
+	}{
+		{"pretext", &m.Pretext},
+		{"title", &m.Title},
+		{"text", &m.Text},
+	} {
+		if t.Lookup(part.name) == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := t.ExecuteTemplate(&buf, part.name, data); err != nil {
+			return m, llog.ErrWithKV(err, llog.KV{"template": ts.Name, "part": part.name})
+		}
+		*part.dst = buf.String()
+	}
+	return m, nil
+}
+
 // OwnerField returns a Owner field with their name
 func OwnerField(e gerritssh.Event, me MessageEnricher) MessageField {
 	return MessageField{
@@ -73,23 +222,268 @@ func ProjectField(e gerritssh.Event) MessageField {
 	}
 }
 
-// ReviewersField returns a Reviewers field with reviewers
-func ReviewersField(e gerritssh.Event, rs []gerrit.ReviewerInfo, me MessageEnricher) MessageField {
-	reviewers := []string{}
-	for _, r := range rs {
+// accountsField returns a field listing the accounts, ignoring bots and the
+// owner of the change
+func accountsField(title string, e gerritssh.Event, as []gerrit.AccountInfo, me MessageEnricher) MessageField {
+	names := []string{}
+	for _, a := range as {
 		// ignore bots
-		if r.Email == "" || r.Name == "" {
+		if a.Email == "" || a.Name == "" {
 			continue
 		}
 		// ignore the owner
-		if r.Email == e.Change.Owner.Email {
+		if a.Email == e.Change.Owner.Email {
 			continue
 		}
-		reviewers = append(reviewers, me.MentionUser(r.Email, r.Name))
+		names = append(names, me.MentionUser(a.Email, a.Name))
+	}
+	return MessageField{
+		Title: title,
+		Value: strings.Join(names, ", "),
+		Short: len(names) < 2,
+	}
+}
+
+// TopicField returns a Topic field with the change's topic
+func TopicField(e gerritssh.Event) MessageField {
+	return MessageField{
+		Title: "Topic",
+		Value: e.Change.Topic,
+		Short: true,
+	}
+}
+
+// HashtagsField returns a Hashtags field with the change's hashtags
+func HashtagsField(e gerritssh.Event) MessageField {
+	tags := make([]string, len(e.Change.Hashtags))
+	for i, h := range e.Change.Hashtags {
+		tags[i] = "#" + h
+	}
+	return MessageField{
+		Title: "Hashtags",
+		Value: strings.Join(tags, " "),
+		Short: true,
+	}
+}
+
+// ReviewersFields returns a Reviewers field and, if anyone was CC'd, a CC field
+func ReviewersFields(e gerritssh.Event, rs map[gerritssh.ReviewerState][]gerrit.AccountInfo, me MessageEnricher) []MessageField {
+	fs := []MessageField{
+		accountsField("Reviewers", e, rs[gerritssh.ReviewerStateReviewer], me),
+	}
+	if cc := accountsField("CC", e, rs[gerritssh.ReviewerStateCC], me); cc.Value != "" {
+		fs = append(fs, cc)
+	}
+	return fs
+}
+
+// labelRange returns the lowest and highest votes on the label
+func labelRange(l gerrit.LabelInfo) (int, int) {
+	var min, max int
+	for _, a := range l.All {
+		if a.Value < min {
+			min = a.Value
+		}
+		if a.Value > max {
+			max = a.Value
+		}
+	}
+	return min, max
+}
+
+// CIField returns a CI field with the status of the given label, usually
+// Verified. Any negative vote means it failed and otherwise any positive vote
+// means it passed.
+func CIField(labels map[string]gerrit.LabelInfo, label string) MessageField {
+	status := "pending"
+	if l, ok := labels[label]; ok {
+		min, max := labelRange(l)
+		if min < 0 {
+			status = "✗ failed"
+		} else if max > 0 {
+			status = "✓ passed"
+		}
 	}
 	return MessageField{
-		Title: "Reviewers",
-		Value: strings.Join(reviewers, ", "),
-		Short: len(reviewers) < 2,
+		Title: "CI",
+		Value: status,
+		Short: true,
+	}
+}
+
+// labelAbbreviation returns the initials of the label, like CR for Code-Review
+func labelAbbreviation(label string) string {
+	var b strings.Builder
+	for _, w := range strings.Split(label, "-") {
+		if w != "" {
+			b.WriteString(strings.ToUpper(w[:1]))
+		}
+	}
+	return b.String()
+}
+
+// VotesField returns a Votes field summarizing the non-zero votes on each
+// label, like CR: +1 +1 | V: +1
+func VotesField(labels map[string]gerrit.LabelInfo) MessageField {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		var votes []string
+		for _, a := range labels[name].All {
+			if a.Value != 0 {
+				votes = append(votes, fmt.Sprintf("%+d", a.Value))
+			}
+		}
+		if len(votes) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", labelAbbreviation(name), strings.Join(votes, " ")))
+		}
+	}
+	value := strings.Join(parts, " | ")
+	if value == "" {
+		value = "none"
+	}
+	return MessageField{
+		Title: "Votes",
+		Value: value,
+		Short: true,
+	}
+}
+
+// maxRelatedChanges is the most related changes listed in a RelationChainField
+const maxRelatedChanges = 10
+
+// RelationChainField returns a Relation Chain field listing the related changes
+// from the newest descendant down to the oldest ancestor with the event's
+// change marked. It returns false if the change isn't part of a chain.
+func RelationChainField(e gerritssh.Event, c *gerrit.Client, related []gerrit.RelatedChangeAndCommitInfo) (MessageField, bool) {
+	if len(related) < 2 {
+		return MessageField{}, false
+	}
+	lines := make([]string, 0, maxRelatedChanges+1)
+	for i, r := range related {
+		if i == maxRelatedChanges {
+			lines = append(lines, fmt.Sprintf("and %d more…", len(related)-i))
+			break
+		}
+		line := fmt.Sprintf("<%s|%s>",
+			gerritssh.ChangeURL(gerritssh.WebURL(c), e.Change.Project, int64(r.ChangeNumber)),
+			r.Commit.Subject,
+		)
+		if int64(r.ChangeNumber) == e.Change.Number {
+			line += " (this change)"
+		} else if r.Status != "" && r.Status != string(gerritssh.ChangeStatusNew) {
+			line += fmt.Sprintf(" (%s)", strings.ToLower(r.Status))
+		}
+		lines = append(lines, line)
+	}
+	return MessageField{
+		Title: "Relation Chain",
+		Value: strings.Join(lines, "\n"),
+	}, true
+}
+
+// TopFilesField returns a Top Files field listing the n files with the most
+// lines inserted and deleted
+func TopFilesField(files map[string]gerrit.FileInfo, n int) MessageField {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	churn := func(p string) int {
+		return files[p].LinesInserted + files[p].LinesDeleted
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if churn(paths[i]) != churn(paths[j]) {
+			return churn(paths[i]) > churn(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+	lines := make([]string, len(paths))
+	for i, p := range paths {
+		lines[i] = fmt.Sprintf("`%s` +%d/-%d", slackEscape(p), files[p].LinesInserted, files[p].LinesDeleted)
+	}
+	return MessageField{
+		Title: "Top Files",
+		Value: strings.Join(lines, "\n"),
+	}
+}
+
+// SubmitRequirementsField returns a Submit Requirements field listing which
+// requirements are satisfied. It returns false if there are no requirements,
+// like on Gerrit versions before 3.5.
+func SubmitRequirementsField(srs []gerritssh.SubmitRequirement, submittable bool) (MessageField, bool) {
+	var lines []string
+	for _, sr := range srs {
+		switch sr.Status {
+		case "SATISFIED", "OVERRIDDEN", "FORCED":
+			lines = append(lines, "✓ "+sr.Name)
+		case "NOT_APPLICABLE":
+		default:
+			lines = append(lines, "✗ "+sr.Name)
+		}
+	}
+	if len(lines) == 0 {
+		return MessageField{}, false
+	}
+	title := "Submit Requirements"
+	if submittable {
+		title += " (submittable)"
+	}
+	return MessageField{
+		Title: title,
+		Value: strings.Join(lines, "\n"),
+		Short: true,
+	}, true
+}
+
+// appendSubmitRequirements adds the SubmitRequirementsField to the message if
+// the project wants it
+func appendSubmitRequirements(m *Message, e gerritssh.Event, pcfg project.Config, c *gerrit.Client) error {
+	if !pcfg.ShowSubmitRequirements {
+		return nil
+	}
+	srs, submittable, err := e.SubmitRequirements(c)
+	if err != nil {
+		return err
+	}
+	if f, ok := SubmitRequirementsField(srs, submittable); ok {
+		m.Fields = append(m.Fields, f)
+	}
+	return nil
+}
+
+// formatAge formats a duration like 3d 4h, only including the two largest
+// units
+func formatAge(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int(d/time.Hour) % 24
+	mins := int(d/time.Minute) % 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, mins)
+	}
+	return fmt.Sprintf("%dm", mins)
+}
+
+// AgeField returns an Age field with how long the change has been in review as
+// of the event
+func AgeField(e gerritssh.Event) MessageField {
+	at := time.Now()
+	if e.TSCreated > 0 {
+		at = time.Unix(e.TSCreated, 0)
+	}
+	return MessageField{
+		Title: "Age",
+		Value: "in review for " + formatAge(at.Sub(time.Unix(e.Change.TSCreated, 0))),
+		Short: true,
 	}
 }
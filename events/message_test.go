@@ -0,0 +1,93 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+)
+
+func TestCommitMessageText(t *testing.T) {
+	msg := "Fix the thing\n\nThe thing was broken.\nNow it isn't.\n\nAlso tidied up.\n\nChange-Id: I123\nSigned-off-by: Someone <someone@example.com>\n"
+	tests := []struct {
+		msg  string
+		mode string
+		text string
+	}{
+		{msg, "", ""},
+		{msg, project.ShowCommitMessageNone, ""},
+		{msg, project.ShowCommitMessageFirstParagraph, "The thing was broken.\nNow it isn't."},
+		{msg, project.ShowCommitMessageFull, "The thing was broken.\nNow it isn't.\n\nAlso tidied up."},
+		{"Fix the thing\r\n\r\nThe body.\r\n", project.ShowCommitMessageFull, "The body."},
+		{"Fix the thing", project.ShowCommitMessageFull, ""},
+		{"Fix the thing\n\nChange-Id: I123", project.ShowCommitMessageFull, ""},
+		{"Fix the thing\n\nSee: the docs\nfor more", project.ShowCommitMessageFull, "See: the docs\nfor more"},
+	}
+	for _, test := range tests {
+		if text := CommitMessageText(test.msg, test.mode); text != test.text {
+			t.Errorf("CommitMessageText(%q, %q) = %q, want %q", test.msg, test.mode, text, test.text)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s         string
+		max       int
+		truncated string
+		ok        bool
+	}{
+		{"short", 0, "short", false},
+		{"short", 10, "short", false},
+		{"exactly10!", 10, "exactly10!", false},
+		{"the quick brown fox", 12, "the quick", true},
+		{"supercalifragilistic is long", 10, "supercalif", true},
+		{"héllo wörld ünïcode", 11, "héllo wörld", true},
+		{"a b", 2, "a ", true},
+	}
+	for _, test := range tests {
+		s, ok := Truncate(test.s, test.max)
+		if s != test.truncated || ok != test.ok {
+			t.Errorf("Truncate(%q, %d) = %q, %v, want %q, %v", test.s, test.max, s, ok, test.truncated, test.ok)
+		}
+	}
+}
+
+func TestApplyTemplateSet(t *testing.T) {
+	var e gerritssh.Event
+	e.Change.Project = "gerrit-slack"
+	e.Change.Subject = "Fix the thing"
+	m := Message{Attachment: Attachment{Pretext: "Someone uploaded a patch set", Title: "Fix the thing", Text: "The body"}}
+	tests := []struct {
+		ts   project.TemplateSet
+		want Attachment
+		err  bool
+	}{
+		{ts: project.TemplateSet{}, want: m.Attachment},
+		{
+			ts:   project.TemplateSet{Pretext: "[{{.Event.Change.Project}}] {{.Message.Pretext}}"},
+			want: Attachment{Pretext: "[gerrit-slack] Someone uploaded a patch set", Title: "Fix the thing", Text: "The body"},
+		},
+		{
+			ts:   project.TemplateSet{Title: "{{.Event.Change.Subject}}!", Text: " "},
+			want: Attachment{Pretext: "Someone uploaded a patch set", Title: "Fix the thing!", Text: " "},
+		},
+		{ts: project.TemplateSet{Text: "{{.Event.Nope}}"}, err: true},
+		{ts: project.TemplateSet{Text: "{{"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := ApplyTemplateSet(m, e, test.ts)
+		if test.err {
+			if err == nil {
+				t.Errorf("ApplyTemplateSet(%+v) didn't return an error", test.ts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ApplyTemplateSet(%+v) returned error: %v", test.ts, err)
+		} else if !reflect.DeepEqual(got.Attachment, test.want) {
+			t.Errorf("ApplyTemplateSet(%+v) = %+v, want %+v", test.ts, got.Attachment, test.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package events
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// mdLinkRegexp's url can't contain <, > or | since it's copied into
+	// slack's <url|text> as is
+	mdLinkRegexp   = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s<>|]+)\)`)
+	mdBoldRegexp   = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	mdStrikeRegexp = regexp.MustCompile(`~~([^~\n]+)~~`)
+	mdBulletRegexp = regexp.MustCompile(`^(\s*)[*-] `)
+	mdInlineRegexp = regexp.MustCompile("`[^`\n]+`")
+)
+
+// slackEscape escapes the characters that slack treats as control characters
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// mrkdwnSpan converts the inline formatting of a line that isn't in a code
+// block. Inline code is escaped but otherwise left alone.
+func mrkdwnSpan(s string) string {
+	var b strings.Builder
+	convert := func(s string) string {
+		// links are converted before escaping since slack's syntax uses < and >
+		var lb strings.Builder
+		last := 0
+		for _, m := range mdLinkRegexp.FindAllStringSubmatchIndex(s, -1) {
+			lb.WriteString(slackEscape(s[last:m[0]]))
+			lb.WriteString("<" + s[m[4]:m[5]] + "|" + slackEscape(s[m[2]:m[3]]) + ">")
+			last = m[1]
+		}
+		lb.WriteString(slackEscape(s[last:]))
+		s = mdBoldRegexp.ReplaceAllString(lb.String(), "*$1$2*")
+		return mdStrikeRegexp.ReplaceAllString(s, "~$1~")
+	}
+	last := 0
+	for _, m := range mdInlineRegexp.FindAllStringIndex(s, -1) {
+		b.WriteString(convert(s[last:m[0]]))
+		b.WriteString(slackEscape(s[m[0]:m[1]]))
+		last = m[1]
+	}
+	b.WriteString(convert(s[last:]))
+	return b.String()
+}
+
+// Mrkdwn converts Gerrit comment formatting, which is either Gerrit's older
+// markup or Markdown, into Slack's mrkdwn and escapes &, < and >
+func Mrkdwn(s string) string {
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	out := make([]string, 0, len(lines))
+	var fenced, indented bool
+	for _, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "```") {
+			if indented {
+				out = append(out, "```")
+				indented = false
+			}
+			// slack doesn't support a language after the fence
+			out = append(out, "```")
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			out = append(out, slackEscape(l))
+			continue
+		}
+		// Gerrit's markup treats indented lines as preformatted
+		if trimmed != "" && (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && !mdBulletRegexp.MatchString(l) {
+			if !indented {
+				out = append(out, "```")
+				indented = true
+			}
+			out = append(out, slackEscape(l))
+			continue
+		}
+		if indented {
+			out = append(out, "```")
+			indented = false
+		}
+		switch {
+		case strings.HasPrefix(l, ">"):
+			out = append(out, "> "+mrkdwnSpan(strings.TrimSpace(strings.TrimLeft(l, "> "))))
+		case mdBulletRegexp.MatchString(l):
+			indent := mdBulletRegexp.FindStringSubmatch(l)[1]
+			out = append(out, indent+"• "+mrkdwnSpan(l[len(mdBulletRegexp.FindString(l)):]))
+		default:
+			out = append(out, mrkdwnSpan(l))
+		}
+	}
+	if fenced || indented {
+		out = append(out, "```")
+	}
+	return strings.Join(out, "\n")
+}
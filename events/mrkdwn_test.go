@@ -0,0 +1,30 @@
+package events
+
+import "testing"
+
+func TestMrkdwn(t *testing.T) {
+	tests := []struct {
+		s, mrkdwn string
+	}{
+		{"plain text", "plain text"},
+		{"a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"**bold** and __bold__", "*bold* and *bold*"},
+		{"~~gone~~", "~gone~"},
+		{"see [the docs](https://example.com/docs)", "see <https://example.com/docs|the docs>"},
+		{"[a <b>](https://example.com)", "<https://example.com|a &lt;b&gt;>"},
+		{"see [x](https://a><!channel>) now", "see [x](https://a&gt;&lt;!channel&gt;) now"},
+		{"[x](https://a|b)", "[x](https://a|b)"},
+		{"`**not bold** <x>`", "`**not bold** &lt;x&gt;`"},
+		{"* one\n- two\n  * nested", "• one\n• two\n  • nested"},
+		{"> quoted **text**", "> quoted *text*"},
+		{"```go\nif a < b {}\n```", "```\nif a &lt; b {}\n```"},
+		{"```\nunclosed", "```\nunclosed\n```"},
+		{"before\n    indented <code>\nafter", "before\n```\n    indented &lt;code&gt;\n```\nafter"},
+		{"line\r\nbreak", "line\nbreak"},
+	}
+	for _, test := range tests {
+		if m := Mrkdwn(test.s); m != test.mrkdwn {
+			t.Errorf("Mrkdwn(%q) = %q, want %q", test.s, m, test.mrkdwn)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package events
 
 import (
 	"fmt"
+	"sort"
 	"strings"
-	"time"
 
 	gerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/levenlabs/gerrit-slack/gerritssh"
@@ -43,6 +43,48 @@ func unchangedPatchSetKind(k gerritssh.PatchSetKind) bool {
 	return false
 }
 
+// patchSetSize returns the number of lines inserted and deleted in the patch
+// set. Deletions are usually negative but that isn't guaranteed.
+func patchSetSize(ps gerritssh.EventPatchSet) int64 {
+	d := ps.SizeDeletions
+	if d < 0 {
+		d = -d
+	}
+	return ps.SizeInsertions + d
+}
+
+// mergePatchSetReviewers adds the reviewers that were added with the patch set
+// to the change's reviewers, in case they weren't returned yet, and sorts them
+// by name so the field is the same no matter the order they were added in
+func mergePatchSetReviewers(rs map[gerritssh.ReviewerState][]gerrit.AccountInfo, added []gerritssh.EventAccount) map[gerritssh.ReviewerState][]gerrit.AccountInfo {
+	if rs == nil {
+		rs = map[gerritssh.ReviewerState][]gerrit.AccountInfo{}
+	}
+	seen := map[string]bool{}
+	for _, as := range rs {
+		for _, a := range as {
+			seen[a.Email] = true
+		}
+	}
+	reviewers := rs[gerritssh.ReviewerStateReviewer]
+	for _, a := range added {
+		if a.Email == "" || seen[a.Email] {
+			continue
+		}
+		seen[a.Email] = true
+		reviewers = append(reviewers, gerrit.AccountInfo{
+			Name:     a.Name,
+			Email:    a.Email,
+			Username: a.Username,
+		})
+	}
+	sort.SliceStable(reviewers, func(i, j int) bool {
+		return reviewers[i].Name < reviewers[j].Name
+	})
+	rs[gerritssh.ReviewerStateReviewer] = reviewers
+	return rs
+}
+
 // Ignore implements the EventHandler interface
 func (PatchSetCreated) Ignore(e gerritssh.Event, pcfg project.Config) (bool, error) {
 	if !pcfg.PublishOnPatchSetCreated {
@@ -51,6 +93,10 @@ func (PatchSetCreated) Ignore(e gerritssh.Event, pcfg project.Config) (bool, err
 	if pcfg.IgnoreUnchangedPatchSet && unchangedPatchSetKind(e.PatchSet.Kind) {
 		return true, nil
 	}
+	if size := patchSetSize(e.PatchSet); (pcfg.IgnoreMinSize > 0 && size < pcfg.IgnoreMinSize) ||
+		(pcfg.IgnoreMaxSize > 0 && size > pcfg.IgnoreMaxSize) {
+		return true, nil
+	}
 	m, err := regexMatch(pcfg.IgnoreCommitMessage, e.Change.CommitMessage)
 	if err != nil || m {
 		return m, err
@@ -74,31 +120,45 @@ func (PatchSetCreated) Message(e gerritssh.Event, pcfg project.Config, c *gerrit
 	)
 	action = fmt.Sprintf("%s %s", e.Uploader.Name, action)
 	m.Pretext = DefaultPretext(action, e)
+	m.Text = truncatedText(CommitMessageText(e.Change.CommitMessage, pcfg.ShowCommitMessage), pcfg, e.Change.URL, "commit message")
 
-	if !pcfg.PublishPatchSetCreatedImmediately {
-		time.Sleep(5 * time.Second)
-	}
-
-	// get the list of reviewers for the reviewers field
-	rs, _, err := c.Changes.ListReviewers(gerritssh.ChangeIDWithProjectNumber(e.Change.Project, e.Change.Number))
+	// get the list of reviewers for the reviewers field, the reviewers that
+	// were added with the patch set should already be waited for
+	rs, err := e.ChangeReviewers(c)
 	if err != nil {
 		return m, err
 	}
+	rs = mergePatchSetReviewers(rs, e.PatchSetReviewers)
 	// we must handle 0 or neagtive numbers
 	dstr := fmt.Sprintf("%d", e.PatchSet.SizeDeletions)
 	if !strings.HasPrefix(dstr, "-") {
 		dstr = "-" + dstr
 	}
-	m.Fields = []MessageField{
-		ReviewersField(e, *rs, me),
-		MessageField{
-			Title: "Size",
-			Value: fmt.Sprintf("+%d, %s",
-				e.PatchSet.SizeInsertions,
-				dstr,
-			),
-			Short: true,
-		},
+	m.Fields = append(ReviewersFields(e, rs, me), MessageField{
+		Title: "Size",
+		Value: fmt.Sprintf("+%d, %s",
+			e.PatchSet.SizeInsertions,
+			dstr,
+		),
+		Short: true,
+	})
+	if pcfg.ShowTopFiles > 0 {
+		files, err := e.ChangedFileInfos(c)
+		if err != nil {
+			return m, err
+		}
+		if len(files) > 0 {
+			m.Fields = append(m.Fields, TopFilesField(files, pcfg.ShowTopFiles))
+		}
+	}
+	if pcfg.ShowRelationChain {
+		related, err := gerritssh.RelatedChanges(c, e.Change.Project, e.Change.Number, e.PatchSet.Revision)
+		if err != nil {
+			return m, err
+		}
+		if f, ok := RelationChainField(e, c, related); ok {
+			m.Fields = append(m.Fields, f)
+		}
 	}
 	return m, nil
 }
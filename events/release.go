@@ -0,0 +1,41 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// ReleaseMessage returns the announcement of the project's new tag listing the
+// changelog since the previous tag, which is empty if it wasn't found. more is
+// true if the changelog was cut short.
+func ReleaseMessage(project, tag, prev string, changelog []gerritssh.ChangelogEntry, more bool) Message {
+	var m Message
+	m.Pretext = fmt.Sprintf("Released %s %s", project, tag)
+	m.Fallback = m.Pretext
+	if len(changelog) == 0 {
+		return m
+	}
+	lines := make([]string, 0, len(changelog)+1)
+	for _, e := range changelog {
+		subject := slackEscape(e.Subject)
+		if e.URL != "" {
+			subject = fmt.Sprintf("<%s|%s>", e.URL, subject)
+		}
+		lines = append(lines, "• "+subject)
+	}
+	if more {
+		lines = append(lines, "and more…")
+	}
+	title := "Changes"
+	if prev != "" {
+		title = fmt.Sprintf("Changes since %s", prev)
+	}
+	m.Fields = append(m.Fields, MessageField{
+		Title: title,
+		Value: strings.Join(lines, "\n"),
+	})
+	m.Color = "good"
+	return m
+}
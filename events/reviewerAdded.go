@@ -26,11 +26,16 @@ func (ReviewerAdded) Ignore(e gerritssh.Event, pcfg project.Config) (bool, error
 	if !pcfg.PublishOnReviewerAdded {
 		return true, nil
 	}
-	if !pcfg.PublishPatchSetReviewersAdded {
-		// if the event and the patchset were created within 5 seconds, the reviewers
-		// were added with the patchset
-		if e.TSCreated-e.PatchSet.TSCreated <= 5 {
-			return true, nil
+	// reviewers added with the patch set are already in its message
+	if !pcfg.PublishPatchSetReviewersAdded && e.AddedWithPatchSet {
+		return true, nil
+	}
+	// the reviewers are loaded before the handler is called, see Load
+	if pcfg.IgnoreCCAdded {
+		for _, a := range e.Reviewers[gerritssh.ReviewerStateCC] {
+			if a.Email == e.Reviewer.Email {
+				return true, nil
+			}
 		}
 	}
 	return false, nil
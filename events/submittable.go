@@ -0,0 +1,34 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// MaybeSubmittable returns true if the event changed a vote, which might have
+// satisfied the change's last submit requirement
+func MaybeSubmittable(e gerritssh.Event) bool {
+	return e.Type == gerritssh.EventTypeCommentAdded && changedVote(e)
+}
+
+// SubmittableMessage returns the message telling the change's owner that it's
+// ready to submit. The mention is prepended to it unless it's empty, like in a
+// direct message.
+func SubmittableMessage(e gerritssh.Event, mention string) Message {
+	var m Message
+	m.Fallback = fmt.Sprintf("Ready to submit: %s: %s",
+		e.Change.URL,
+		e.Change.Subject,
+	)
+	m.Pretext = fmt.Sprintf("Ready to submit: %s: <%s|%s>",
+		e.Change.Project,
+		e.Change.URL,
+		e.Change.Subject,
+	)
+	if mention != "" {
+		m.Pretext = mention + " " + m.Pretext
+	}
+	m.Color = "good"
+	return m
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+const (
+	// sourceStdin reads newline-delimited events from stdin
+	sourceStdin = "stdin"
+
+	// sourceFilePrefix is the prefix of a source that reads newline-delimited
+	// events from the file after the prefix
+	sourceFilePrefix = "file:"
+)
+
+// readerSource reads newline-delimited events from r and sends them to ech
+// until r is exhausted or the context is cancelled. Lines written by
+// debug-events, which are prefixed with a timestamp, are also accepted.
+func readerSource(ctx context.Context, r io.Reader, ech chan<- gerritssh.Event) {
+	lineCh := make(chan []byte)
+	go func() {
+		defer close(lineCh)
+		s := bufio.NewScanner(r)
+		// events with long commit messages can be bigger than the default
+		s.Buffer(nil, 10*1024*1024)
+		for s.Scan() {
+			// the scanner reuses its buffer
+			line := append([]byte(nil), s.Bytes()...)
+			select {
+			case lineCh <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := s.Err(); err != nil {
+			llog.Error("error reading events", llog.ErrKV(err))
+		}
+	}()
+
+	for {
+		var line []byte
+		var ok bool
+		select {
+		case line, ok = <-lineCh:
+			if !ok {
+				llog.Info("finished reading events")
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		line = bytes.TrimSpace(line)
+		// strip the timestamp that debug-events adds
+		if i := bytes.Index(line, []byte(": {")); i >= 0 && !bytes.HasPrefix(line, []byte("{")) {
+			line = line[i+2:]
+		}
+		if len(line) == 0 {
+			continue
+		}
+		e, err := gerritssh.ParseEvent(line)
+		if err != nil {
+			llog.Error("error unmarshalling event", llog.ErrKV(err))
+			continue
+		}
+		llog.Info("gerrit event", e.KV())
+		select {
+		case ech <- e:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fileSource reads newline-delimited events from the file at path
+func fileSource(ctx context.Context, path string, ech chan<- gerritssh.Event) {
+	f, err := os.Open(path)
+	if err != nil {
+		llog.Error("error opening events file", llog.ErrKV(err), llog.KV{"path": path})
+		return
+	}
+	defer f.Close()
+	readerSource(ctx, f, ech)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// gerritTokenCommandTimeout is how long the http-token-command has to print a
+// token
+var gerritTokenCommandTimeout = 30 * time.Second
+
+// gerritToken is the bearer token sent to gerrit instead of basic auth, for
+// sites that front gerrit with an OAuth proxy. It's either the http-token or
+// the output of the http-token-command, which is run again once the token is
+// older than refresh and whenever gerrit responds with a 401.
+type gerritToken struct {
+	l       sync.Mutex
+	token   string
+	command string
+	refresh time.Duration
+	fetched time.Time
+}
+
+// set replaces the token and the command, the command is used if it's set
+func (t *gerritToken) set(token, command string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.token = token
+	t.command = command
+	t.fetched = time.Time{}
+}
+
+// get returns the token, running the command first if the token is stale or
+// if force is true
+func (t *gerritToken) get(force bool) (string, error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.command == "" {
+		return t.token, nil
+	}
+	if !force && t.token != "" && (t.refresh <= 0 || time.Since(t.fetched) < t.refresh) {
+		return t.token, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gerritTokenCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "sh", "-c", t.command).Output()
+	if err != nil {
+		return "", llog.ErrWithKV(err, llog.KV{"command": t.command})
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", llog.ErrWithKV(errors.New("token command printed nothing"), llog.KV{"command": t.command})
+	}
+	t.token = token
+	t.fetched = time.Now()
+	return token, nil
+}
+
+// bearerTransport sets the Authorization header of gerrit's requests to the
+// token. A request that's rejected with a 401 is sent once more with a fresh
+// token if the token comes from a command.
+type bearerTransport struct {
+	next  http.RoundTripper
+	token *gerritToken
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (bt bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := bt.send(req, false)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	bt.token.l.Lock()
+	fromCommand := bt.token.command != ""
+	bt.token.l.Unlock()
+	// requests with a body can only be sent again if it can be read again
+	if !fromCommand || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	llog.Debug("refreshing gerrit token after 401", llog.KV{"url": req.URL.Path})
+	retry := req
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+	return bt.send(retry, true)
+}
+
+// send sends a copy of the request with the token in its Authorization header
+func (bt bearerTransport) send(req *http.Request, refresh bool) (*http.Response, error) {
+	token, err := bt.token.get(refresh)
+	if err != nil {
+		return nil, err
+	}
+	// a RoundTripper isn't allowed to modify the request
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return bt.next.RoundTrip(r)
+}
+
+// withGerritToken returns a copy of the client that sends the token with every
+// request
+func withGerritToken(client *http.Client, token *gerritToken) *http.Client {
+	c := *client
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c.Transport = bearerTransport{next: next, token: token}
+	return &c
+}
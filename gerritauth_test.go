@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tokenCommand returns a command that prints tok1, tok2, etc each time it's run
+func tokenCommand(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gerritauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	f := filepath.Join(dir, "count")
+	return `n=$(cat ` + f + ` 2>/dev/null || echo 0); n=$((n+1)); echo $n > ` + f + `; echo tok$n`
+}
+
+func TestGerritTokenGet(t *testing.T) {
+	command := tokenCommand(t)
+	tests := []struct {
+		name    string
+		token   string
+		command string
+		refresh time.Duration
+		stale   bool
+		force   bool
+		want    []string
+	}{
+		{name: "static", token: "static", force: true, want: []string{"static", "static"}},
+		{name: "command", command: command, want: []string{"tok1", "tok1"}},
+		{name: "forced", command: command, force: true, want: []string{"tok2", "tok3"}},
+		{name: "fresh", command: command, refresh: time.Hour, want: []string{"tok4", "tok4"}},
+		{name: "stale", command: command, refresh: time.Hour, stale: true, want: []string{"tok5", "tok6"}},
+	}
+	for _, test := range tests {
+		gt := &gerritToken{refresh: test.refresh}
+		gt.set(test.token, test.command)
+		for i, want := range test.want {
+			got, err := gt.get(test.force)
+			if err != nil {
+				t.Fatalf("%s: get returned error: %v", test.name, err)
+			} else if got != want {
+				t.Errorf("%s: get #%d = %q, want %q", test.name, i+1, got, want)
+			}
+			if test.stale {
+				gt.fetched = gt.fetched.Add(-2 * test.refresh)
+			}
+		}
+	}
+
+	gt := &gerritToken{}
+	gt.set("", "exit 1")
+	if _, err := gt.get(false); err == nil {
+		t.Error("get didn't return an error when the command failed")
+	}
+	gt.set("", "true")
+	if _, err := gt.get(false); err == nil {
+		t.Error("get didn't return an error when the command printed nothing")
+	}
+}
+
+func TestBearerTransport(t *testing.T) {
+	var auths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		// only the second token the command prints is accepted
+		if r.Header.Get("Authorization") != "Bearer tok2" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		token  string
+		cmd    bool
+		status int
+		auths  []string
+	}{
+		{name: "static", token: "tok1", status: http.StatusUnauthorized, auths: []string{"Bearer tok1"}},
+		{name: "retried", cmd: true, status: http.StatusOK, auths: []string{"Bearer tok1", "Bearer tok2"}},
+	}
+	for _, test := range tests {
+		auths = nil
+		gt := &gerritToken{}
+		var command string
+		if test.cmd {
+			command = tokenCommand(t)
+		}
+		gt.set(test.token, command)
+		client := withGerritToken(&http.Client{}, gt)
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("%s: request returned error: %v", test.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+		if len(auths) != len(test.auths) {
+			t.Errorf("%s: sent %v, want %v", test.name, auths, test.auths)
+			continue
+		}
+		for i := range auths {
+			if auths[i] != test.auths[i] {
+				t.Errorf("%s: sent %v, want %v", test.name, auths, test.auths)
+				break
+			}
+		}
+	}
+}
@@ -3,6 +3,14 @@ package gerritssh
 import (
 	"fmt"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	llog "github.com/levenlabs/go-llog"
 )
 
 // ChangeStatus describes the current status of the change
@@ -42,7 +50,292 @@ const (
 	PatchSetKindNoChange PatchSetKind = "NO_CHANGE"
 )
 
+// ReviewerState describes how an account was added to a change
+type ReviewerState string
+
+const (
+	// ReviewerStateReviewer is an account that was asked to review the change
+	ReviewerStateReviewer ReviewerState = "REVIEWER"
+
+	// ReviewerStateCC is an account that was CC'd on the change
+	ReviewerStateCC ReviewerState = "CC"
+
+	// ReviewerStateRemoved is an account that was removed from the change
+	ReviewerStateRemoved ReviewerState = "REMOVED"
+)
+
 // ChangeIDWithProjectNumber formats the given project/number into a Change's ID
 func ChangeIDWithProjectNumber(project string, number int64) string {
 	return fmt.Sprintf("%s~%d", url.PathEscape(project), number)
 }
+
+// ChangeURL returns the web url for the given project/number on the gerrit
+// instance at base
+func ChangeURL(base url.URL, project string, number int64) string {
+	base.Path = fmt.Sprintf("%s/c/%s/+/%d", strings.TrimSuffix(base.Path, "/"), project, number)
+	return base.String()
+}
+
+// CanonicalWebURL, if set, is the base of the web urls in messages instead of
+// the url that gerrit is reached at, for gerrits behind a reverse proxy
+var CanonicalWebURL *url.URL
+
+// WebURL returns the base of the web urls for the gerrit instance the client
+// is for, which is CanonicalWebURL if it's set
+func WebURL(client *gerrit.Client) url.URL {
+	if CanonicalWebURL != nil {
+		return *CanonicalWebURL
+	}
+	return client.BaseURL()
+}
+
+// RewriteURL replaces the change's URL, which gerrit builds from its own
+// canonicalWebUrl, with one under CanonicalWebURL if it's set
+func (c *EventChange) RewriteURL() {
+	if CanonicalWebURL == nil || c.Number == 0 || c.Project == "" {
+		return
+	}
+	c.URL = ChangeURL(*CanonicalWebURL, c.Project, c.Number)
+}
+
+// ChangedFiles returns the paths of the files changed in the given revision of
+// the change. Gerrit's magic files, like /COMMIT_MSG, are not included. If
+// revision is empty then the current revision is used.
+func ChangedFiles(client *gerrit.Client, project string, number int64, revision string) ([]string, error) {
+	fs, err := ChangedFileInfos(client, project, number, revision)
+	if err != nil {
+		return nil, err
+	}
+	return sortedFiles(fs), nil
+}
+
+// sortedFiles returns the paths of the files in order
+func sortedFiles(fs map[string]gerrit.FileInfo) []string {
+	files := make([]string, 0, len(fs))
+	for f := range fs {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// ChangedFileInfos is like ChangedFiles but returns the info, like the lines
+// inserted and deleted, for each file keyed by its path
+func ChangedFileInfos(client *gerrit.Client, project string, number int64, revision string) (map[string]gerrit.FileInfo, error) {
+	if revision == "" {
+		revision = "current"
+	}
+	fs, _, err := client.Changes.ListFiles(ChangeIDWithProjectNumber(project, number), revision, nil)
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	for f := range fs {
+		if strings.HasPrefix(f, "/") {
+			delete(fs, f)
+		}
+	}
+	return fs, nil
+}
+
+// ReviewersTTL is how long ChangeReviewers caches a change's reviewers, since
+// the handlers of a burst of events for a change all need them
+var ReviewersTTL = 10 * time.Second
+
+type cachedReviewers struct {
+	rs      map[ReviewerState][]gerrit.AccountInfo
+	fetched time.Time
+}
+
+var reviewersCache = struct {
+	sync.Mutex
+	m map[string]cachedReviewers
+}{m: map[string]cachedReviewers{}}
+
+// copyReviewers copies the map and its slices so callers can modify them
+// without modifying the cache
+func copyReviewers(rs map[ReviewerState][]gerrit.AccountInfo) map[ReviewerState][]gerrit.AccountInfo {
+	cp := make(map[ReviewerState][]gerrit.AccountInfo, len(rs))
+	for state, as := range rs {
+		cp[state] = append([]gerrit.AccountInfo(nil), as...)
+	}
+	return cp
+}
+
+// InvalidateReviewers removes the change's reviewers from the cache, it's
+// called when they change
+func InvalidateReviewers(project string, number int64) {
+	reviewersCache.Lock()
+	delete(reviewersCache.m, ChangeIDWithProjectNumber(project, number))
+	reviewersCache.Unlock()
+}
+
+// ChangeReviewers returns the accounts on the change keyed by their state. The
+// result is cached for ReviewersTTL.
+func ChangeReviewers(client *gerrit.Client, project string, number int64) (map[ReviewerState][]gerrit.AccountInfo, error) {
+	id := ChangeIDWithProjectNumber(project, number)
+	reviewersCache.Lock()
+	cr, ok := reviewersCache.m[id]
+	reviewersCache.Unlock()
+	if ok && time.Since(cr.fetched) < ReviewersTTL {
+		return copyReviewers(cr.rs), nil
+	}
+	rs, err := changeReviewers(client, project, number)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reviewersCache.Lock()
+	// remove the expired changes while we're here so the cache stays small
+	for k, cr := range reviewersCache.m {
+		if now.Sub(cr.fetched) >= ReviewersTTL {
+			delete(reviewersCache.m, k)
+		}
+	}
+	reviewersCache.m[id] = cachedReviewers{rs: rs, fetched: now}
+	reviewersCache.Unlock()
+	return copyReviewers(rs), nil
+}
+
+func changeReviewers(client *gerrit.Client, project string, number int64) (map[ReviewerState][]gerrit.AccountInfo, error) {
+	// gerrit only includes the reviewers when the labels are requested
+	c, _, err := client.Changes.GetChange(ChangeIDWithProjectNumber(project, number), &gerrit.ChangeOptions{
+		AdditionalFields: []string{"DETAILED_LABELS", "DETAILED_ACCOUNTS"},
+	})
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	rs := make(map[ReviewerState][]gerrit.AccountInfo, len(c.Reviewers))
+	for state, as := range c.Reviewers {
+		rs[ReviewerState(state)] = as
+	}
+	return rs, nil
+}
+
+// ChangeLabels returns the labels on the change's current revision along with
+// every account's vote
+func ChangeLabels(client *gerrit.Client, project string, number int64) (map[string]gerrit.LabelInfo, error) {
+	c, _, err := client.Changes.GetChange(ChangeIDWithProjectNumber(project, number), &gerrit.ChangeOptions{
+		AdditionalFields: []string{"DETAILED_LABELS"},
+	})
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	return c.Labels, nil
+}
+
+// ChangeMatches returns true if the change matches the search query, like
+// branch:master -is:wip
+func ChangeMatches(client *gerrit.Client, project string, number int64, query string) (bool, error) {
+	cs, _, err := client.Changes.QueryChanges(&gerrit.QueryChangeOptions{
+		QueryOptions: gerrit.QueryOptions{
+			Query: []string{fmt.Sprintf(`project:"%s" change:%d (%s)`, project, number, query)},
+			Limit: 1,
+		},
+	})
+	if err != nil {
+		return false, llog.ErrWithKV(err, llog.KV{"project": project, "number": number, "query": query})
+	}
+	return len(*cs) > 0, nil
+}
+
+// RelatedChanges returns the changes that depend on, or are dependencies of,
+// the given revision of the change ordered from the newest descendant to the
+// oldest ancestor. If revision is empty then the current revision is used.
+func RelatedChanges(client *gerrit.Client, project string, number int64, revision string) ([]gerrit.RelatedChangeAndCommitInfo, error) {
+	if revision == "" {
+		revision = "current"
+	}
+	r, _, err := client.Changes.GetRelatedChanges(ChangeIDWithProjectNumber(project, number), revision)
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	return r.Changes, nil
+}
+
+// MessageID returns the id of the change message that the account posted
+// closest to the given time, which is usually the one that triggered a
+// comment-added event. An empty string is returned if there isn't one.
+func MessageID(client *gerrit.Client, project string, number int64, email string, at time.Time) (string, error) {
+	c, _, err := client.Changes.GetChange(ChangeIDWithProjectNumber(project, number), &gerrit.ChangeOptions{
+		AdditionalFields: []string{"MESSAGES", "DETAILED_ACCOUNTS"},
+	})
+	if err != nil {
+		return "", llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	var id string
+	var closest time.Duration
+	for _, m := range c.Messages {
+		if m.Author.Email != email {
+			continue
+		}
+		d := m.Date.Sub(at)
+		if d < 0 {
+			d = -d
+		}
+		if id == "" || d < closest {
+			id = m.ID
+			closest = d
+		}
+	}
+	return id, nil
+}
+
+// MessageURL returns the web url for the message on the change at changeURL
+func MessageURL(changeURL, id string) string {
+	return changeURL + "#message-" + id
+}
+
+// SubmitRequirement is the status of one of a change's submit requirements.
+// They're only returned by Gerrit 3.5 and newer.
+type SubmitRequirement struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// SubmitRequirements returns the status of the change's submit requirements
+// and whether it's submittable
+func SubmitRequirements(client *gerrit.Client, project string, number int64) ([]SubmitRequirement, bool, error) {
+	q := url.Values{"o": {"SUBMIT_REQUIREMENTS", "SUBMITTABLE"}}
+	req, err := client.NewRequest("GET", fmt.Sprintf("changes/%s?%s", ChangeIDWithProjectNumber(project, number), q.Encode()), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	var c struct {
+		Submittable        bool                `json:"submittable"`
+		SubmitRequirements []SubmitRequirement `json:"submit_requirements"`
+	}
+	if _, err := client.Do(req, &c); err != nil {
+		return nil, false, llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	return c.SubmitRequirements, c.Submittable, nil
+}
+
+// UnreviewedChanges returns up to limit of the project's open changes that
+// nobody but their owner has commented on or voted on, oldest first, as events
+// with their Reviewers loaded. Work in progress and private changes are left
+// out.
+func UnreviewedChanges(client *gerrit.Client, project string, limit int) ([]Event, error) {
+	q := url.Values{
+		"q": {fmt.Sprintf(`status:open project:"%s" -is:wip -is:private -is:reviewed`, project)},
+		"o": {"DETAILED_ACCOUNTS", "DETAILED_LABELS"},
+		"n": {strconv.Itoa(limit)},
+	}
+	req, err := client.NewRequest("GET", "changes/?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var cs []restChange
+	if _, err := client.Do(req, &cs); err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"project": project})
+	}
+	es := make([]Event, len(cs))
+	for i, c := range cs {
+		rs := map[ReviewerState][]gerrit.AccountInfo{}
+		for state, as := range c.Reviewers {
+			rs[ReviewerState(state)] = as
+		}
+		es[i] = Event{Change: eventChangeFromREST(client, c), Reviewers: rs}
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Change.TSCreated < es[j].Change.TSCreated })
+	return es, nil
+}
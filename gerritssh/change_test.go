@@ -0,0 +1,76 @@
+package gerritssh
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+)
+
+// changeResponse is a trimmed response to GET /changes/ with the
+// DETAILED_LABELS and DETAILED_ACCOUNTS options
+const changeResponse = `)]}'
+{
+  "id": "proj~master~I8473b95934b5732ac55d26311a706c9c2bde9940",
+  "project": "proj",
+  "branch": "master",
+  "_number": 1,
+  "status": "NEW",
+  "owner": {"_account_id": 1000096, "name": "John Doe", "email": "john.doe@example.com"},
+  "labels": {
+    "Code-Review": {
+      "all": [
+        {"value": 1, "_account_id": 1000097, "name": "Jane Roe", "email": "jane.roe@example.com"}
+      ]
+    }
+  },
+  "reviewers": {
+    "REVIEWER": [
+      {"_account_id": 1000097, "name": "Jane Roe", "email": "jane.roe@example.com", "username": "jroe"}
+    ],
+    "CC": [
+      {"_account_id": 1000098, "name": "Jim Poe", "email": "jim.poe@example.com"}
+    ],
+    "REMOVED": [
+      {"_account_id": 1000099, "name": "Joe Zoe"}
+    ]
+  }
+}
+`
+
+func TestChangeReviewers(t *testing.T) {
+	var options []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		options = r.URL.Query()["o"]
+		fmt.Fprint(w, changeResponse)
+	}))
+	defer srv.Close()
+	client, err := gerrit.NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := changeReviewers(client, "proj", 1)
+	if err != nil {
+		t.Fatalf("changeReviewers returned error: %v", err)
+	}
+	var labels bool
+	for _, o := range options {
+		labels = labels || o == "DETAILED_LABELS"
+	}
+	if !labels {
+		t.Errorf("changeReviewers requested %v, want DETAILED_LABELS so gerrit includes the reviewers", options)
+	}
+
+	want := map[ReviewerState][]gerrit.AccountInfo{
+		ReviewerStateReviewer: {{AccountID: 1000097, Name: "Jane Roe", Email: "jane.roe@example.com", Username: "jroe"}},
+		ReviewerStateCC:       {{AccountID: 1000098, Name: "Jim Poe", Email: "jim.poe@example.com"}},
+		ReviewerStateRemoved:  {{AccountID: 1000099, Name: "Joe Zoe"}},
+	}
+	if !reflect.DeepEqual(rs, want) {
+		t.Errorf("changeReviewers() = %+v, want %+v", rs, want)
+	}
+}
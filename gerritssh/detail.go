@@ -0,0 +1,136 @@
+package gerritssh
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	llog "github.com/levenlabs/go-llog"
+)
+
+// ChangeDetail is what the handlers of an event need to know about its change
+// beyond what's in the event. It's fetched with a single request by LoadDetail
+// so the handlers don't each make their own.
+type ChangeDetail struct {
+	// Revision is the change's current revision when the detail was fetched
+	Revision string
+	Labels   map[string]gerrit.LabelInfo
+	// Reviewers is the accounts on the change keyed by their state
+	Reviewers map[ReviewerState][]gerrit.AccountInfo
+	// Files is the info for each file changed by Revision keyed by its path,
+	// without Gerrit's magic files
+	Files       map[string]gerrit.FileInfo
+	Submittable bool
+	// SubmitRequirements is only set if they were asked for, since only Gerrit
+	// 3.5 and newer has them
+	SubmitRequirements []SubmitRequirement
+
+	hasSubmitRequirements bool
+}
+
+// FetchChangeDetail fetches the change's detail. The submit requirements are
+// only fetched if submitRequirements is true.
+func FetchChangeDetail(client *gerrit.Client, project string, number int64, submitRequirements bool) (ChangeDetail, error) {
+	q := url.Values{"o": {
+		"DETAILED_LABELS",
+		"DETAILED_ACCOUNTS",
+		"CURRENT_REVISION",
+		"CURRENT_FILES",
+		"SUBMITTABLE",
+	}}
+	if submitRequirements {
+		q.Add("o", "SUBMIT_REQUIREMENTS")
+	}
+	req, err := client.NewRequest("GET", fmt.Sprintf("changes/%s?%s", ChangeIDWithProjectNumber(project, number), q.Encode()), nil)
+	if err != nil {
+		return ChangeDetail{}, err
+	}
+	var c struct {
+		gerrit.ChangeInfo
+		Submittable        bool                `json:"submittable"`
+		SubmitRequirements []SubmitRequirement `json:"submit_requirements"`
+	}
+	if _, err := client.Do(req, &c); err != nil {
+		return ChangeDetail{}, llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	d := ChangeDetail{
+		Revision:           c.CurrentRevision,
+		Labels:             c.Labels,
+		Reviewers:          make(map[ReviewerState][]gerrit.AccountInfo, len(c.Reviewers)),
+		Files:              map[string]gerrit.FileInfo{},
+		Submittable:        c.Submittable,
+		SubmitRequirements: c.SubmitRequirements,
+
+		hasSubmitRequirements: submitRequirements,
+	}
+	for state, as := range c.Reviewers {
+		d.Reviewers[ReviewerState(state)] = as
+	}
+	for f, fi := range c.Revisions[c.CurrentRevision].Files {
+		if !strings.HasPrefix(f, "/") {
+			d.Files[f] = fi
+		}
+	}
+	return d, nil
+}
+
+// LoadDetail fetches the detail of the event's change and stores it in Detail.
+// It does nothing if it was already loaded or if the event isn't for a change.
+func (e *Event) LoadDetail(client *gerrit.Client, submitRequirements bool) error {
+	if e.Detail != nil || e.Change.Number == 0 {
+		return nil
+	}
+	d, err := FetchChangeDetail(client, e.Change.Project, e.Change.Number, submitRequirements)
+	if err != nil {
+		return err
+	}
+	e.Detail = &d
+	return nil
+}
+
+// ChangeReviewers is like the ChangeReviewers function but uses the event's
+// Detail if it's loaded
+func (e Event) ChangeReviewers(client *gerrit.Client) (map[ReviewerState][]gerrit.AccountInfo, error) {
+	if e.Detail != nil {
+		return copyReviewers(e.Detail.Reviewers), nil
+	}
+	return ChangeReviewers(client, e.Change.Project, e.Change.Number)
+}
+
+// ChangeLabels is like the ChangeLabels function but uses the event's Detail
+// if it's loaded
+func (e Event) ChangeLabels(client *gerrit.Client) (map[string]gerrit.LabelInfo, error) {
+	if e.Detail != nil {
+		return e.Detail.Labels, nil
+	}
+	return ChangeLabels(client, e.Change.Project, e.Change.Number)
+}
+
+// ChangedFileInfos is like the ChangedFileInfos function for the event's patch
+// set but uses the event's Detail if it's loaded and for the same revision
+func (e Event) ChangedFileInfos(client *gerrit.Client) (map[string]gerrit.FileInfo, error) {
+	if e.Detail != nil && (e.PatchSet.Revision == "" || e.PatchSet.Revision == e.Detail.Revision) {
+		return e.Detail.Files, nil
+	}
+	return ChangedFileInfos(client, e.Change.Project, e.Change.Number, e.PatchSet.Revision)
+}
+
+// Submittable returns whether the change is submittable, using the event's
+// Detail if it's loaded
+func (e Event) Submittable(client *gerrit.Client) (bool, error) {
+	if e.Detail != nil {
+		return e.Detail.Submittable, nil
+	}
+	_, ok, err := SubmitRequirements(client, e.Change.Project, e.Change.Number)
+	return ok, err
+}
+
+// SubmitRequirements is like the SubmitRequirements function but uses the
+// event's Detail if it's loaded with the submit requirements
+func (e Event) SubmitRequirements(client *gerrit.Client) ([]SubmitRequirement, bool, error) {
+	if e.Detail != nil && e.Detail.hasSubmitRequirements {
+		return e.Detail.SubmitRequirements, e.Detail.Submittable, nil
+	}
+	return SubmitRequirements(client, e.Change.Project, e.Change.Number)
+}
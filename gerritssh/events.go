@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"time"
 
+	gerrit "github.com/andygrunwald/go-gerrit"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/levenlabs/go-llog"
@@ -91,6 +94,7 @@ type Event struct {
 	Author    EventAccount `json:"author"`
 	Submitter EventAccount `json:"submitter"`
 	Reviewer  EventAccount `json:"reviewer"`
+	Adder     EventAccount `json:"adder"`
 	Remover   EventAccount `json:"remover"`
 	Changer   EventAccount `json:"changer"`
 	Uploader  EventAccount `json:"uploader"`
@@ -115,6 +119,43 @@ type Event struct {
 	NodesCount  int64           `json:"nodesCount"`
 
 	TSCreated int64 `json:"eventCreatedOn"`
+
+	// Raw is the original JSON of the event so fields that aren't modeled above
+	// can still be accessed. It's empty for events that weren't streamed.
+	Raw json.RawMessage `json:"-"`
+
+	// Files is the list of files changed by the event's patch set. It's only
+	// set after LoadFiles is called so it's only fetched once per event.
+	Files []string `json:"-"`
+
+	// Reviewers is the accounts on the change keyed by their state. It's only
+	// set after LoadReviewers is called.
+	Reviewers map[ReviewerState][]gerrit.AccountInfo `json:"-"`
+
+	// Detail is the detail of the event's change. It's only set after
+	// LoadDetail is called so it's only fetched once per event.
+	Detail *ChangeDetail `json:"-"`
+
+	// PatchSetReviewers are the reviewers added by the reviewer-added events
+	// that closely followed a patchset-created event, in the order they were
+	// added. AddedWithPatchSet is true for those reviewer-added events.
+	PatchSetReviewers []EventAccount `json:"-"`
+	AddedWithPatchSet bool           `json:"-"`
+}
+
+// LoadFiles fetches the files changed by the event's patch set and stores them
+// in Files. It does nothing if they were already loaded or if the event isn't
+// for a change.
+func (e *Event) LoadFiles(client *gerrit.Client) error {
+	if e.Files != nil || e.Change.Number == 0 {
+		return nil
+	}
+	fs, err := e.ChangedFileInfos(client)
+	if err != nil {
+		return err
+	}
+	e.Files = sortedFiles(fs)
+	return nil
 }
 
 // KV returns a KV for the given event
@@ -131,6 +172,48 @@ func (e Event) KV() llog.KV {
 	}
 }
 
+// LoadReviewers fetches the accounts on the event's change and stores them in
+// Reviewers. It does nothing if they were already loaded or if the event isn't
+// for a change.
+func (e *Event) LoadReviewers(client *gerrit.Client) error {
+	if e.Reviewers != nil || e.Change.Number == 0 {
+		return nil
+	}
+	rs, err := e.ChangeReviewers(client)
+	if err != nil {
+		return err
+	}
+	e.Reviewers = rs
+	return nil
+}
+
+// Actor returns the account that caused the event, if any
+func (e Event) Actor() EventAccount {
+	switch e.Type {
+	case EventTypePatchSetCreated:
+		return e.Uploader
+	case EventTypeChangeMerged:
+		return e.Submitter
+	case EventTypeChangeAbandoned:
+		return e.Abandoner
+	case EventTypeChangeRestored:
+		return e.Restorer
+	case EventTypeReviewerDeleted, EventTypeVoteDeleted:
+		return e.Remover
+	case EventTypeHashtagsChanged:
+		return e.Editor
+	case EventTypeTopicChanged, EventTypeAssigneeChanged,
+		EventTypeWorkInProgressStateChanged, EventTypePrivateStateChanged:
+		return e.Changer
+	case EventTypeReviewerAdded:
+		return e.Adder
+	case EventTypeRefUpdated:
+		return e.Submitter
+	}
+	// comment-added uses author
+	return e.Author
+}
+
 // EventChange describes a change inside an Event
 type EventChange struct {
 	Project       string       `json:"project"`
@@ -146,6 +229,7 @@ type EventChange struct {
 	Open          bool         `json:"open"`
 	Private       bool         `json:"private"`
 	WIP           bool         `json:"wip"`
+	Hashtags      []string     `json:"hashtags"`
 	TSCreated     int64        `json:"createdOn"`
 }
 
@@ -189,34 +273,72 @@ type EventApproval struct {
 	By          EventAccount `json:"by"`
 }
 
-// StreamEvents will start listening for real-time gerrit events
-func (e *Client) StreamEvents(ctx context.Context, ch chan Event) error {
+// ParseEvent unmarshals the JSON of a single event as sent by stream-events
+func ParseEvent(b []byte) (Event, error) {
+	var ev Event
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return ev, err
+	}
+	// the caller might reuse b so the bytes need to be copied
+	ev.Raw = append(json.RawMessage(nil), b...)
+	return ev, nil
+}
+
+// StreamEventsCommand returns the command to stream the given event types or
+// all events if no types are sent
+func StreamEventsCommand(types ...string) string {
+	cmd := "gerrit stream-events"
+	for _, t := range types {
+		cmd += " -s " + t
+	}
+	return cmd
+}
+
+// StreamEvents will start listening for real-time gerrit events. If types are
+// sent then only those types of events are streamed.
+func (e *Client) StreamEvents(ctx context.Context, ch chan Event, types ...string) error {
 	sess, err := e.Dial()
 	if err != nil {
 		return err
 	}
+	// this connection already uses the latest credentials
+	select {
+	case <-e.redialCh:
+	default:
+	}
 	sout, err := sess.StdoutPipe()
 	if err != nil {
+		sess.Close()
 		return err
 	}
 	sos := bufio.NewScanner(sout)
 	runCh := make(chan error, 1)
 
+	e.stats.setConnected(true)
+	defer e.stats.setConnected(false)
+
 	// start running stream-events and wait for it to disconnect
 	go func() {
 		// Run calls Start and then Wait
-		runCh <- sess.Run("gerrit stream-events")
+		runCh <- sess.Run(StreamEventsCommand(types...))
 	}()
 
 	readCh := make(chan error, 1)
 	// listen on the stdout of ssh session and send events to ch
 	go func() {
 		for sos.Scan() {
-			var ev Event
-			if err := json.Unmarshal(sos.Bytes(), &ev); err != nil {
+			ev, err := ParseEvent(sos.Bytes())
+			if err != nil {
 				llog.Error("error unmarshalling event", llog.ErrKV(err))
+				e.stats.update(func(h *StreamHealth) { h.UnmarshalErrors++ })
 				continue
 			}
+			e.stats.update(func(h *StreamHealth) {
+				h.LastEvent = time.Now()
+				if ev.Type == EventTypeDroppedOutput {
+					h.DroppedOutput++
+				}
+			})
 			llog.Info("gerrit event", ev.KV())
 			ch <- ev
 		}
@@ -225,6 +347,9 @@ func (e *Client) StreamEvents(ctx context.Context, ch chan Event) error {
 
 	select {
 	case <-ctx.Done():
+	case <-e.redialCh:
+		llog.Info("redialing event stream")
+		err = errors.New("redialing")
 	case err = <-runCh:
 		close(runCh)
 	case err = <-readCh:
@@ -0,0 +1,43 @@
+package gerritssh
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	llog "github.com/levenlabs/go-llog"
+)
+
+// OpenChanges returns up to limit of the open changes on the project's branch,
+// most recently updated first
+func OpenChanges(client *gerrit.Client, project, branch string, limit int) ([]EventChange, error) {
+	q := url.Values{
+		"q": {fmt.Sprintf(`status:open project:"%s" branch:"%s"`, project, branch)},
+		"o": {"DETAILED_ACCOUNTS"},
+		"n": {strconv.Itoa(limit)},
+	}
+	req, err := client.NewRequest("GET", "changes/?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var cs []restChange
+	if _, err := client.Do(req, &cs); err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"project": project, "branch": branch})
+	}
+	ecs := make([]EventChange, len(cs))
+	for i, c := range cs {
+		ecs[i] = eventChangeFromREST(client, c)
+	}
+	return ecs, nil
+}
+
+// Mergeable returns true if the change's current revision can be merged into
+// its branch without conflicts
+func Mergeable(client *gerrit.Client, project string, number int64) (bool, error) {
+	mi, _, err := client.Changes.GetMergeable(ChangeIDWithProjectNumber(project, number), "current", nil)
+	if err != nil {
+		return false, llog.ErrWithKV(err, llog.KV{"project": project, "number": number})
+	}
+	return mi.Mergeable, nil
+}
@@ -0,0 +1,200 @@
+package gerritssh
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+)
+
+// restChange is a gerrit.ChangeInfo with the fields that go-gerrit is missing
+type restChange struct {
+	gerrit.ChangeInfo
+	WorkInProgress bool     `json:"work_in_progress"`
+	IsPrivate      bool     `json:"is_private"`
+	Hashtags       []string `json:"hashtags"`
+}
+
+// MissedEvents queries the REST api for changes updated after since and
+// synthesizes the events that would have been streamed for them up until
+// until. Only patchset-created, comment-added and change-merged events can be
+// synthesized and some fields, like the approvals on comment-added, are
+// missing.
+func MissedEvents(client *gerrit.Client, since, until time.Time) ([]Event, error) {
+	cs, err := changesUpdatedSince(client, since, eventsOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return eventsFromChanges(client, cs, since, until), nil
+}
+
+// ChangesUpdated queries the REST api for the changes that were updated
+// between since and until. Only the changes themselves are fetched, not their
+// revisions, so the changes don't have a CommitMessage.
+func ChangesUpdated(client *gerrit.Client, since, until time.Time) ([]EventChange, error) {
+	cs, err := changesUpdatedSince(client, since)
+	if err != nil {
+		return nil, err
+	}
+	var ecs []EventChange
+	for _, c := range cs {
+		if c.Updated.After(since) && !c.Updated.After(until) {
+			ecs = append(ecs, eventChangeFromREST(client, c))
+		}
+	}
+	return ecs, nil
+}
+
+// changesPageSize is how many changes are asked for in each page of a query
+const changesPageSize = 100
+
+// eventsOptions are the options needed to synthesize the events of a change
+var eventsOptions = []string{"DETAILED_ACCOUNTS", "DETAILED_LABELS", "MESSAGES", "ALL_REVISIONS", "CURRENT_COMMIT"}
+
+// changesUpdatedSince queries the REST api, with the options, for changes
+// updated after since
+func changesUpdatedSince(client *gerrit.Client, since time.Time, options ...string) ([]restChange, error) {
+	// add a minute to the age to make sure we don't miss any changes because of
+	// clock skew, callers filter out anything before since anyways
+	age := int64(time.Since(since)/time.Second) + 60
+	return queryChanges(client, fmt.Sprintf("-age:%ds", age), options...)
+}
+
+// queryChanges queries the REST api for the changes matching the query a page
+// at a time until gerrit says there are no more
+func queryChanges(client *gerrit.Client, query string, options ...string) ([]restChange, error) {
+	var all []restChange
+	for {
+		q := url.Values{
+			"q": {query},
+			"o": options,
+			"n": {strconv.Itoa(changesPageSize)},
+			"S": {strconv.Itoa(len(all))},
+		}
+		req, err := client.NewRequest("GET", "changes/?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var cs []restChange
+		if _, err := client.Do(req, &cs); err != nil {
+			return nil, err
+		}
+		all = append(all, cs...)
+		// only the last change of a page says if there are more
+		if len(cs) == 0 || !cs[len(cs)-1].MoreChanges {
+			return all, nil
+		}
+	}
+}
+
+// eventsFromChanges synthesizes the events that happened to the changes
+// between since and until
+func eventsFromChanges(client *gerrit.Client, cs []restChange, since, until time.Time) []Event {
+	var evs []Event
+	inGap := func(t gerrit.Timestamp) bool {
+		return !t.Before(since) && !t.After(until)
+	}
+	for _, c := range cs {
+		ec := eventChangeFromREST(client, c)
+		// the streamed events have the patch set they're for, which is what
+		// they're deduplicated by
+		patchSets := map[int]EventPatchSet{}
+		for sha, rev := range c.Revisions {
+			patchSets[rev.Number] = EventPatchSet{
+				Number:    int64(rev.Number),
+				Revision:  sha,
+				Ref:       rev.Ref,
+				Uploader:  eventAccountFromREST(rev.Uploader),
+				TSCreated: rev.Created.Unix(),
+			}
+		}
+		for _, rev := range c.Revisions {
+			if !inGap(rev.Created) {
+				continue
+			}
+			ps := patchSets[rev.Number]
+			// the kind isn't available over REST so assume it changed
+			ps.Kind = PatchSetKindRework
+			ps.SizeInsertions = int64(c.Insertions)
+			ps.SizeDeletions = int64(-c.Deletions)
+			evs = append(evs, Event{
+				Type:      EventTypePatchSetCreated,
+				Change:    ec,
+				PatchSet:  ps,
+				Uploader:  ps.Uploader,
+				TSCreated: rev.Created.Unix(),
+			})
+		}
+		for _, msg := range c.Messages {
+			if !inGap(msg.Date) {
+				continue
+			}
+			author := eventAccountFromREST(msg.Author)
+			switch {
+			case msg.Tag == "autogenerated:gerrit:merged":
+				evs = append(evs, Event{
+					Type:      EventTypeChangeMerged,
+					Change:    ec,
+					PatchSet:  patchSets[c.Revisions[c.CurrentRevision].Number],
+					Submitter: author,
+					TSCreated: msg.Date.Unix(),
+				})
+			case strings.HasPrefix(msg.Tag, "autogenerated:gerrit:"):
+				// these are for things like uploading a new patchset which are
+				// handled above
+			default:
+				evs = append(evs, Event{
+					Type:      EventTypeCommentAdded,
+					Change:    ec,
+					PatchSet:  patchSets[msg.RevisionNumber],
+					Author:    author,
+					Comment:   msg.Message,
+					TSCreated: msg.Date.Unix(),
+				})
+			}
+		}
+	}
+	sortEvents(evs)
+	return evs
+}
+
+func sortEvents(evs []Event) {
+	sort.SliceStable(evs, func(i, j int) bool {
+		return evs[i].TSCreated < evs[j].TSCreated
+	})
+}
+
+func eventAccountFromREST(a gerrit.AccountInfo) EventAccount {
+	return EventAccount{
+		Name:     a.Name,
+		Email:    a.Email,
+		Username: a.Username,
+	}
+}
+
+func eventChangeFromREST(client *gerrit.Client, c restChange) EventChange {
+	ec := EventChange{
+		Project:   c.Project,
+		Branch:    c.Branch,
+		Topic:     c.Topic,
+		ChangeID:  c.ChangeID,
+		Number:    int64(c.Number),
+		Subject:   c.Subject,
+		Owner:     eventAccountFromREST(c.Owner),
+		URL:       ChangeURL(WebURL(client), c.Project, int64(c.Number)),
+		Status:    ChangeStatus(c.Status),
+		Open:      c.Status == string(ChangeStatusNew),
+		Private:   c.IsPrivate,
+		WIP:       c.WorkInProgress,
+		Hashtags:  c.Hashtags,
+		TSCreated: c.Created.Unix(),
+	}
+	if rev, ok := c.Revisions[c.CurrentRevision]; ok {
+		ec.CommitMessage = rev.Commit.Message
+	}
+	return ec
+}
@@ -0,0 +1,52 @@
+package gerritssh
+
+import (
+	"testing"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+)
+
+func TestEventsFromChangesPatchSets(t *testing.T) {
+	client, err := gerrit.NewClient("https://gerrit.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Unix(1000, 0)
+	ts := func(sec int64) gerrit.Timestamp { return gerrit.Timestamp{Time: time.Unix(sec, 0)} }
+	c := restChange{ChangeInfo: gerrit.ChangeInfo{
+		Project:         "proj",
+		Number:          1,
+		Status:          "MERGED",
+		CurrentRevision: "bbb",
+		Revisions: map[string]gerrit.RevisionInfo{
+			"aaa": {Number: 1, Created: ts(900)},
+			"bbb": {Number: 2, Created: ts(1000)},
+		},
+		Messages: []gerrit.ChangeMessageInfo{
+			// before the last streamed event so it isn't recovered
+			{Message: "old", Date: ts(999), RevisionNumber: 1},
+			{Message: "looks good", Date: ts(1000), RevisionNumber: 1},
+			{Tag: "autogenerated:gerrit:merged", Date: ts(1001), RevisionNumber: 2},
+		},
+	}}
+	evs := eventsFromChanges(client, []restChange{c}, since, time.Unix(2000, 0))
+	want := []struct {
+		typ      string
+		patchSet int64
+		revision string
+	}{
+		{EventTypePatchSetCreated, 2, "bbb"},
+		{EventTypeCommentAdded, 1, "aaa"},
+		{EventTypeChangeMerged, 2, "bbb"},
+	}
+	if len(evs) != len(want) {
+		t.Fatalf("eventsFromChanges returned %d events, want %d", len(evs), len(want))
+	}
+	for i, w := range want {
+		e := evs[i]
+		if e.Type != w.typ || e.PatchSet.Number != w.patchSet || e.PatchSet.Revision != w.revision {
+			t.Errorf("event %d = %s patch set %d %s, want %s patch set %d %s", i, e.Type, e.PatchSet.Number, e.PatchSet.Revision, w.typ, w.patchSet, w.revision)
+		}
+	}
+}
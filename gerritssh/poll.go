@@ -0,0 +1,145 @@
+package gerritssh
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/go-llog"
+)
+
+// seenTTL is how long a polled event is remembered so that it isn't sent
+// twice, it only needs to be longer than the poll window
+const seenTTL = 10 * time.Minute
+
+// poller tracks what it has already sent so that overlapping polls don't send
+// the same event twice
+type poller struct {
+	client *gerrit.Client
+	// seen maps an event's key to when it was seen
+	seen map[string]time.Time
+	// reviewers maps a change number to the emails of its reviewers
+	reviewers map[int]map[string]bool
+}
+
+func eventKey(e Event) string {
+	return fmt.Sprintf("%s/%d/%d/%s/%d", e.Type, e.Change.Number, e.PatchSet.Number, e.Reviewer.Email, e.TSCreated)
+}
+
+// reviewerEvents diffs the change's reviewers against the last poll and
+// returns a reviewer-added event for each new reviewer
+func (p *poller) reviewerEvents(c restChange) []Event {
+	rs := map[string]bool{}
+	for _, r := range c.Reviewers["REVIEWER"] {
+		rs[r.Email] = true
+	}
+	prev, ok := p.reviewers[c.Number]
+	if c.Status == string(ChangeStatusNew) {
+		p.reviewers[c.Number] = rs
+	} else {
+		// nobody is going to be added to a closed change so forget about it
+		delete(p.reviewers, c.Number)
+	}
+	// if we haven't seen the change before then we don't know who was added,
+	// unless the change is new in which case the reviewers were added with
+	// the patchset and the patchset-created event covers them
+	if !ok {
+		return nil
+	}
+	var evs []Event
+	now := time.Now()
+	for _, r := range c.Reviewers["REVIEWER"] {
+		if prev[r.Email] {
+			continue
+		}
+		ec := eventChangeFromREST(p.client, c)
+		e := Event{
+			Type:      EventTypeReviewerAdded,
+			Change:    ec,
+			Reviewer:  eventAccountFromREST(r),
+			TSCreated: now.Unix(),
+		}
+		if rev, ok := c.Revisions[c.CurrentRevision]; ok {
+			e.PatchSet.Number = int64(rev.Number)
+			e.PatchSet.TSCreated = rev.Created.Unix()
+		}
+		evs = append(evs, e)
+	}
+	return evs
+}
+
+func (p *poller) poll(since, until time.Time) ([]Event, error) {
+	cs, err := changesUpdatedSince(p.client, since, eventsOptions...)
+	if err != nil {
+		return nil, err
+	}
+	evs := eventsFromChanges(p.client, cs, since, until)
+	for _, c := range cs {
+		evs = append(evs, p.reviewerEvents(c)...)
+	}
+	sortEvents(evs)
+
+	// filter out anything we already sent and forget old events
+	var newEvs []Event
+	for _, e := range evs {
+		k := eventKey(e)
+		if _, ok := p.seen[k]; ok {
+			continue
+		}
+		p.seen[k] = until
+		newEvs = append(newEvs, e)
+	}
+	for k, t := range p.seen {
+		if until.Sub(t) > seenTTL {
+			delete(p.seen, k)
+		}
+	}
+	return newEvs, nil
+}
+
+// PollEvents periodically queries the REST api for recently updated changes
+// and sends synthesized events to ch until the context is cancelled. This can
+// be used instead of StreamEvents when the account can't stream events. See
+// MissedEvents for the events that can be synthesized, in addition
+// reviewer-added events are synthesized by comparing reviewers between polls.
+func PollEvents(ctx context.Context, client *gerrit.Client, interval time.Duration, ch chan<- Event) {
+	p := &poller{
+		client:    client,
+		seen:      map[string]time.Time{},
+		reviewers: map[int]map[string]bool{},
+	}
+	started := time.Now()
+	since := started
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		until := time.Now()
+		// overlap the polls a bit in case gerrit's clock is behind ours, the
+		// seen events are filtered out, but nothing from before we started is
+		// sent
+		from := since.Add(-interval)
+		if from.Before(started) {
+			from = started
+		}
+		evs, err := p.poll(from, until)
+		if err != nil {
+			llog.Error("error polling events", llog.ErrKV(err))
+			continue
+		}
+		since = until
+		for _, e := range evs {
+			llog.Info("gerrit event", e.KV())
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package gerritssh
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	llog "github.com/levenlabs/go-llog"
+)
+
+// ChangelogEntry is a commit between two tags. Number and URL are only set if
+// the commit was merged from a change.
+type ChangelogEntry struct {
+	Commit  string
+	Subject string
+	Number  int64
+	URL     string
+}
+
+// tagCommit returns the commit the tag points at. Annotated tags are their own
+// object so the commit is in Object.
+func tagCommit(t gerrit.TagInfo) string {
+	if t.Object != "" {
+		return t.Object
+	}
+	return t.Revision
+}
+
+// Changelog returns the commits between the tag and the last tag before it that
+// matches, newest first, along with that tag's name. The first parents of the
+// tag's commit are followed for up to limit commits, if the previous tag wasn't
+// reached by then its name is empty.
+func Changelog(client *gerrit.Client, project, tag string, matches func(name string) bool, limit int) (string, []ChangelogEntry, error) {
+	tags, _, err := client.Projects.ListTags(project, nil)
+	if err != nil {
+		return "", nil, llog.ErrWithKV(err, llog.KV{"project": project})
+	}
+	ref := "refs/tags/" + tag
+	var commit string
+	prevTags := map[string]string{}
+	for _, t := range *tags {
+		name := strings.TrimPrefix(t.Ref, "refs/tags/")
+		if t.Ref == ref {
+			commit = tagCommit(t)
+		} else if matches(name) {
+			prevTags[tagCommit(t)] = name
+		}
+	}
+	if commit == "" {
+		return "", nil, llog.ErrWithKV(errors.New("tag not found"), llog.KV{"project": project, "tag": tag})
+	}
+
+	var prev string
+	var entries []ChangelogEntry
+	for len(entries) < limit {
+		if name, ok := prevTags[commit]; ok {
+			prev = name
+			break
+		}
+		ci, _, err := client.Projects.GetCommit(project, commit)
+		if err != nil {
+			return "", nil, llog.ErrWithKV(err, llog.KV{"project": project, "commit": commit})
+		}
+		entries = append(entries, ChangelogEntry{Commit: commit, Subject: ci.Subject})
+		if len(ci.Parents) == 0 {
+			break
+		}
+		commit = ci.Parents[0].Commit
+	}
+	return prev, entries, addChangelogChanges(client, project, entries)
+}
+
+// addChangelogChanges sets the Number and URL of the entries that were merged
+// from a change
+func addChangelogChanges(client *gerrit.Client, project string, entries []ChangelogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	terms := make([]string, len(entries))
+	for i, e := range entries {
+		terms[i] = "commit:" + e.Commit
+	}
+	q := url.Values{
+		"q": {fmt.Sprintf(`project:"%s" status:merged (%s)`, project, strings.Join(terms, " OR "))},
+		"o": {"CURRENT_REVISION"},
+	}
+	req, err := client.NewRequest("GET", "changes/?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var cs []gerrit.ChangeInfo
+	if _, err := client.Do(req, &cs); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"project": project})
+	}
+	byCommit := make(map[string]gerrit.ChangeInfo, len(cs))
+	for _, c := range cs {
+		byCommit[c.CurrentRevision] = c
+	}
+	for i, e := range entries {
+		if c, ok := byCommit[e.Commit]; ok {
+			entries[i].Number = int64(c.Number)
+			entries[i].URL = ChangeURL(WebURL(client), project, int64(c.Number))
+		}
+	}
+	return nil
+}
@@ -1,49 +1,235 @@
 package gerritssh
 
-import "golang.org/x/crypto/ssh"
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// DefaultKeepAliveInterval is the default interval between keepalive requests
+const DefaultKeepAliveInterval = 30 * time.Second
 
 // Client holds the necessary params to connect to a gerrit instance over
 // ssh
 type Client struct {
+	// l guards privateKey which can be replaced with SetPrivateKey
+	l          sync.RWMutex
 	privateKey ssh.Signer
+	agentSock  string
 	hostKey    ssh.PublicKey
+	knownHosts string
 	user       string
 	addr       string
+
+	stats *streamStats
+
+	// redialCh closes the current stream so it reconnects, see Redial
+	redialCh chan struct{}
+
+	// KeepAliveInterval is how often a keepalive request is sent over the
+	// connection. If a response isn't received within the interval then the
+	// connection is closed. Setting it to 0 disables keepalives.
+	KeepAliveInterval time.Duration
 }
 
-// NewClient returns a new SSHClient
-func NewClient(sshAddr, user string, privateKey, hostKey []byte) (*Client, error) {
-	k, err := ssh.ParsePrivateKey(privateKey)
+// NewClient returns a new SSHClient. The passphrase is only used if the private
+// key is encrypted.
+func NewClient(sshAddr, user string, privateKey, passphrase, hostKey []byte) (*Client, error) {
+	k, err := parsePrivateKey(privateKey, passphrase)
 	if err != nil {
 		return nil, err
 	}
+	c, err := newClient(sshAddr, user, hostKey)
+	if err != nil {
+		return nil, err
+	}
+	c.privateKey = k
+	return c, nil
+}
 
-	hk, _, _, _, err := ssh.ParseAuthorizedKey(hostKey)
+// NewAgentClient returns a new SSHClient that authenticates using the keys in
+// the ssh agent listening on SSH_AUTH_SOCK
+func NewAgentClient(sshAddr, user string, hostKey []byte) (*Client, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	c, err := newClient(sshAddr, user, hostKey)
 	if err != nil {
 		return nil, err
 	}
+	c.agentSock = sock
+	return c, nil
+}
+
+func parsePrivateKey(privateKey, passphrase []byte) (ssh.Signer, error) {
+	if len(passphrase) > 0 {
+		return ssh.ParsePrivateKeyWithPassphrase(privateKey, passphrase)
+	}
+	return ssh.ParsePrivateKey(privateKey)
+}
+
+func newClient(sshAddr, user string, hostKey []byte) (*Client, error) {
+	c := &Client{
+		stats:             &streamStats{},
+		redialCh:          make(chan struct{}, 1),
+		user:              user,
+		addr:              sshAddr,
+		KeepAliveInterval: DefaultKeepAliveInterval,
+	}
+	// the host key can be empty if a known_hosts file is going to be used
+	if len(hostKey) > 0 {
+		hk, _, _, _, err := ssh.ParseAuthorizedKey(hostKey)
+		if err != nil {
+			return nil, err
+		}
+		c.hostKey = hk
+	}
+	return c, nil
+}
+
+// SetKnownHostsFile makes the client verify the server's host key using the
+// OpenSSH known_hosts file at the given path instead of the host key sent to
+// NewClient. The file is read every time the client dials so that it can be
+// updated without restarting.
+func (s *Client) SetKnownHostsFile(path string) error {
+	// make sure the file can be parsed now so we fail early
+	if _, err := knownhosts.New(path); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	s.knownHosts = path
+	return nil
+}
+
+// SetPrivateKey replaces the private key used for new connections. Existing
+// connections aren't affected until Redial is called.
+func (s *Client) SetPrivateKey(privateKey, passphrase []byte) error {
+	k, err := parsePrivateKey(privateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	s.l.Lock()
+	s.privateKey = k
+	s.l.Unlock()
+	return nil
+}
+
+// Redial closes the current event stream, if any, so that it's reconnected
+// with the current credentials
+func (s *Client) Redial() {
+	select {
+	case s.redialCh <- struct{}{}:
+	default:
+		// a redial is already queued
+	}
+}
+
+// Health returns the current health of the event stream
+func (s *Client) Health() StreamHealth {
+	return s.stats.get()
+}
+
+func (s *Client) hostKeyCallback() (ssh.HostKeyCallback, []string, error) {
+	if s.knownHosts != "" {
+		cb, err := knownhosts.New(s.knownHosts)
+		if err != nil {
+			return nil, nil, llog.ErrWithKV(err, llog.KV{"path": s.knownHosts})
+		}
+		return cb, nil, nil
+	}
+	if s.hostKey == nil {
+		return nil, nil, errors.New("no host key or known_hosts file")
+	}
+	return ssh.FixedHostKey(s.hostKey), []string{s.hostKey.Type()}, nil
+}
+
+// Session is an ssh session that closes its underlying connection when it's
+// closed
+type Session struct {
+	*ssh.Session
+	client *ssh.Client
+}
 
-	return &Client{
-		privateKey: k,
-		hostKey:    hk,
-		user:       user,
-		addr:       sshAddr,
-	}, nil
+// Close closes the session and its connection
+func (s *Session) Close() error {
+	s.Session.Close()
+	return s.client.Close()
 }
 
 // Dial connects to gerrit over ssh and returns a new session
-func (s Client) Dial() (*ssh.Session, error) {
+func (s *Client) Dial() (*Session, error) {
+	hkcb, hkAlgos, err := s.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	var auth ssh.AuthMethod
+	if s.agentSock != "" {
+		// connect to the agent every time in case it restarted, the connection
+		// is only needed until the handshake is done
+		conn, err := net.Dial("unix", s.agentSock)
+		if err != nil {
+			return nil, llog.ErrWithKV(err, llog.KV{"sock": s.agentSock})
+		}
+		defer conn.Close()
+		auth = ssh.PublicKeysCallback(agent.NewClient(conn).Signers)
+	} else {
+		s.l.RLock()
+		auth = ssh.PublicKeys(s.privateKey)
+		s.l.RUnlock()
+	}
 	cfg := &ssh.ClientConfig{
 		User: s.user,
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(s.privateKey),
+			auth,
 		},
-		HostKeyCallback:   ssh.FixedHostKey(s.hostKey),
-		HostKeyAlgorithms: []string{s.hostKey.Type()},
+		HostKeyCallback:   hkcb,
+		HostKeyAlgorithms: hkAlgos,
 	}
 	c, err := ssh.Dial("tcp", s.addr, cfg)
 	if err != nil {
 		return nil, err
 	}
-	return c.NewSession()
+	sess, err := c.NewSession()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if s.KeepAliveInterval > 0 {
+		go keepAlive(c, s.KeepAliveInterval)
+	}
+	return &Session{Session: sess, client: c}, nil
+}
+
+// keepAlive sends keepalive requests over the connection until it's closed and
+// closes the connection if the server stops responding, which in turn stops
+// any running sessions
+func keepAlive(c *ssh.Client, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				// the connection was already closed
+				return
+			}
+		case <-time.After(interval):
+			llog.Warn("ssh keepalive timed out, closing connection", llog.KV{"addr": c.RemoteAddr().String()})
+			c.Close()
+			return
+		}
+	}
 }
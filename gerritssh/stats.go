@@ -0,0 +1,50 @@
+package gerritssh
+
+import (
+	"sync"
+	"time"
+)
+
+// StreamHealth describes the health of the event stream
+type StreamHealth struct {
+	// Connected is true if events are currently being streamed
+	Connected bool
+	// Since is when the stream last connected or disconnected
+	Since time.Time
+	// LastEvent is when the last event was received
+	LastEvent time.Time
+
+	Reconnects      int64
+	UnmarshalErrors int64
+	// DroppedOutput is the number of dropped-output events gerrit sent, which
+	// means gerrit dropped events because we weren't reading fast enough
+	DroppedOutput int64
+}
+
+// streamStats tracks the StreamHealth of a Client
+type streamStats struct {
+	l sync.Mutex
+	h StreamHealth
+}
+
+func (s *streamStats) update(fn func(h *StreamHealth)) {
+	s.l.Lock()
+	fn(&s.h)
+	s.l.Unlock()
+}
+
+func (s *streamStats) setConnected(connected bool) {
+	s.update(func(h *StreamHealth) {
+		if connected && !h.Since.IsZero() {
+			h.Reconnects++
+		}
+		h.Connected = connected
+		h.Since = time.Now()
+	})
+}
+
+func (s *streamStats) get() StreamHealth {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.h
+}
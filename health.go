@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+// healthCheckInterval is how often the health of the stream is checked
+var healthCheckInterval = 30 * time.Second
+
+// healthFields returns fields describing the stream's health
+func healthFields(h gerritssh.StreamHealth) []events.MessageField {
+	return []events.MessageField{
+		{
+			Title: "Reconnects",
+			Value: fmt.Sprintf("%d", h.Reconnects),
+			Short: true,
+		},
+		{
+			Title: "Unmarshal Errors",
+			Value: fmt.Sprintf("%d", h.UnmarshalErrors),
+			Short: true,
+		},
+		{
+			Title: "Dropped Output",
+			Value: fmt.Sprintf("%d", h.DroppedOutput),
+			Short: true,
+		},
+	}
+}
+
+// healthReporter logs the health of the stream and, if an admin webhook is
+// configured, posts when the stream has been down longer than the threshold
+// and again when it recovers
+func healthReporter(ctx context.Context, sshc *gerritssh.Client, cfg config, sch chan<- webhookSubmit) {
+	started := time.Now()
+	var alerted bool
+	var last gerritssh.StreamHealth
+
+	tick := time.NewTicker(healthCheckInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		h := sshc.Health()
+		if h.Reconnects != last.Reconnects || h.UnmarshalErrors != last.UnmarshalErrors || h.DroppedOutput != last.DroppedOutput {
+			llog.Info("stream health", llog.KV{
+				"connected":       h.Connected,
+				"reconnects":      h.Reconnects,
+				"unmarshalErrors": h.UnmarshalErrors,
+				"droppedOutput":   h.DroppedOutput,
+			})
+		}
+		last = h
+
+		downSince := h.Since
+		if downSince.IsZero() {
+			// we haven't connected yet
+			downSince = started
+		}
+		var msg events.Message
+		switch {
+		case !alerted && !h.Connected && time.Since(downSince) > cfg.StreamDownThreshold:
+			alerted = true
+			msg.Pretext = fmt.Sprintf("Gerrit event stream has been down since %s", downSince.Format(time.RFC822))
+			msg.Color = "danger"
+		case alerted && h.Connected:
+			alerted = false
+			msg.Pretext = "Gerrit event stream recovered"
+			msg.Color = "good"
+		default:
+			continue
+		}
+		llog.Warn(msg.Pretext)
+		if cfg.AdminWebhookURL == "" {
+			continue
+		}
+		msg.Fallback = msg.Pretext
+		msg.Channel = cfg.AdminChannel
+		msg.Fields = healthFields(h)
+		select {
+		case sch <- webhookSubmit{
+			Message:    msg,
+			WebhookURL: cfg.AdminWebhookURL,
+			SourceType: "health",
+		}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
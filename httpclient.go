@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+var (
+	// httpRetryMinDelay and httpRetryMaxDelay bound the delay between retries
+	// of gerrit's REST api
+	httpRetryMinDelay = 250 * time.Millisecond
+	httpRetryMaxDelay = 5 * time.Second
+)
+
+// newHTTPClient returns the client that's shared by every request to slack,
+// the other sinks and gerrit, with the timeouts and connection limits from the
+// config. A request that takes longer than http-timeout in total is cancelled.
+func newHTTPClient(cfg config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   cfg.HTTPConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Timeout: cfg.HTTPTimeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   cfg.HTTPConnectTimeout,
+			ResponseHeaderTimeout: cfg.HTTPTimeout,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   cfg.HTTPMaxConnsPerHost,
+			MaxConnsPerHost:       cfg.HTTPMaxConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// retryTransport retries idempotent requests, like gerrit's GETs, that fail
+// with a network error or a 429 or 5xx status, waiting a jittered backoff
+// between attempts
+type retryTransport struct {
+	next     http.RoundTripper
+	attempts int
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (rt retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// requests with a body can't be sent again
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) {
+		return rt.next.RoundTrip(req)
+	}
+	b := backoff{min: httpRetryMinDelay, max: httpRetryMaxDelay}
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.next.RoundTrip(req)
+		if attempt >= rt.attempts || !retryable(resp, err) {
+			return resp, err
+		}
+		kv := llog.KV{"url": req.URL.Path, "attempt": attempt}
+		if err != nil {
+			kv["err"] = err.Error()
+		} else {
+			kv["status"] = resp.StatusCode
+			resp.Body.Close()
+		}
+		llog.Debug("retrying gerrit request", kv)
+		select {
+		case <-time.After(b.next()):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryable returns true if the request might succeed if it's sent again
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// newGerritHTTPClient returns a copy of the client that retries gerrit's GETs
+// up to attempts times in total
+func newGerritHTTPClient(client *http.Client, attempts int) *http.Client {
+	if attempts <= 1 {
+		return client
+	}
+	c := *client
+	c.Transport = retryTransport{next: client.Transport, attempts: attempts}
+	return &c
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+	"github.com/segmentio/kafka-go"
+)
+
+// sourceKafka consumes events published by the events-kafka plugin
+const sourceKafka = "kafka"
+
+// brokerMessage is the envelope older versions of the events-broker wrap
+// events in, newer versions publish the event directly
+type brokerMessage struct {
+	Body json.RawMessage `json:"body"`
+}
+
+// parseBrokerEvent parses an event published by the events-broker
+func parseBrokerEvent(b []byte) (gerritssh.Event, error) {
+	var bm brokerMessage
+	if err := json.Unmarshal(b, &bm); err == nil && len(bm.Body) > 0 {
+		b = bm.Body
+	}
+	return gerritssh.ParseEvent(b)
+}
+
+// kafkaSource consumes events from kafka and sends them to ech until the
+// context is cancelled
+func kafkaSource(ctx context.Context, cfg config, ech chan<- gerritssh.Event) {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: strings.Split(cfg.KafkaBrokers, ","),
+		Topic:   cfg.KafkaTopic,
+		GroupID: cfg.KafkaGroup,
+	})
+	defer r.Close()
+
+	kv := llog.KV{"brokers": cfg.KafkaBrokers, "topic": cfg.KafkaTopic, "group": cfg.KafkaGroup}
+	llog.Info("consuming events from kafka", kv)
+	b := backoff{min: sshRetryMinDelay, max: sshRetryMaxDelay}
+	for {
+		// ReadMessage commits the offset for us since we're in a group
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			llog.Error("error reading from kafka", llog.ErrKV(err), kv)
+			select {
+			case <-time.After(b.next()):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		b.reset()
+		e, err := parseBrokerEvent(m.Value)
+		if err != nil {
+			llog.Error("error unmarshalling event", llog.ErrKV(err), kv)
+			continue
+		}
+		llog.Info("gerrit event", e.KV())
+		select {
+		case ech <- e:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
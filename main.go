@@ -2,46 +2,131 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/go-ini/ini"
-	"github.com/nlopes/slack"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/levenlabs/gerrit-slack/events"
 	"github.com/levenlabs/gerrit-slack/gerritssh"
 	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/sink"
+	"github.com/levenlabs/gerrit-slack/store"
 
 	"github.com/andygrunwald/go-gerrit"
 	"github.com/levenlabs/go-llog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var sshRetryDelay = 3 * time.Second
-
 type config struct {
 	HTTPAddress    string `ini:"http-address"`
+	CanonicalURL   string `ini:"canonical-web-url"`
 	SSHAddress     string `ini:"ssh-address"`
 	Username       string `ini:"username"`
 	Password       string `ini:"password"`
 	PrivateKeyPath string `ini:"private-key-path"`
+	Passphrase     string `ini:"private-key-passphrase"`
+	SSHAgent       bool   `ini:"ssh-agent"`
 	HostKey        string `ini:"host-key"`
+	KnownHosts     string `ini:"known-hosts"`
 	DebugEvents    string `ini:"debug-events"`
 	SlackToken     string `ini:"slack-token"`
+	SlackAppToken  string `ini:"slack-app-token"`
+	LogFile        string `ini:"log-file"`
+	LogMaxSize     int    `ini:"log-max-size"`
+	LogMaxBackups  int    `ini:"log-max-backups"`
+	LogMaxAge      int    `ini:"log-max-age"`
+	IgnoreUsers    string `ini:"ignore-users"`
+	IgnoreGroup    string `ini:"ignore-group"`
+	SMTPAddress    string `ini:"smtp-address"`
+	SMTPFrom       string `ini:"smtp-from"`
+	SMTPUsername   string `ini:"smtp-username"`
+	SMTPPassword   string `ini:"smtp-password"`
+	MatrixServer   string `ini:"matrix-homeserver"`
+	MatrixToken    string `ini:"matrix-access-token"`
+	SecretStore    string `ini:"secret-store"`
+	ProjectsFile   string `ini:"projects-file"`
+	SecretDir      string `ini:"secret-dir"`
+	VaultAddress   string `ini:"vault-address"`
+	VaultToken     string `ini:"vault-token"`
+	VaultPath      string `ini:"vault-path"`
+	PrefsPath      string `ini:"preferences-path"`
+	OptOutHashtag  string `ini:"opt-out-hashtag"`
+	StatePath      string `ini:"state-path"`
+
+	BackfillAfter  time.Duration `ini:"backfill-after"`
+	HandlerWorkers int           `ini:"handler-workers"`
+	StateTTLDays   int           `ini:"state-ttl-days"`
+
+	DestinationConcurrency int `ini:"destination-concurrency"`
+
+	ConfigCacheTTL  time.Duration `ini:"config-cache-ttl"`
+	WarmConfigCache bool          `ini:"warm-config-cache"`
+
+	EventBufferSize   int    `ini:"event-buffer-size"`
+	MessageBufferSize int    `ini:"message-buffer-size"`
+	EventOverflow     string `ini:"event-overflow"`
+	EventSpillPath    string `ini:"event-spill-path"`
+
+	HTTPTimeout           time.Duration `ini:"http-timeout"`
+	HTTPConnectTimeout    time.Duration `ini:"http-connect-timeout"`
+	HTTPMaxConnsPerHost   int           `ini:"http-max-conns-per-host"`
+	GerritRequestAttempts int           `ini:"gerrit-request-attempts"`
+	HTTPToken             string        `ini:"http-token"`
+	HTTPTokenCommand      string        `ini:"http-token-command"`
+	HTTPTokenRefresh      time.Duration `ini:"http-token-refresh"`
+
+	PendingSpillDir    string `ini:"pending-spill-dir"`
+	MaxPendingMessages int    `ini:"max-pending-messages"`
+
+	Source               string        `ini:"source"`
+	PollInterval         time.Duration `ini:"poll-interval"`
+	KafkaBrokers         string        `ini:"kafka-brokers"`
+	KafkaTopic           string        `ini:"kafka-topic"`
+	KafkaGroup           string        `ini:"kafka-group"`
+	NATSURL              string        `ini:"nats-url"`
+	NATSSubject          string        `ini:"nats-subject"`
+	NATSQueue            string        `ini:"nats-queue"`
+	AMQPURL              string        `ini:"amqp-url"`
+	AMQPQueue            string        `ini:"amqp-queue"`
+	SSHKeepAliveInterval time.Duration `ini:"ssh-keepalive-interval"`
+	StartupTimeout       time.Duration `ini:"startup-timeout"`
+	ShutdownTimeout      time.Duration `ini:"shutdown-timeout"`
+	SpoolPath            string        `ini:"spool-path"`
+
+	OTLPEndpoint        string        `ini:"otlp-endpoint"`
+	SentryDSN           string        `ini:"sentry-dsn"`
+	AdminAddress        string        `ini:"admin-address"`
+	PprofAddress        string        `ini:"pprof-address"`
+	AdminWebhookURL     string        `ini:"admin-webhook-url"`
+	AdminChannel        string        `ini:"admin-channel"`
+	StreamDownThreshold time.Duration `ini:"stream-down-threshold"`
+	NotifyBranchChanges bool          `ini:"notify-branch-changes"`
+
+	ReactionVoteLabels string `ini:"reaction-vote-labels"`
+	CommandGroup       string `ini:"command-group"`
+	UsergroupSync      string `ini:"usergroup-sync"`
 }
 
 func main() {
 	cp := flag.String("config", "./slack.config", "path to ini-formatted config file")
 	ll := flag.String("log-level", "info", "the log level to set on llog")
+	src := flag.String("source", "", "overrides the source of events in the config, like stdin or file:/path/to/events")
+	dryRun := flag.Bool("dry-run", false, "log messages instead of posting them")
 	flag.Parse()
 
 	err := llog.SetLevelFromString(*ll)
@@ -49,7 +134,38 @@ func main() {
 		llog.Fatal("invalid log-level", llog.ErrKV(err))
 	}
 
-	var cfg config
+	cfg := config{
+		LogMaxSize:           100,
+		LogMaxBackups:        3,
+		Source:               sourceSSH,
+		PollInterval:         30 * time.Second,
+		KafkaTopic:           "gerrit",
+		KafkaGroup:           "gerrit-slack",
+		NATSSubject:          "gerrit",
+		NATSQueue:            "gerrit-slack",
+		AMQPQueue:            "gerrit",
+		SSHKeepAliveInterval: gerritssh.DefaultKeepAliveInterval,
+		StartupTimeout:       10 * time.Minute,
+		ShutdownTimeout:      30 * time.Second,
+		StreamDownThreshold:  5 * time.Minute,
+		OptOutHashtag:        "noslack",
+		BackfillAfter:        10 * time.Minute,
+		StateTTLDays:         30,
+		HandlerWorkers:       20,
+
+		DestinationConcurrency: 1,
+		ConfigCacheTTL:         5 * time.Minute,
+		EventBufferSize:        10,
+		MessageBufferSize:      10,
+		EventOverflow:          overflowBlock,
+		HTTPTimeout:            30 * time.Second,
+		HTTPConnectTimeout:     10 * time.Second,
+		HTTPMaxConnsPerHost:    10,
+		GerritRequestAttempts:  3,
+		HTTPTokenRefresh:       30 * time.Minute,
+		MaxPendingMessages:     1000,
+		ReactionVoteLabels:     "Code-Review",
+	}
 	f, err := ini.Load(*cp)
 	if err != nil {
 		llog.Fatal("error reading config file", llog.ErrKV(err), llog.KV{"path": *cp})
@@ -57,220 +173,737 @@ func main() {
 	if err := f.Section("gerrit").MapTo(&cfg); err != nil {
 		llog.Fatal("error parsing config", llog.ErrKV(err), llog.KV{"path": *cp})
 	}
+	if *src != "" {
+		cfg.Source = *src
+	}
+	switch flag.Arg(0) {
+	case "status":
+		os.Exit(runStatus(cfg.AdminAddress))
+	case "state":
+		os.Exit(runState(cfg.StatePath, flag.Arg(1), flag.Arg(2)))
+	}
+	if cfg.LogFile != "" {
+		// logs in a file don't get timestamped by anything else
+		llog.DisplayTimestamp = true
+		llog.Out = &lumberjack.Logger{
+			Filename:   cfg.LogFile,
+			MaxSize:    cfg.LogMaxSize,
+			MaxBackups: cfg.LogMaxBackups,
+			MaxAge:     cfg.LogMaxAge,
+		}
+	}
 
-	client, err := gerrit.NewClient(cfg.HTTPAddress, nil)
+	if cfg.CanonicalURL != "" {
+		u, err := url.Parse(cfg.CanonicalURL)
+		if err == nil && (u.Scheme == "" || u.Host == "") {
+			err = errors.New("url must be absolute")
+		}
+		if err != nil {
+			llog.Fatal("invalid canonical-web-url", llog.ErrKV(err), llog.KV{"url": cfg.CanonicalURL})
+		}
+		gerritssh.CanonicalWebURL = u
+	}
+
+	httpClient := newHTTPClient(cfg)
+	gerritHTTPClient := newGerritHTTPClient(httpClient, cfg.GerritRequestAttempts)
+	var token *gerritToken
+	if cfg.HTTPToken != "" || cfg.HTTPTokenCommand != "" {
+		token = &gerritToken{refresh: cfg.HTTPTokenRefresh}
+		token.set(cfg.HTTPToken, cfg.HTTPTokenCommand)
+		gerritHTTPClient = withGerritToken(gerritHTTPClient, token)
+	}
+	client, err := gerrit.NewClient(cfg.HTTPAddress, gerritHTTPClient)
 	if err != nil {
 		llog.Fatal("error creating gerrit client", llog.ErrKV(err))
 	}
+	// basic auth is set even with a token so requests go to gerrit's
+	// authenticated /a/ endpoints, the token replaces its header
 	client.Authentication.SetBasicAuth(cfg.Username, cfg.Password)
 
+	var configs project.Provider = project.GerritProvider{Client: client}
+	if cfg.ProjectsFile != "" {
+		configs = project.NewFileProvider(cfg.ProjectsFile)
+	}
+	if flag.Arg(0) == "effective-config" {
+		os.Exit(runEffectiveConfig(configs, flag.Arg(1), flag.Arg(2)))
+	}
+
 	// make sure that the client works
-	if _, _, err := client.Accounts.GetAccount("self"); err != nil {
+	if err := waitForGerrit(client, cfg.StartupTimeout); err != nil {
 		llog.Fatal("error validating gerrit client", llog.ErrKV(err))
 	}
 	llog.Info("connected to rest api")
 
-	pk, err := ioutil.ReadFile(cfg.PrivateKeyPath)
-	if err != nil {
-		llog.Fatal("unable to read private key", llog.ErrKV(err))
+	// the projects-file is already only read when it changes
+	if cfg.ConfigCacheTTL > 0 && cfg.ProjectsFile == "" {
+		configs = project.NewCachedProvider(configs, cfg.ConfigCacheTTL)
+		if cfg.WarmConfigCache {
+			go warmConfigCache(client, configs)
+		}
 	}
-	sshc, err := gerritssh.NewClient(cfg.SSHAddress, cfg.Username, pk, []byte(cfg.HostKey))
-	if err != nil {
-		llog.Fatal("error creating ssh client", llog.ErrKV(err))
+
+	var sshc *gerritssh.Client
+	if cfg.Source == sourceSSH || cfg.DebugEvents != "" {
+		if sshc, err = newSSHClient(cfg); err != nil {
+			llog.Fatal("error creating ssh client", llog.ErrKV(err))
+		}
 	}
 
 	if cfg.DebugEvents != "" {
 		llog.Info("debugging events")
 		go debugEvents(cfg.DebugEvents, sshc)
 	}
-	// add a buffer so we don't overflow the ssh buffer trying to handle/submit
-	sch := make(chan webhookSubmit, 10)
-	go webhookSubmitter(sch)
-	ech := make(chan gerritssh.Event, 10)
-	go listenForEvents(client, ech, sch, cfg.SlackToken)
+	if cfg.OTLPEndpoint != "" {
+		shutdownTracing, err := initTracing(context.Background(), cfg.OTLPEndpoint)
+		if err != nil {
+			llog.Fatal("error setting up tracing", llog.ErrKV(err))
+		}
+		defer shutdownTracing(context.Background())
+	}
 
-	llog.Info("streaming events")
-	for {
-		if err := sshc.StreamEvents(context.Background(), ech); err != nil {
-			llog.Error("error streaming events", llog.ErrKV(err))
+	if cfg.SentryDSN != "" {
+		flushReports, err := initErrorReporting(cfg.SentryDSN)
+		if err != nil {
+			llog.Fatal("error setting up error reporting", llog.ErrKV(err))
 		}
-		time.Sleep(sshRetryDelay)
+		defer flushReports()
 	}
-}
 
-// SlackState holds various slack metadata that can be used to improve messages
-type slackState struct {
-	emailToID map[string]string
-	refreshed time.Time
-	sapi      *slack.Client
-}
+	// cancel the context on SIGINT/SIGTERM so we can shut down gracefully
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		llog.Info("shutting down", llog.KV{"signal": sig.String()})
+		cancel()
+	}()
 
-func (s *slackState) refresh() error {
-	if s.sapi == nil {
-		return nil
+	// add a buffer so we don't overflow the ssh buffer trying to handle/submit
+	sch := make(chan webhookSubmit, cfg.MessageBufferSize)
+	state := newSlackState(cfg.SlackToken, httpClient)
+	sinks := sink.New(sink.Config{
+		SlackToken:        state.Token,
+		SMTPAddress:       cfg.SMTPAddress,
+		SMTPFrom:          cfg.SMTPFrom,
+		SMTPUsername:      cfg.SMTPUsername,
+		SMTPPassword:      cfg.SMTPPassword,
+		MatrixHomeserver:  cfg.MatrixServer,
+		MatrixAccessToken: cfg.MatrixToken,
+		HTTPClient:        httpClient,
+	})
+	var changes *store.Store
+	if cfg.StatePath != "" {
+		if changes, err = store.Open(cfg.StatePath); err != nil {
+			llog.Fatal("error opening state store", llog.ErrKV(err))
+		}
+		defer changes.Close()
 	}
-	us, err := s.sapi.GetUsers()
+	lastRunning, err := changes.Heartbeat()
 	if err != nil {
-		return err
+		llog.Error("error reading heartbeat", llog.ErrKV(err))
 	}
-	emailToID := map[string]string{}
-	for _, u := range us {
-		if u.Profile.Email != "" {
-			emailToID[strings.ToLower(u.Profile.Email)] = u.ID
+	if changes != nil {
+		go heartbeatLoop(ctx, changes)
+		if cfg.StateTTLDays > 0 {
+			go stateCleanupLoop(ctx, changes, time.Duration(cfg.StateTTLDays)*24*time.Hour)
 		}
 	}
-	llog.Debug("loaded users from slack", llog.KV{"numUsers": len(emailToID)})
-	s.emailToID = emailToID
-	s.refreshed = time.Now()
-	return nil
-}
+	permalinks := &permalinker{client: client, state: state, username: cfg.Username}
+	sub := newSubmitter(sinks, cfg)
+	sub.secrets = newSecretStore(cfg)
+	sub.changes = changes
+	sub.dryRun = *dryRun
+	sub.permalinks = permalinks
+	submitDone := make(chan struct{})
+	go func() {
+		sub.run(sch)
+		close(submitDone)
+	}()
+	queues := newChangeQueues(cfg.HandlerWorkers)
+	prefs, err := newPrefStore(cfg.PrefsPath)
+	if err != nil {
+		llog.Fatal("error loading user preferences", llog.ErrKV(err))
+	}
+	go state.refreshLoop()
+	reloader := credentialReloader{
+		path:   *cp,
+		client: client,
+		sshc:   sshc,
+		state:  state,
+		token:  token,
+	}
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			if err := reloader.reload(); err != nil {
+				llog.Error("error reloading credentials", llog.ErrKV(err))
+			}
+		}
+	}()
+	if cfg.AdminAddress != "" {
+		a := adminAPI{
+			client:  client,
+			configs: configs,
+			state:   state,
+			prefs:   prefs,
+			changes: changes,
+			queues:  queues,
+			sub:     sub,
+			reload:  reloader.reload,
+		}
+		// with debug-events there's an ssh client even if it doesn't stream
+		if cfg.Source == sourceSSH {
+			a.sshc = sshc
+		}
+		go adminServer(ctx, cfg, a)
+	}
+	if cfg.PprofAddress != "" {
+		go pprofServer(ctx, cfg.PprofAddress)
+	}
+	bots := newBotFilter(client, cfg.IgnoreUsers, cfg.IgnoreGroup)
+	go bots.refreshLoop(ctx)
+	usergroups, err := parseUsergroupSync(cfg.UsergroupSync)
+	if err != nil {
+		llog.Fatal("invalid usergroup-sync", llog.ErrKV(err))
+	}
+	go usergroupSync{client: client, state: state, groups: usergroups}.run(ctx)
+	tracker := newEventTracker()
+	go sdWatchdog(ctx, tracker)
+	// sources send to ech and events are handled from hch, which are the same
+	// channel unless events can overflow somewhere other than the source
+	ech, hch := newEventChannels(cfg)
+	alerts := newConfigAlerter(cfg, sch)
+	eh := eventHandler{
+		client:    client,
+		configs:   configs,
+		sch:       sch,
+		state:     state,
+		sinks:     sinks,
+		alerts:    alerts,
+		prefs:     prefs,
+		changes:   changes,
+		reviewers: newReviewerAggregator(),
+		debounce:  newDebouncer(sch),
+		queues:    queues,
+		conflicts: newMergeConflicts(),
+
+		submittable: newSubmittablePatchSets(),
 
-func (s *slackState) refreshIfNecessary() error {
-	if s.sapi == nil {
-		return nil
+		permalinks:    permalinks,
+		optOutHashtag: strings.TrimPrefix(cfg.OptOutHashtag, "#"),
 	}
-	if time.Since(s.refreshed) > time.Hour {
-		return s.refresh()
+	if cfg.NotifyBranchChanges {
+		eh.branchWebhookURL = cfg.AdminWebhookURL
+		eh.branchChannel = cfg.AdminChannel
 	}
-	return nil
-}
+	// schWG tracks everything that sends to sch so we know when to close it
+	var schWG sync.WaitGroup
+	if cfg.SlackAppToken != "" {
+		commands := commandHandler{
+			client:     client,
+			state:      state,
+			httpClient: httpClient,
+			group:      cfg.CommandGroup,
+		}
+		sm := socketMode{
+			token:         cfg.SlackAppToken,
+			client:        httpClient,
+			handleEvent:   newReactionVoter(eh, cfg.ReactionVoteLabels).handle,
+			handleCommand: commands.handle,
+			// the reaction handlers can send alerts
+			handlers: &schWG,
+		}
+		schWG.Add(1)
+		go func() {
+			defer schWG.Done()
+			sm.run(ctx)
+		}()
+	}
+	schWG.Add(4)
+	go func() {
+		defer schWG.Done()
+		eh.backfillSummary(lastRunning, cfg.BackfillAfter)
+	}()
+	go func() {
+		defer schWG.Done()
+		eh.listen(hch, bots, tracker)
+	}()
+	go func() {
+		defer schWG.Done()
+		digestScheduler(ctx, client, configs, sch, alerts, bots, eh.optOutHashtag)
+	}()
+	go func() {
+		defer schWG.Done()
+		eh.escalationScheduler(ctx)
+	}()
 
-// MentionUser either returns just their name or it @ mentions them
-// MentionUser implements the events.MessageEnricher interface
-func (s *slackState) MentionUser(email string, name string) string {
-	llog.Debug("lloking up user", llog.KV{"email": email})
-	id, ok := s.emailToID[strings.ToLower(email)]
-	if ok {
-		return fmt.Sprintf("<@%s>", id)
+	if err := sdNotify("READY=1"); err != nil {
+		llog.Warn("error notifying systemd", llog.ErrKV(err))
+	}
+	switch cfg.Source {
+	case sourceSSH:
+		schWG.Add(1)
+		go func() {
+			defer schWG.Done()
+			healthReporter(ctx, sshc, cfg, sch)
+		}()
+		sshSource(ctx, client, sshc, ech)
+	case sourcePoll:
+		llog.Info("polling events", llog.KV{"interval": cfg.PollInterval})
+		gerritssh.PollEvents(ctx, client, cfg.PollInterval, ech)
+	case sourceKafka:
+		kafkaSource(ctx, cfg, ech)
+	case sourceNATS:
+		natsSource(ctx, cfg, ech)
+	case sourceAMQP:
+		amqpSource(ctx, cfg, ech)
+	case sourceStdin:
+		readerSource(ctx, os.Stdin, ech)
+	default:
+		path := strings.TrimPrefix(cfg.Source, sourceFilePrefix)
+		if path == cfg.Source {
+			llog.Fatal("unknown source", llog.KV{"source": cfg.Source})
+		}
+		fileSource(ctx, path, ech)
+	}
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		llog.Warn("error notifying systemd", llog.ErrKV(err))
 	}
-	return name
-}
 
-func listenForEvents(client *gerrit.Client, ech <-chan gerritssh.Event, sch chan webhookSubmit, token string) {
-	var state slackState
-	if token != "" {
-		state.sapi = slack.New(token)
+	// now that the source is stopped, close each channel once everything that
+	// sends to it has stopped so that all of the in-flight events are handled
+	// and their messages are sent
+	done := make(chan struct{})
+	go func() {
+		close(ech)
+		schWG.Wait()
+		close(sch)
+		<-submitDone
+		close(done)
+	}()
+	select {
+	case <-done:
+		llog.Info("shut down")
+	case <-time.After(cfg.ShutdownTimeout):
+		llog.Warn("timed out shutting down", llog.KV{"timeout": cfg.ShutdownTimeout})
+		// save whatever we can, including the messages that are still queued,
+		// the ones being posted right now might be sent again once we start
+		sub.Stop(sch)
+		sub.Spool()
 	}
-	if err := state.refresh(); err != nil {
-		llog.Fatal("failed to load slack metadata", llog.ErrKV(err))
+	llog.Flush()
+}
+
+// waitForGerrit checks that the REST api works, retrying for up to timeout in
+// case Gerrit is restarting. Only authentication errors fail immediately.
+func waitForGerrit(client *gerrit.Client, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	b := backoff{min: sshRetryMinDelay, max: sshRetryMaxDelay}
+	for {
+		_, resp, err := client.Accounts.GetAccount("self")
+		if err == nil {
+			return nil
+		}
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return err
+		}
+		delay := b.next()
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		llog.Warn("error connecting to rest api, retrying", llog.ErrKV(err), llog.KV{"delay": delay})
+		time.Sleep(delay)
 	}
+}
+
+// eventHandler turns events into messages and sends them to sch
+type eventHandler struct {
+	client    *gerrit.Client
+	configs   project.Provider
+	sch       chan webhookSubmit
+	state     *slackState
+	sinks     map[string]sink.Sink
+	alerts    *configAlerter
+	prefs     *prefStore
+	changes   *store.Store
+	reviewers *reviewerAggregator
+	debounce  *debouncer
+	queues    *changeQueues
+	conflicts *mergeConflicts
 
+	// submittable remembers which patch sets their owners were told could be
+	// submitted when changes is nil
+	submittable *submittablePatchSets
+
+	// permalinks recognizes our own permalink comments so they're ignored
+	permalinks *permalinker
+	// optOutHashtag suppresses every notification for changes that have it
+	optOutHashtag string
+
+	// branchWebhookURL and branchChannel are where branches that are created
+	// or deleted are posted, they're empty unless notify-branch-changes is set
+	branchWebhookURL string
+	branchChannel    string
+}
+
+func (eh eventHandler) listen(ech <-chan gerritssh.Event, bots *botFilter, tracker *eventTracker) {
+	var wg sync.WaitGroup
+	defer eh.debounce.Flush()
+	defer wg.Wait()
+	dedup := newEventDedup()
 	for e := range ech {
-		go func(e gerritssh.Event) {
-			var pcfg project.Config
-			if e.Change.Project != "" {
-				var err error
-				pcfg, err = project.LoadConfig(client, e.Change.Project)
-				if err != nil {
-					llog.Error("error loading config", llog.ErrKV(err), e.KV())
-					return
-				}
-			}
-			h, ok := events.Handler(e, pcfg)
-			if !ok {
-				llog.Info("no handlers for event", e.KV())
-				return
-			}
-			ignore, err := h.Ignore(e, pcfg)
-			if err != nil {
-				llog.Error("error handling event", llog.ErrKV(err), e.KV(), llog.KV{"handler": h.Type()})
-				return
-			}
-			if ignore {
-				return
-			}
-			if err := state.refreshIfNecessary(); err != nil {
-				llog.Error("error refreshing slack metadata", llog.ErrKV(err))
-			}
-			msg, err := h.Message(e, pcfg, client, &state)
-			if err != nil {
-				llog.Error("error generating message for event", llog.ErrKV(err), e.KV(), llog.KV{"handler": h.Type()})
-				return
-			}
-			sch <- webhookSubmit{
-				Message:    msg,
-				WebhookURL: pcfg.WebhookURL,
-				SourceType: e.Type,
+		if dedup.duplicate(e) {
+			llog.Info("ignoring duplicate event", e.KV(), llog.KV{"created": e.TSCreated})
+			continue
+		}
+		if bots.ignore(e) {
+			llog.Debug("ignoring event from bot", e.KV(), llog.KV{"username": e.Actor().Username})
+			continue
+		}
+		if eh.permalinks.isPermalinkComment(e) {
+			continue
+		}
+		e.Change.RewriteURL()
+		// this has to happen in the order events are received so that the
+		// reviewer-added events are collected by their patch set
+		switch e.Type {
+		case gerritssh.EventTypePatchSetCreated:
+			eh.reviewers.Open(e)
+		case gerritssh.EventTypeReviewerAdded:
+			e.AddedWithPatchSet = eh.reviewers.Add(e)
+			gerritssh.InvalidateReviewers(e.Change.Project, e.Change.Number)
+		case gerritssh.EventTypeReviewerDeleted:
+			gerritssh.InvalidateReviewers(e.Change.Project, e.Change.Number)
+		case gerritssh.EventTypeRefUpdated:
+			if cp, ok := eh.configs.(*project.CachedProvider); ok && e.RefUpdate.RefName == metaConfigRef {
+				cp.Invalidate()
 			}
-		}(e)
+		}
+		wg.Add(1)
+		// a change's events are handled in order so its messages are too
+		e := e
+		eh.queues.Run(e, func() {
+			defer wg.Done()
+			// events waiting for a worker aren't stuck
+			defer tracker.start()()
+			defer reportPanic(e.KV())
+			eh.handle(e)
+		})
 	}
 }
 
-type webhookSubmit struct {
-	events.Message
-	WebhookURL string
-	SourceType string
-}
+// handle generates the messages for the event, if any, and sends them to sch
+func (eh eventHandler) handle(e gerritssh.Event) {
+	ctx, span := startSpan(context.Background(), "event", eventAttributes(e)...)
+	defer span.End()
+	if e.TSCreated > 0 {
+		span.SetAttributes(attribute.Int64("gerrit.event.delay_ms", int64(time.Since(time.Unix(e.TSCreated, 0))/time.Millisecond)))
+	}
 
-func webhookSubmitter(sch <-chan webhookSubmit) {
-	var pendingMessages []webhookSubmit
+	if eh.optedOut(e) {
+		llog.Debug("ignoring event for opted out change", e.KV(), llog.KV{"hashtag": eh.optOutHashtag})
+		return
+	}
 
-	publish := func(s webhookSubmit) bool {
-		if s.WebhookURL == "" {
-			return true
+	if e.Change.Number > 0 && e.Change.Status != "" {
+		change := store.Change{Project: e.Change.Project, Number: e.Change.Number}
+		if err := eh.changes.SetStatus(change, string(e.Change.Status)); err != nil {
+			llog.Error("error recording change status", llog.ErrKV(err), e.KV())
+		}
+		switch e.Type {
+		case gerritssh.EventTypeChangeAbandoned, gerritssh.EventTypeChangeRestored:
+			eh.markFirst(e, change)
+		}
+	}
+	if e.Type == gerritssh.EventTypeRefUpdated {
+		eh.handleRefUpdated(ctx, e)
+	}
+	// events without a handler, like most of the stateEventTypes, aren't posted
+	if _, ok := events.Handler(e, project.Config{}); !ok {
+		return
+	}
+
+	var pcfg project.Config
+	if e.Change.Project != "" {
+		_, cspan := startSpan(ctx, "load config")
+		var err error
+		pcfg, err = eh.configs.LoadConfig(e.Change.Project)
+		if err == nil {
+			pcfg, err = pcfg.ForBranch(e.Change.Branch)
 		}
-		b, err := json.Marshal(s.Message)
+		cspan.End()
 		if err != nil {
-			llog.Error("error marshalling message", llog.ErrKV(err))
-			// pretend it worked because we can't magically marshal it later
+			span.RecordError(err)
+			llog.Error("error loading config", llog.ErrKV(err), e.KV())
+			eh.alerts.alert(err)
+			return
+		}
+	}
+	if e.Type == gerritssh.EventTypePatchSetCreated && !pcfg.PublishPatchSetCreatedImmediately {
+		_, wspan := startSpan(ctx, "wait for reviewers")
+		e.PatchSetReviewers = eh.reviewers.Wait(e)
+		wspan.End()
+	}
+	// this is after waiting for reviewers so the change's detail includes them
+	_, lspan := startSpan(ctx, "load")
+	err := events.Load(&e, pcfg, eh.client)
+	lspan.End()
+	if err != nil {
+		span.RecordError(err)
+		llog.Error("error loading event", llog.ErrKV(err), e.KV())
+		return
+	}
+	// each destination has its own handlers and message, they're handled
+	// concurrently since a handler might wait before generating its message
+	var wg sync.WaitGroup
+	for _, dcfg := range pcfg.DestinationConfigs() {
+		wg.Add(1)
+		go func(dcfg project.Config) {
+			defer wg.Done()
+			eh.handleDestination(ctx, e, dcfg)
+		}(dcfg)
+	}
+	if !eh.prefs.Empty() && e.Change.Number > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			eh.handleDirectMessages(ctx, e, pcfg)
+		}()
+	}
+	if pcfg.Enabled && pcfg.NotifyOwnerOnCIFailure != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			eh.handleCIFailure(ctx, e, pcfg)
+		}()
+	}
+	if pcfg.Enabled && pcfg.NotifyOwnerOnSubmittable != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			eh.handleSubmittable(ctx, e, pcfg)
+		}()
+	}
+	wg.Wait()
+}
+
+// handleDirectMessages sends the event's message directly to the change's owner
+// and reviewers that opted into it in their preferences
+func (eh eventHandler) handleDirectMessages(ctx context.Context, e gerritssh.Event, pcfg project.Config) {
+	ctx, span := startSpan(ctx, "direct messages")
+	defer span.End()
+	h, ok := events.Handler(e, pcfg)
+	if !ok {
+		return
+	}
+	ignore, err := h.Ignore(e, pcfg)
+	if err != nil {
+		span.RecordError(err)
+		llog.Error("error handling event", llog.ErrKV(err), e.KV(), llog.KV{"handler": h.Type()})
+		return
+	} else if ignore {
+		return
+	}
+	if err := e.LoadReviewers(eh.client); err != nil {
+		span.RecordError(err)
+		llog.Error("error loading reviewers for direct messages", llog.ErrKV(err), e.KV())
+		return
+	}
+	recipients := eh.prefs.Recipients(e)
+	if len(recipients) == 0 {
+		return
+	}
+	msg, err := h.Message(e, pcfg, eh.client, eh.state)
+	if err != nil {
+		span.RecordError(err)
+		llog.Error("error generating message for event", llog.ErrKV(err), e.KV(), llog.KV{"handler": h.Type()})
+		return
+	}
+	dcfg := pcfg
+	dcfg.Sink = sink.SlackDMName
+	dcfg.WebhookURLSecret = ""
+	for _, email := range recipients {
+		id := eh.state.UserID(email)
+		if id == "" {
+			llog.Debug("no slack user for direct message", e.KV(), llog.KV{"email": email})
+			continue
+		}
+		m := msg
+		m.Channel = id
+		eh.sch <- webhookSubmit{
+			Message:       m,
+			SourceType:    e.Type,
+			ProjectConfig: dcfg,
+			ctx:           ctx,
+		}
+	}
+}
+
+// optedOut returns true if the event's change has the opt-out-hashtag
+func (eh eventHandler) optedOut(e gerritssh.Event) bool {
+	if eh.optOutHashtag == "" {
+		return false
+	}
+	for _, h := range e.Change.Hashtags {
+		if strings.EqualFold(strings.TrimPrefix(h, "#"), eh.optOutHashtag) {
 			return true
 		}
-		resp, err := http.Post(s.WebhookURL, "application/json", bytes.NewBuffer(b))
+	}
+	return false
+}
+
+// handleDestination generates the message for the event for a single one of
+// the project's destinations, if any, and sends it to sch
+func (eh eventHandler) handleDestination(ctx context.Context, e gerritssh.Event, pcfg project.Config) {
+	ctx, span := startSpan(ctx, "destination", attribute.String("sink", pcfg.Sink))
+	defer span.End()
+	var caps sink.Capabilities
+	if sk, ok := eh.sinks[pcfg.Sink]; ok {
+		caps = sk.Capabilities()
+	}
+	// mentions are slack user ids so they're only included if they're rendered
+	if !caps.Mentions {
+		pcfg.MentionPolicy = project.MentionPolicyNever
+	}
+	h, ok := events.Handler(e, pcfg)
+	if !ok {
+		llog.Info("no handlers for event", e.KV())
+		return
+	}
+	_, ispan := startSpan(ctx, "ignore")
+	ignore, err := h.Ignore(e, pcfg)
+	ispan.SetAttributes(attribute.Bool("ignore", ignore))
+	ispan.End()
+	if err != nil {
+		span.RecordError(err)
+		llog.Error("error handling event", llog.ErrKV(err), e.KV(), llog.KV{"handler": h.Type()})
+		return
+	}
+	if ignore {
+		return
+	}
+	if pcfg.Filter != "" && e.Change.Number > 0 {
+		match, err := gerritssh.ChangeMatches(eh.client, e.Change.Project, e.Change.Number, pcfg.Filter)
 		if err != nil {
-			llog.Error("error posting to slack webhook", llog.ErrKV(err), llog.KV{"url": s.WebhookURL})
-			return false
-		}
-		defer resp.Body.Close()
-		kv := llog.KV{
-			"channel": s.Channel,
-			"url":     s.WebhookURL,
-			"source":  s.SourceType,
-		}
-		switch resp.StatusCode {
-		case http.StatusOK:
-			llog.Info("posted to slack channel", kv)
-		case http.StatusNotFound:
-			llog.Error("slack channel does not exist", kv)
-		case http.StatusGone:
-			llog.Error("slack channel is archived", kv)
-		default:
-			var sbody string
-			body, err := ioutil.ReadAll(resp.Body)
-			if err == nil {
-				sbody = string(body)
-				if len(sbody) > 250 {
-					sbody = sbody[:250]
-				}
-			}
-			llog.Error("unknown error posting to slack", kv, llog.KV{
-				"status": resp.StatusCode,
-				"body":   sbody,
-			})
-			return false
+			span.RecordError(err)
+			llog.Error("error matching filter", llog.ErrKV(err), e.KV())
+			return
+		} else if !match {
+			return
 		}
-		return true
 	}
-	// retry pending messages every minute
-	tick := time.NewTicker(time.Minute)
-	defer tick.Stop()
-	for {
-		select {
-		case <-tick.C:
-			if len(pendingMessages) > 0 {
-				var newPend []webhookSubmit
-				for _, s := range pendingMessages {
-					if !publish(s) {
-						newPend = append(newPend, s)
-					}
-				}
-				pendingMessages = newPend
-			}
-		case s := <-sch:
-			if !publish(s) {
-				pendingMessages = append(pendingMessages, s)
-			}
+	_, mspan := startSpan(ctx, "message")
+	msg, err := h.Message(e, pcfg, eh.client, eh.state)
+	mspan.End()
+	if err != nil {
+		span.RecordError(err)
+		llog.Error("error generating message for event", llog.ErrKV(err), e.KV(), llog.KV{"handler": h.Type()})
+		return
+	}
+	change := store.Change{Project: e.Change.Project, Number: e.Change.Number}
+	if pcfg.ThreadUpdates && e.Type == gerritssh.EventTypePatchSetCreated && e.PatchSet.Number > 1 {
+		eh.threadUnderFirst(&msg, change, pcfg)
+	}
+	var recipients []string
+	if caps.Recipients {
+		if err := e.LoadReviewers(eh.client); err != nil {
+			span.RecordError(err)
+			llog.Error("error loading reviewers for recipients", llog.ErrKV(err), e.KV())
+			return
+		}
+		recipients = messageRecipients(e)
+	}
+	s := webhookSubmit{
+		Message:       msg,
+		WebhookURL:    pcfg.WebhookURL,
+		SourceType:    e.Type,
+		ProjectConfig: pcfg,
+		Recipients:    recipients,
+		Change:        change,
+		ctx:           ctx,
+	}
+	if pcfg.Debounce > 0 && change.Number > 0 {
+		eh.debounce.Add(s)
+		return
+	}
+	eh.sch <- s
+}
+
+// threadUnderFirst makes the message a reply to the first message posted for
+// the change by the same destination, if it was recorded
+func (eh eventHandler) threadUnderFirst(msg *events.Message, change store.Change, pcfg project.Config) {
+	r, ok, err := eh.changes.Get(change)
+	if err != nil {
+		llog.Error("error getting change's first message", llog.ErrKV(err))
+		return
+	}
+	// abandoned changes aren't threaded until they're restored
+	if !ok || r.TS == "" || r.Destination != pcfg.DestinationName() ||
+		r.Status == string(gerritssh.ChangeStatusAbandoned) {
+		return
+	}
+	msg.Channel = r.Channel
+	msg.ThreadTS = r.TS
+	msg.ReplyBroadcast = pcfg.ThreadBroadcast
+}
+
+// abandonedMarker is prepended to the first message of abandoned changes
+const abandonedMarker = "⛔ "
+
+// abandonedColor replaces the color of the first message of abandoned changes
+const abandonedColor = "#9e9e9e"
+
+// markFirst edits the first message posted for the change, if it was recorded,
+// to mark it as abandoned or, if the change was restored, back to how it was
+func (eh eventHandler) markFirst(e gerritssh.Event, change store.Change) {
+	r, ok, err := eh.changes.Get(change)
+	if err != nil {
+		llog.Error("error getting change's first message", llog.ErrKV(err), e.KV())
+		return
+	}
+	if !ok || r.TS == "" || r.Attachment == nil {
+		return
+	}
+	msg := events.Message{Attachment: *r.Attachment, Channel: r.Channel}
+	if e.Type == gerritssh.EventTypeChangeAbandoned {
+		msg.Pretext = abandonedMarker + msg.Pretext
+		msg.Fallback = abandonedMarker + msg.Fallback
+		msg.Color = abandonedColor
+	}
+	pcfg := project.DefaultConfig()
+	pcfg.Sink = project.SinkSlackAPI
+	eh.sch <- webhookSubmit{
+		Message:       msg,
+		SourceType:    e.Type,
+		ProjectConfig: pcfg,
+		EditTS:        r.TS,
+	}
+}
+
+// messageRecipients returns the emails of the change's owner and reviewers,
+// excluding whoever caused the event. The event's reviewers should already be
+// loaded.
+func messageRecipients(e gerritssh.Event) []string {
+	actor := e.Actor().Email
+	set := map[string]bool{}
+	add := func(email string) {
+		if email != "" && email != actor {
+			set[email] = true
 		}
 	}
+	add(e.Change.Owner.Email)
+	for _, a := range e.Reviewers[gerritssh.ReviewerStateReviewer] {
+		add(a.Email)
+	}
+	rs := make([]string, 0, len(set))
+	for email := range set {
+		rs = append(rs, email)
+	}
+	sort.Strings(rs)
+	return rs
 }
 
 // todo: this is very similar to gerritssh.Client.StreamEvents
@@ -294,7 +927,7 @@ func debugEvents(p string, sshc *gerritssh.Client) {
 		sos := bufio.NewScanner(sout)
 		runCh := make(chan error, 1)
 		go func() {
-			runCh <- sess.Run("gerrit stream-events")
+			runCh <- sess.Run(gerritssh.StreamEventsCommand())
 		}()
 		readCh := make(chan error, 1)
 		go func() {
@@ -321,10 +954,15 @@ func debugEvents(p string, sshc *gerritssh.Client) {
 		}
 		return err
 	}
+	b := backoff{min: sshRetryMinDelay, max: sshRetryMaxDelay}
 	for {
+		start := time.Now()
 		if err := innerDebug(); err != nil {
 			llog.Error("error streaming debug events", llog.ErrKV(err))
 		}
-		time.Sleep(sshRetryDelay)
+		if time.Since(start) > sshRetryMaxDelay {
+			b.reset()
+		}
+		time.Sleep(b.next())
 	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/go-llog"
+)
+
+// mergeConflictMaxChanges is the most open changes on a branch whose
+// mergeability is checked when the branch is updated
+var mergeConflictMaxChanges = 100
+
+// mergeConflictSourceType is the SourceType of the messages about merge
+// conflicts
+const mergeConflictSourceType = "merge-conflict"
+
+// branchConflicts is the last check of a branch's open changes
+type branchConflicts struct {
+	// running is true while the branch is being checked and again is set if
+	// it was updated in the meantime so it needs to be checked again
+	running, again bool
+	checked        bool
+	unmergeable    map[int64]bool
+}
+
+// mergeConflicts tracks which open changes can't be merged into their branch
+// so that owners are only notified when a change becomes unmergeable
+type mergeConflicts struct {
+	l        sync.Mutex
+	branches map[string]*branchConflicts
+}
+
+func newMergeConflicts() *mergeConflicts {
+	return &mergeConflicts{branches: map[string]*branchConflicts{}}
+}
+
+// start returns true if the branch should be checked now. If it's already being
+// checked then it's checked again once that check finishes.
+func (mc *mergeConflicts) start(key string) bool {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	b, ok := mc.branches[key]
+	if !ok {
+		b = &branchConflicts{}
+		mc.branches[key] = b
+	}
+	if b.running {
+		b.again = true
+		return false
+	}
+	b.running = true
+	return true
+}
+
+// finish records the unmergeable changes found by the check and returns the
+// ones that weren't unmergeable before. Nothing is returned for a branch's first
+// check since we don't know which changes were already unmergeable. It also
+// returns true if the branch needs to be checked again.
+func (mc *mergeConflicts) finish(key string, unmergeable map[int64]bool) (map[int64]bool, bool) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	b := mc.branches[key]
+	newly := map[int64]bool{}
+	for n := range unmergeable {
+		if b.checked && !b.unmergeable[n] {
+			newly[n] = true
+		}
+	}
+	b.checked = true
+	b.unmergeable = unmergeable
+	again := b.again
+	b.running, b.again = again, false
+	return newly, again
+}
+
+// abort ends a check that failed, keeping the results of the last one. It
+// returns true if the branch needs to be checked again.
+func (mc *mergeConflicts) abort(key string) bool {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	b := mc.branches[key]
+	again := b.again
+	b.running, b.again = again, false
+	return again
+}
+
+// previously returns true if the change was unmergeable in the branch's last
+// check
+func (mc *mergeConflicts) previously(key string, number int64) bool {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	return mc.branches[key].unmergeable[number]
+}
+
+// checkMergeConflicts checks the mergeability of the open changes on the
+// updated branch and notifies the owners of the ones that became unmergeable,
+// as set by notify-owner-on-merge-conflict
+func (eh eventHandler) checkMergeConflicts(ctx context.Context, e gerritssh.Event, branch string, pcfg project.Config) {
+	ru := e.RefUpdate
+	ctx, span := startSpan(ctx, "merge conflicts")
+	defer span.End()
+	key := ru.Project + "~" + branch
+	if !eh.conflicts.start(key) {
+		return
+	}
+	for again := true; again; {
+		kv := llog.KV{"project": ru.Project, "branch": branch}
+		cs, err := gerritssh.OpenChanges(eh.client, ru.Project, branch, mergeConflictMaxChanges)
+		if err != nil {
+			span.RecordError(err)
+			llog.Error("error getting open changes to check for merge conflicts", llog.ErrKV(err), kv)
+			again = eh.conflicts.abort(key)
+			continue
+		}
+		unmergeable := map[int64]bool{}
+		for _, c := range cs {
+			ok, err := gerritssh.Mergeable(eh.client, ru.Project, c.Number)
+			if err != nil {
+				llog.Warn("error checking if change is mergeable", llog.ErrKV(err), kv)
+				// assume nothing changed so it isn't notified twice
+				ok = !eh.conflicts.previously(key, c.Number)
+			}
+			if !ok {
+				unmergeable[c.Number] = true
+			}
+		}
+		var newly map[int64]bool
+		newly, again = eh.conflicts.finish(key, unmergeable)
+		for _, c := range cs {
+			if !newly[c.Number] || eh.optedOut(gerritssh.Event{Change: c}) {
+				continue
+			}
+			c := c
+			eh.notifyOwner(ctx, mergeConflictSourceType, c, pcfg, pcfg.NotifyOwnerOnMergeConflict, func(mention string) events.Message {
+				return events.MergeConflictMessage(c, mention)
+			})
+		}
+	}
+}
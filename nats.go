@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+	"github.com/nats-io/nats.go"
+)
+
+// sourceNATS consumes events published to a NATS subject
+const sourceNATS = "nats"
+
+// natsSource subscribes to the configured subject and sends events to ech until
+// the context is cancelled
+func natsSource(ctx context.Context, cfg config, ech chan<- gerritssh.Event) {
+	kv := llog.KV{"url": cfg.NATSURL, "subject": cfg.NATSSubject, "queue": cfg.NATSQueue}
+	// nats reconnects on its own once it's connected but the initial connect
+	// needs to be retried
+	var nc *nats.Conn
+	b := backoff{min: sshRetryMinDelay, max: sshRetryMaxDelay}
+	for {
+		var err error
+		nc, err = nats.Connect(cfg.NATSURL, nats.MaxReconnects(-1))
+		if err == nil {
+			break
+		}
+		llog.Error("error connecting to nats", llog.ErrKV(err), kv)
+		select {
+		case <-time.After(b.next()):
+		case <-ctx.Done():
+			return
+		}
+	}
+	defer nc.Close()
+
+	msgCh := make(chan *nats.Msg, 64)
+	// a queue group lets multiple instances share the events
+	sub, err := nc.ChanQueueSubscribe(cfg.NATSSubject, cfg.NATSQueue, msgCh)
+	if err != nil {
+		llog.Error("error subscribing to nats", llog.ErrKV(err), kv)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	llog.Info("consuming events from nats", kv)
+	for {
+		select {
+		case m := <-msgCh:
+			e, err := parseBrokerEvent(m.Data)
+			if err != nil {
+				llog.Error("error unmarshalling event", llog.ErrKV(err), kv)
+				continue
+			}
+			llog.Info("gerrit event", e.KV())
+			select {
+			case ech <- e:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
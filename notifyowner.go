@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/sink"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+)
+
+// notifyOwner sends the change's owner the message from msg, as set by mode.
+// Replies in the change's thread mention the owner and fall back to a direct
+// message if the change's first message wasn't recorded. The mention passed to
+// msg is empty for direct messages.
+func (eh eventHandler) notifyOwner(ctx context.Context, sourceType string, c gerritssh.EventChange, pcfg project.Config, mode string, msg func(mention string) events.Message) {
+	id := eh.state.UserID(c.Owner.Email)
+	if mode == project.NotifyOwnerThread {
+		mention := c.Owner.Name
+		if id != "" {
+			mention = fmt.Sprintf("<@%s>", id)
+		}
+		if eh.replyInThread(ctx, sourceType, c, pcfg, msg(mention)) {
+			return
+		}
+	}
+	if id == "" {
+		llog.Debug("no slack user to notify", llog.KV{
+			"project":    c.Project,
+			"number":     c.Number,
+			"email":      c.Owner.Email,
+			"sourceType": sourceType,
+		})
+		return
+	}
+	m := msg("")
+	m.Channel = id
+	dcfg := pcfg
+	dcfg.Sink = sink.SlackDMName
+	dcfg.WebhookURLSecret = ""
+	eh.sch <- webhookSubmit{
+		Message:       m,
+		SourceType:    sourceType,
+		ProjectConfig: dcfg,
+		ctx:           ctx,
+	}
+}
+
+// replyInThread sends the message as a reply to the change's first message and
+// returns false if that wasn't recorded
+func (eh eventHandler) replyInThread(ctx context.Context, sourceType string, c gerritssh.EventChange, pcfg project.Config, m events.Message) bool {
+	r, ok, err := eh.changes.Get(store.Change{Project: c.Project, Number: c.Number})
+	if err != nil {
+		llog.Error("error getting change's first message", llog.ErrKV(err), llog.KV{"project": c.Project, "number": c.Number})
+		return false
+	} else if !ok || r.TS == "" {
+		return false
+	}
+	m.Channel = r.Channel
+	m.ThreadTS = r.TS
+	dcfg := pcfg
+	dcfg.Sink = project.SinkSlackAPI
+	dcfg.WebhookURLSecret = ""
+	eh.sch <- webhookSubmit{
+		Message:       m,
+		SourceType:    sourceType,
+		ProjectConfig: dcfg,
+		ctx:           ctx,
+	}
+	return true
+}
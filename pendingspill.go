@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// pendingSpillExt is the extension of the files in the pending-spill-dir
+const pendingSpillExt = ".jsonl"
+
+// pendingSpill is a file that holds a destination's oldest pending messages
+// once there are too many to keep in memory. Messages are appended to its end
+// and sent from its start, in the spool file's format.
+type pendingSpill struct {
+	path string
+	// f is only opened once something is spilled
+	f *os.File
+	// next is where the oldest message starts and end is where the next one
+	// is written
+	next, end int64
+	// n is how many messages are in the file
+	n int
+}
+
+// newPendingSpill returns the spill for the destination in the dir
+func newPendingSpill(dir, key string) *pendingSpill {
+	h := sha1.Sum([]byte(key))
+	return &pendingSpill{path: filepath.Join(dir, hex.EncodeToString(h[:])+pendingSpillExt)}
+}
+
+// write appends the messages to the end of the file
+func (ps *pendingSpill) write(ss []webhookSubmit) error {
+	if ps.f == nil {
+		// the webhook urls are secret so only we can read the file
+		f, err := os.OpenFile(ps.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return llog.ErrWithKV(err, llog.KV{"path": ps.path})
+		}
+		ps.f = f
+	}
+	var b []byte
+	for _, s := range ss {
+		sb, err := json.Marshal(newSpooledMessage(s))
+		if err != nil {
+			return err
+		}
+		b = append(append(b, sb...), '\n')
+	}
+	n, err := ps.f.WriteAt(b, ps.end)
+	ps.end += int64(n)
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": ps.path})
+	}
+	ps.n += len(ss)
+	return nil
+}
+
+// peek returns the oldest message and its size, which is passed to advance
+// once it's sent. It returns false if there aren't any messages.
+func (ps *pendingSpill) peek() (webhookSubmit, int64, bool, error) {
+	if ps.n == 0 {
+		return webhookSubmit{}, 0, false, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(ps.f, ps.next, ps.end-ps.next))
+	b, err := r.ReadBytes('\n')
+	if err != nil {
+		return webhookSubmit{}, 0, false, llog.ErrWithKV(err, llog.KV{"path": ps.path})
+	}
+	var sm spooledMessage
+	if err := json.Unmarshal(b, &sm); err != nil {
+		return webhookSubmit{}, int64(len(b)), false, llog.ErrWithKV(err, llog.KV{"path": ps.path})
+	}
+	return sm.submit(), int64(len(b)), true, nil
+}
+
+// advance removes the oldest message, whose size was returned by peek. Once
+// there are no messages left the file is truncated.
+func (ps *pendingSpill) advance(size int64) {
+	ps.next += size
+	ps.n--
+	if ps.n > 0 {
+		return
+	}
+	ps.clear()
+}
+
+// all returns every message in the file, oldest first
+func (ps *pendingSpill) all() ([]webhookSubmit, error) {
+	if ps.n == 0 {
+		return nil, nil
+	}
+	var ss []webhookSubmit
+	sc := bufio.NewScanner(io.NewSectionReader(ps.f, ps.next, ps.end-ps.next))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		var sm spooledMessage
+		if err := json.Unmarshal(sc.Bytes(), &sm); err != nil {
+			llog.Warn("skipping invalid spilled message", llog.ErrKV(err), llog.KV{"path": ps.path})
+			continue
+		}
+		ss = append(ss, sm.submit())
+	}
+	if err := sc.Err(); err != nil {
+		return ss, llog.ErrWithKV(err, llog.KV{"path": ps.path})
+	}
+	return ss, nil
+}
+
+// clear drops every message and truncates the file
+func (ps *pendingSpill) clear() {
+	ps.next, ps.end, ps.n = 0, 0, 0
+	if ps.f == nil {
+		return
+	}
+	if err := ps.f.Truncate(0); err != nil {
+		llog.Error("error truncating pending spill file", llog.ErrKV(err), llog.KV{"path": ps.path})
+	}
+}
+
+// close closes and removes the file
+func (ps *pendingSpill) close() {
+	if ps.f == nil {
+		return
+	}
+	ps.f.Close()
+	ps.f = nil
+	ps.next, ps.end, ps.n = 0, 0, 0
+	if err := os.Remove(ps.path); err != nil {
+		llog.Warn("error removing pending spill file", llog.ErrKV(err), llog.KV{"path": ps.path})
+	}
+}
+
+// readPendingSpills reads and removes the spill files that were left in the
+// dir, like when we crashed before they could be spooled
+func readPendingSpills(dir string) ([]webhookSubmit, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+pendingSpillExt))
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"dir": dir})
+	}
+	var ss []webhookSubmit
+	for _, path := range paths {
+		pss, err := readSpool(path)
+		if err != nil {
+			return ss, err
+		}
+		ss = append(ss, pss...)
+	}
+	return ss, nil
+}
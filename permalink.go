@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/sink"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+	"github.com/nlopes/slack"
+)
+
+const (
+	// permalinkCommentPrefix starts the comments with the permalinks so that
+	// their comment-added events can be recognized and ignored
+	permalinkCommentPrefix = "Slack discussion: "
+
+	// permalinkTag is the tag of the permalink comments, autogenerated tags
+	// are hidden by gerrit's "Only comments" filter
+	permalinkTag = "autogenerated:gerrit-slack"
+)
+
+// permalinker comments on changes with the permalinks of their first messages
+type permalinker struct {
+	client   *gerrit.Client
+	state    *slackState
+	username string
+}
+
+// post comments on the change with the permalink of the posted message
+func (p *permalinker) post(c store.Change, posted sink.Posted) {
+	kv := llog.KV{"project": c.Project, "number": c.Number, "channel": posted.Channel}
+	api := p.state.api()
+	if api == nil {
+		llog.Error("error getting permalink", llog.ErrKV(errors.New("slack-token is not set")), kv)
+		return
+	}
+	link, err := api.GetPermalink(&slack.PermalinkParameters{Channel: posted.Channel, Ts: posted.TS})
+	if err != nil {
+		llog.Error("error getting permalink", llog.ErrKV(err), kv)
+		return
+	}
+	_, _, err = p.client.Changes.SetReview(gerritssh.ChangeIDWithProjectNumber(c.Project, c.Number), "current", &gerrit.ReviewInput{
+		Message: permalinkCommentPrefix + link,
+		Tag:     permalinkTag,
+		Notify:  "NONE",
+	})
+	if err != nil {
+		llog.Error("error commenting permalink on change", llog.ErrKV(err), kv)
+		return
+	}
+	llog.Debug("commented permalink on change", kv)
+}
+
+// isPermalinkComment returns true if the event is for one of our own permalink
+// comments
+func (p *permalinker) isPermalinkComment(e gerritssh.Event) bool {
+	return e.Type == gerritssh.EventTypeCommentAdded &&
+		e.Author.Username == p.username &&
+		strings.Contains(e.Comment, permalinkCommentPrefix)
+}
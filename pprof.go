@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// pprofServer serves the runtime profiles from net/http/pprof on addr until the
+// context is cancelled. It's separate from the admin api so that it can be
+// bound to a different address.
+func pprofServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+	llog.Info("serving pprof", llog.KV{"addr": addr})
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		llog.Error("error serving pprof", llog.ErrKV(err), llog.KV{"addr": addr})
+	}
+}
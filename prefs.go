@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+// userPrefs are a user's notification preferences, they're on top of whatever
+// their projects post to channels
+type userPrefs struct {
+	// Owned sends direct messages for changes the user owns
+	Owned bool `json:"owned"`
+	// Reviewing sends direct messages for changes the user is a reviewer on
+	Reviewing bool `json:"reviewing"`
+	// MutedProjects are globs, like platform/*, of projects that never send
+	// the user direct messages
+	MutedProjects []string `json:"mutedProjects,omitempty"`
+}
+
+// muted returns true if the user muted the project
+func (p userPrefs) muted(project string) bool {
+	for _, glob := range p.MutedProjects {
+		if ok, _ := path.Match(glob, project); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// prefStore holds every user's preferences keyed by their lowercased email and
+// saves them to a json file
+type prefStore struct {
+	path string
+
+	l     sync.Mutex
+	prefs map[string]userPrefs
+}
+
+// newPrefStore loads the preferences from the file at path, if it exists. An
+// empty path keeps the preferences in memory.
+func newPrefStore(path string) (*prefStore, error) {
+	ps := &prefStore{
+		path:  path,
+		prefs: map[string]userPrefs{},
+	}
+	if path == "" {
+		return ps, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	} else if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	if err := json.Unmarshal(b, &ps.prefs); err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	return ps, nil
+}
+
+// Get returns the user's preferences
+func (ps *prefStore) Get(email string) userPrefs {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	return ps.prefs[strings.ToLower(email)]
+}
+
+// Set replaces the user's preferences and saves them
+func (ps *prefStore) Set(email string, p userPrefs) error {
+	for _, glob := range p.MutedProjects {
+		if _, err := path.Match(glob, ""); err != nil {
+			return llog.ErrWithKV(err, llog.KV{"glob": glob})
+		}
+	}
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	email = strings.ToLower(email)
+	if p.Owned || p.Reviewing || len(p.MutedProjects) > 0 {
+		ps.prefs[email] = p
+	} else {
+		delete(ps.prefs, email)
+	}
+	return ps.save()
+}
+
+// save writes the preferences to the file, the lock must be held
+func (ps *prefStore) save() error {
+	if ps.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(ps.prefs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ps.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": tmp})
+	}
+	if err := os.Rename(tmp, ps.path); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": ps.path})
+	}
+	return nil
+}
+
+// Recipients returns the emails of the users that want a direct message for
+// the event, excluding whoever caused it. The event's reviewers should already
+// be loaded.
+func (ps *prefStore) Recipients(e gerritssh.Event) []string {
+	actor := strings.ToLower(e.Actor().Email)
+	set := map[string]bool{}
+	add := func(email string, want func(userPrefs) bool) {
+		email = strings.ToLower(email)
+		if email == "" || email == actor {
+			return
+		}
+		if p := ps.Get(email); want(p) && !p.muted(e.Change.Project) {
+			set[email] = true
+		}
+	}
+	add(e.Change.Owner.Email, func(p userPrefs) bool { return p.Owned })
+	for _, a := range e.Reviewers[gerritssh.ReviewerStateReviewer] {
+		add(a.Email, func(p userPrefs) bool { return p.Reviewing })
+	}
+	rs := make([]string, 0, len(set))
+	for email := range set {
+		rs = append(rs, email)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+// Empty returns true if no user has any preferences
+func (ps *prefStore) Empty() bool {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	return len(ps.prefs) == 0
+}
@@ -1,8 +1,14 @@
 package project
 
 import (
+	"errors"
 	"fmt"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
 	gerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/go-ini/ini"
@@ -13,6 +19,100 @@ var (
 	projectConfigPath   = "project.config"
 	projectConfigBranch = "refs/meta/config"
 	configPluginName    = "slack-integration"
+
+	// notifySection is the prefix of gerrit's [notify "name"] sections
+	notifySection = "notify"
+
+	// branchSubsectionPrefix is the prefix of the subsections of the plugin's
+	// section, like [plugin "slack-integration" "branch:stable-*"], whose
+	// options override the section's for matching branches
+	branchSubsectionPrefix = "branch:"
+
+	// destinationSection is the prefix of the sections, like
+	// [gerrit-slack-destination "ops"], that declare additional destinations
+	destinationSection = "gerrit-slack-destination"
+
+	// templateSection is the prefix of the sections, like
+	// [gerrit-slack-template "terse"], that declare template sets
+	templateSection = "gerrit-slack-template"
+)
+
+// TimeFormat is the format of time of day options like digest-time
+const TimeFormat = "15:04"
+
+const (
+	// MentionPolicyNever never @ mentions anyone
+	MentionPolicyNever = "never"
+
+	// MentionPolicyOwnerOnly only @ mentions the owner of the change
+	MentionPolicyOwnerOnly = "owner-only"
+
+	// MentionPolicyActionNeeded only @ mentions users that need to act on the
+	// event, like a newly added reviewer
+	MentionPolicyActionNeeded = "action-needed"
+
+	// MentionPolicyAlways @ mentions everyone that can be looked up
+	MentionPolicyAlways = "always"
+)
+
+const (
+	// ShowCommitMessageNone doesn't include the commit message in messages
+	ShowCommitMessageNone = "none"
+
+	// ShowCommitMessageFirstParagraph includes the first paragraph of the
+	// commit message's body
+	ShowCommitMessageFirstParagraph = "first-paragraph"
+
+	// ShowCommitMessageFull includes the commit message's whole body
+	ShowCommitMessageFull = "full"
+)
+
+const (
+	// VerbosityCompact only includes the pretext and title of messages
+	VerbosityCompact = "compact"
+
+	// VerbosityNormal includes the text and fields enabled by the show-*
+	// options
+	VerbosityNormal = "normal"
+
+	// VerbosityVerbose enables all of the show-* options
+	VerbosityVerbose = "verbose"
+
+	// verboseTopFiles is what ShowTopFiles is set to by VerbosityVerbose if it
+	// isn't already set
+	verboseTopFiles = 5
+)
+
+const (
+	// NotifyOwnerDM sends the change's owner a direct message
+	NotifyOwnerDM = "dm"
+
+	// NotifyOwnerThread replies to the change's first message, mentioning the
+	// owner
+	NotifyOwnerThread = "thread"
+)
+
+const (
+	// SinkSlack posts messages to a slack incoming webhook
+	SinkSlack = "slack"
+
+	// SinkDiscord posts messages to a discord webhook as embeds
+	SinkDiscord = "discord"
+
+	// SinkRocketChat posts messages to a rocket.chat incoming webhook
+	SinkRocketChat = "rocketchat"
+
+	// SinkEmail emails messages to the change's owner and reviewers over the
+	// daemon's smtp server instead of posting them to WebhookURL
+	SinkEmail = "email"
+
+	// SinkMatrix sends messages to the matrix room whose id is Channel using
+	// the daemon's matrix account instead of posting them to WebhookURL
+	SinkMatrix = "matrix"
+
+	// SinkSlackAPI posts messages to Channel with slack's web api using the
+	// daemon's slack-token instead of posting them to WebhookURL
+	SinkSlackAPI = "slack-api"
 )
 
 // Config represents a slack-integration plugin configuration
@@ -31,15 +131,29 @@ type Config struct {
 	PublishOnCommentAdded    bool   `ini:"publish-on-comment-added"`
 	PublishOnPatchSetCreated bool   `ini:"publish-on-patch-set-created"`
 	PublishOnReviewerAdded   bool   `ini:"publish-on-reviewer-added"`
+	MentionPolicy            string `ini:"mention-policy"`
+	// Timezone is used for all of the time of day options
+	Timezone string `ini:"timezone"`
+	// DigestTime is the local time, formatted like 15:04, to post a daily digest
+	// of open changes at. The digest is disabled if empty.
+	DigestTime string `ini:"digest-time"`
+	// ReportTime is the local weekday and time, formatted like Mon 15:04, to
+	// post a weekly report of the project's review statistics at. The report is
+	// disabled if empty.
+	ReportTime string `ini:"report-time"`
+	// QuietHours is a range of local times, like 20:00-08:00, when messages are
+	// held and then sent once the range ends
+	QuietHours    string `ini:"quiet-hours"`
+	QuietWeekends bool   `ini:"quiet-weekends"`
 	// PublishPatchSetReviewersAdded controls whether we publish when a reviewer
 	// is added as part of uploading a new patch-set. This is only necessary
 	// because https://bugs.chromium.org/p/gerrit/issues/detail?id=10042
 	PublishPatchSetReviewersAdded bool `ini:"publish-patch-set-reviewers-added"`
 
 	// PublishPatchSetCreatedImmediately changes the patch-set-created event to fire
-	// immediately against slack instead of waiting 5 seconds before publishing to
-	// collect any automatically added reviewers. This is necessary because of the same
-	// bug as above.
+	// immediately against slack instead of waiting 5 seconds for the reviewer-added
+	// events of any automatically added reviewers. This is necessary because of the
+	// same bug as above.
 	PublishPatchSetCreatedImmediately bool `ini:"publish-patch-set-created-immediately"`
 
 	// PublishOnWipReady and PublishOnPrivateToPublic default to the value of
@@ -49,6 +163,482 @@ type Config struct {
 	OrigPublishOnPrivatePublic *bool `ini:"publish-on-private-to-public"`
 	PublishOnWipReady          bool
 	PublishOnPrivateToPublic   bool
+
+	// IgnoreBranches is matched against the full ref of the change's branch,
+	// like refs/heads/master
+	IgnoreBranches string `ini:"ignore-branches"`
+	// IgnorePaths is a comma separated list of globs, like *.lock or vendor/**,
+	// and changes that only touch matching files are ignored
+	IgnorePaths string `ini:"ignore-paths"`
+	// IgnoreMinSize and IgnoreMaxSize ignore patch sets whose size, the number
+	// of inserted and deleted lines, is below or above them. Zero disables them.
+	IgnoreMinSize int64 `ini:"ignore-min-size"`
+	IgnoreMaxSize int64 `ini:"ignore-max-size"`
+	// IgnoreOwnerComments ignores comments by the change's owner that didn't
+	// change any votes
+	IgnoreOwnerComments bool `ini:"ignore-owner-comments"`
+	// IgnoreCCAdded ignores reviewer-added events for accounts that were only
+	// CC'd on the change
+	IgnoreCCAdded bool `ini:"ignore-cc-added"`
+	// IgnoreHashtags is matched against each of the change's hashtags
+	IgnoreHashtags string `ini:"ignore-hashtags"`
+	// PublishOnlyOnLabels limits the votes that are published to the listed
+	// values, like Code-Review=+2|-2, Verified=-1
+	PublishOnlyOnLabels string `ini:"publish-only-on-labels"`
+	// PublishOnlyNegativeVotes limits the votes that are published to negative
+	// ones, like Code-Review-1 or Verified-1
+	PublishOnlyNegativeVotes bool `ini:"publish-only-negative-votes"`
+	// Filter is a search query, like branch:master, that changes must match for
+	// their events to be published
+	Filter string `ini:"filter"`
+	// WebhookURLSecret is the name of a secret in the daemon's secret store that
+	// is used as the webhook url instead of WebhookURL
+	WebhookURLSecret string `ini:"webhookurl-secret"`
+	// ChannelOnChangeMerged, ChannelOnCommentAdded, ChannelOnPatchSetCreated
+	// and ChannelOnReviewerAdded override Channel for their event types
+	ChannelOnChangeMerged    string `ini:"channel-on-change-merged"`
+	ChannelOnCommentAdded    string `ini:"channel-on-comment-added"`
+	ChannelOnPatchSetCreated string `ini:"channel-on-patch-set-created"`
+	ChannelOnReviewerAdded   string `ini:"channel-on-reviewer-added"`
+	// Destinations are where messages are delivered in addition to WebhookURL
+	Destinations []Destination `ini:"-"`
+	// Template is the name of the template set in Templates that messages are
+	// rendered with, messages are left as they are if it's empty
+	Template  string                 `ini:"template"`
+	Templates map[string]TemplateSet `ini:"-"`
+	// branches are the branch subsections in the order they were declared
+	branches []branchConfig
+	// project is the name of the project the config was loaded for
+	project string
+	// sources maps each option that was set to where it was set
+	sources map[string]string
+	// Sink is the kind of webhook that WebhookURL is, or SinkEmail,
+	// SinkMatrix or SinkSlackAPI
+	Sink string `ini:"sink"`
+	// Verbosity is a preset for the show-* options and how much of each message
+	// is included
+	Verbosity string `ini:"verbosity"`
+	// ShowTopic and ShowHashtags add Topic and Hashtags fields to messages for
+	// changes that have them
+	ShowTopic    bool `ini:"show-topic"`
+	ShowHashtags bool `ini:"show-hashtags"`
+	// MaxTextLength is the most characters of a comment or commit message that
+	// are included in a message before it's truncated. Zero disables it.
+	MaxTextLength int `ini:"max-text-length"`
+	// ShowCommitMessage controls how much of the commit message's body, if any,
+	// is included in patchset-created and change-merged messages
+	ShowCommitMessage string `ini:"show-commit-message"`
+	// ShowCIStatus adds a CI field to messages with the status of CILabel
+	ShowCIStatus bool   `ini:"show-ci-status"`
+	CILabel      string `ini:"ci-label"`
+	// ShowVoteSummary adds a Votes field to messages summarizing the current
+	// votes on each label
+	ShowVoteSummary bool `ini:"show-vote-summary"`
+	// ShowSubmitRequirements adds a field to comment-added and change-merged
+	// messages with the status of the change's submit requirements
+	ShowSubmitRequirements bool `ini:"show-submit-requirements"`
+	// ShowChangeAge adds a field to comment-added and change-merged messages
+	// with how long the change has been in review
+	ShowChangeAge bool `ini:"show-change-age"`
+	// ShowTopFiles adds a field to patchset-created messages listing that many
+	// files with the most lines changed. Zero disables it.
+	ShowTopFiles int `ini:"show-top-files"`
+	// ShowRelationChain adds a field to patchset-created messages listing the
+	// changes that the change depends on or that depend on it
+	ShowRelationChain bool `ini:"show-relation-chain"`
+	// ThreadUpdates posts patchset-created messages for later patch sets as
+	// replies to the change's first message, if it was recorded, and
+	// ThreadBroadcast also sends those replies to the channel
+	ThreadUpdates   bool `ini:"thread-updates"`
+	ThreadBroadcast bool `ini:"thread-broadcast"`
+	// Debounce combines the messages for a change that are sent within that long
+	// of its first one into a single message. Zero disables it.
+	Debounce time.Duration `ini:"debounce"`
+	// CIAccounts is a comma separated list of the usernames of CI accounts
+	CIAccounts string `ini:"ci-accounts"`
+	// NotifyOwnerOnCIFailure notifies the change's owner, as NotifyOwnerDM or
+	// NotifyOwnerThread, when one of CIAccounts votes -1 or lower on CILabel
+	NotifyOwnerOnCIFailure string `ini:"notify-owner-on-ci-failure"`
+	// NotifyOwnerOnMergeConflict notifies the change's owner, as NotifyOwnerDM
+	// or NotifyOwnerThread, when the change can no longer be merged because its
+	// branch was updated
+	NotifyOwnerOnMergeConflict string `ini:"notify-owner-on-merge-conflict"`
+	// NotifyOwnerOnSubmittable notifies the change's owner, as NotifyOwnerDM or
+	// NotifyOwnerThread, when a vote makes the change submittable
+	NotifyOwnerOnSubmittable string `ini:"notify-owner-on-submittable"`
+	// EscalateReviewersAfter mentions a change's reviewers again once it has
+	// gone that long without any reviews. Zero disables it.
+	EscalateReviewersAfter time.Duration `ini:"escalate-reviewers-after"`
+	// EscalateUsergroupAfter mentions EscalateUsergroup, the ID of a slack
+	// usergroup, once a change has gone that long without any reviews. Zero
+	// disables it.
+	EscalateUsergroupAfter time.Duration `ini:"escalate-usergroup-after"`
+	EscalateUsergroup      string        `ini:"escalate-usergroup"`
+	// ReleaseTags is a regex of the tags that are announced as releases, with
+	// the changes merged since the previous matching tag. ReleaseChannel is
+	// where they're announced, instead of Channel, if it's set.
+	ReleaseTags    string `ini:"release-tags"`
+	ReleaseChannel string `ini:"release-channel"`
+	// PostPermalink comments on the change with a link to its first message
+	// once it's posted
+	PostPermalink bool `ini:"post-permalink"`
+	// ReactionVotes maps slack emoji to the vote that reacting with them to a
+	// change's first message casts, like +1=Code-Review+1
+	ReactionVotes string `ini:"reaction-votes"`
+
+	// destination is the name of the destination the config is for, it's
+	// empty for the project's own config
+	destination string
+
+	location    *time.Location
+	quietStart  int
+	quietEnd    int
+	labelValues map[string][]int
+	// reactionVotes is ReactionVotes parsed
+	reactionVotes map[string]ReactionVote
+}
+
+// ReactionVote is the vote cast by reacting with an emoji
+type ReactionVote struct {
+	Label string
+	Value int
+}
+
+// branchConfig is a branch subsection of the plugin's section
+type branchConfig struct {
+	glob    string
+	section *ini.Section
+}
+
+// ConfigError is returned by LoadConfig and ForBranch when a project's config
+// can't be parsed or is invalid
+type ConfigError struct {
+	Project string
+	// Section is the section the error is in if it's not the plugin's section
+	Section string
+	// Option and Value are the invalid option and its value, if known
+	Option string
+	Value  string
+	Err    error
+}
+
+// Error implements the error interface
+func (e ConfigError) Error() string {
+	where := e.Project
+	if e.Section != "" {
+		where += " in " + e.Section
+	}
+	if e.Option == "" {
+		return fmt.Sprintf("invalid config for project %s: %s", where, e.Err)
+	}
+	return fmt.Sprintf("invalid %s %q for project %s: %s", e.Option, e.Value, where, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// invalidOption returns a ConfigError for the option's value, the project is
+// filled in by configError
+func invalidOption(option, value string, err error) error {
+	if err == nil {
+		err = errors.New("invalid value")
+	}
+	return ConfigError{Option: option, Value: value, Err: err}
+}
+
+// withSection returns err as a ConfigError in the section
+func withSection(err error, section string) error {
+	var cerr ConfigError
+	if !errors.As(err, &cerr) {
+		cerr = ConfigError{Err: err}
+	}
+	cerr.Section = section
+	return cerr
+}
+
+// configError returns err as a ConfigError for the project
+func configError(project string, err error) error {
+	var cerr ConfigError
+	if !errors.As(err, &cerr) {
+		cerr = ConfigError{Err: err}
+	}
+	cerr.Project = project
+	return cerr
+}
+
+// Destination is an additional place that a project's messages are delivered
+// to. Unset options are inherited from the project's config.
+type Destination struct {
+	Name       string `ini:"-"`
+	Enabled    *bool  `ini:"enabled"`
+	Sink       string `ini:"sink"`
+	WebhookURL string `ini:"webhookurl"`
+	// WebhookURLSecret replaces the project's WebhookURL and WebhookURLSecret
+	WebhookURLSecret string `ini:"webhookurl-secret"`
+	Channel          string `ini:"channel"`
+	Username         string `ini:"username"`
+	Filter           string `ini:"filter"`
+
+	PublishOnChangeMerged    *bool `ini:"publish-on-change-merged"`
+	PublishOnCommentAdded    *bool `ini:"publish-on-comment-added"`
+	PublishOnPatchSetCreated *bool `ini:"publish-on-patch-set-created"`
+	PublishOnReviewerAdded   *bool `ini:"publish-on-reviewer-added"`
+
+	Verbosity         string `ini:"verbosity"`
+	ShowCommitMessage string `ini:"show-commit-message"`
+	MaxTextLength     *int   `ini:"max-text-length"`
+	Template          string `ini:"template"`
+}
+
+// TemplateSet is a set of text/templates that replace the pretext, title and
+// text of messages. Each is executed with the message's Event and the Message
+// as it would otherwise be sent, and the parts without a template are left as
+// they are.
+type TemplateSet struct {
+	Name    string `ini:"-"`
+	Pretext string `ini:"pretext"`
+	Title   string `ini:"title"`
+	Text    string `ini:"text"`
+}
+
+// Parse returns the set's templates as a single template with an associated
+// template, named pretext, title or text, for each part that has one
+func (ts TemplateSet) Parse() (*template.Template, error) {
+	t := template.New(ts.Name)
+	for _, part := range []struct{ name, text string }{
+		{"pretext", ts.Pretext},
+		{"title", ts.Title},
+		{"text", ts.Text},
+	} {
+		if part.text == "" {
+			continue
+		}
+		if _, err := t.New(part.name).Parse(part.text); err != nil {
+			return nil, invalidOption(part.name, part.text, err)
+		}
+	}
+	return t, nil
+}
+
+// TemplateSet returns the template set that the config's messages are
+// rendered with and false if there isn't one
+func (c Config) TemplateSet() (TemplateSet, bool) {
+	if c.Template == "" {
+		return TemplateSet{}, false
+	}
+	ts, ok := c.Templates[c.Template]
+	return ts, ok
+}
+
+// section returns the name of the section the destination was declared in
+func (d Destination) section() string {
+	if strings.HasPrefix(d.Name, notifySection+" ") {
+		return d.Name
+	}
+	return fmt.Sprintf(`%s "%s"`, destinationSection, d.Name)
+}
+
+// apply returns the project's config with the destination's options applied
+func (d Destination) apply(c Config) Config {
+	setBool := func(dst *bool, src *bool) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setString := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	c.Destinations = nil
+	c.destination = d.Name
+	setBool(&c.Enabled, d.Enabled)
+	setString(&c.Sink, d.Sink)
+	if d.WebhookURL != "" || d.WebhookURLSecret != "" {
+		c.WebhookURL = d.WebhookURL
+		c.WebhookURLSecret = d.WebhookURLSecret
+	}
+	if d.Channel != "" {
+		// the project's per-event channels are for the project's channel
+		c.Channel = d.Channel
+		c.ChannelOnChangeMerged = ""
+		c.ChannelOnCommentAdded = ""
+		c.ChannelOnPatchSetCreated = ""
+		c.ChannelOnReviewerAdded = ""
+	}
+	setString(&c.Username, d.Username)
+	setString(&c.Filter, d.Filter)
+	setBool(&c.PublishOnChangeMerged, d.PublishOnChangeMerged)
+	setBool(&c.PublishOnCommentAdded, d.PublishOnCommentAdded)
+	setBool(&c.PublishOnPatchSetCreated, d.PublishOnPatchSetCreated)
+	// wip-ready and private-to-public default to publish-on-patch-set-created
+	if d.PublishOnPatchSetCreated != nil {
+		if c.OrigPublishOnWipReady == nil {
+			c.PublishOnWipReady = *d.PublishOnPatchSetCreated
+		}
+		if c.OrigPublishOnPrivatePublic == nil {
+			c.PublishOnPrivateToPublic = *d.PublishOnPatchSetCreated
+		}
+	}
+	setBool(&c.PublishOnReviewerAdded, d.PublishOnReviewerAdded)
+	if d.Verbosity != "" {
+		c.Verbosity = d.Verbosity
+		applyVerbosity(&c)
+	}
+	setString(&c.ShowCommitMessage, d.ShowCommitMessage)
+	if d.MaxTextLength != nil {
+		c.MaxTextLength = *d.MaxTextLength
+	}
+	setString(&c.Template, d.Template)
+	return c
+}
+
+// applyVerbosity sets the show-* options according to the config's verbosity
+func applyVerbosity(c *Config) {
+	var show bool
+	switch c.Verbosity {
+	case VerbosityCompact:
+		c.ShowCommitMessage = ShowCommitMessageNone
+		c.ShowTopFiles = 0
+	case VerbosityVerbose:
+		show = true
+		if c.ShowCommitMessage == ShowCommitMessageNone {
+			c.ShowCommitMessage = ShowCommitMessageFull
+		}
+		if c.ShowTopFiles == 0 {
+			c.ShowTopFiles = verboseTopFiles
+		}
+	default:
+		return
+	}
+	c.ShowTopic = show
+	c.ShowHashtags = show
+	c.ShowCIStatus = show
+	c.ShowVoteSummary = show
+	c.ShowSubmitRequirements = show
+	c.ShowChangeAge = show
+	c.ShowRelationChain = show
+}
+
+// DestinationName returns the name of the destination the config is for or an
+// empty string if it's the project's own config
+func (c Config) DestinationName() string {
+	return c.destination
+}
+
+// DestinationConfigs returns the project's config followed by a config for
+// each of its destinations with the destination's options applied
+func (c Config) DestinationConfigs() []Config {
+	cfgs := []Config{c}
+	for _, d := range c.Destinations {
+		cfgs = append(cfgs, d.apply(c))
+	}
+	return cfgs
+}
+
+// notifyTypes maps the types in gerrit's notify sections to the events that
+// are published for them. new_changes can't be distinguished from
+// new_patchsets so both publish patchset-created.
+var notifyTypes = map[string][]string{
+	"new_changes":       {"patchset-created"},
+	"new_patchsets":     {"patchset-created"},
+	"all_comments":      {"comment-added"},
+	"submitted_changes": {"change-merged"},
+	"all": {
+		"patchset-created",
+		"comment-added",
+		"change-merged",
+		"reviewer-added",
+	},
+}
+
+// notifyDestination returns the destination for one of gerrit's notify
+// sections and false if it doesn't have a slack-channel
+func notifyDestination(name string, sec *ini.Section) (Destination, bool) {
+	channel := sec.Key("slack-channel").String()
+	if channel == "" {
+		return Destination{}, false
+	}
+	publish := map[string]bool{}
+	types := sec.Key("type").ValueWithShadows()
+	// gerrit notifies for all types if none are listed
+	if len(types) == 0 || (len(types) == 1 && types[0] == "") {
+		types = []string{"all"}
+	}
+	for _, t := range types {
+		for _, ev := range notifyTypes[strings.TrimSpace(t)] {
+			publish[ev] = true
+		}
+	}
+	ptr := func(b bool) *bool { return &b }
+	return Destination{
+		Name:                     "notify " + name,
+		Enabled:                  ptr(true),
+		Channel:                  channel,
+		Filter:                   sec.Key("filter").String(),
+		PublishOnPatchSetCreated: ptr(publish["patchset-created"]),
+		PublishOnCommentAdded:    ptr(publish["comment-added"]),
+		PublishOnChangeMerged:    ptr(publish["change-merged"]),
+		PublishOnReviewerAdded:   ptr(publish["reviewer-added"]),
+	}, true
+}
+
+// loadDestinations adds the destinations declared in the ini file, including
+// gerrit's notify sections that have a slack-channel, to the config, replacing
+// any inherited destinations with the same name
+func loadDestinations(cfg *Config, f *ini.File) error {
+	for _, sec := range f.Sections() {
+		var d Destination
+		if name := strings.TrimPrefix(sec.Name(), notifySection+" "); name != sec.Name() {
+			var ok bool
+			if d, ok = notifyDestination(strings.Trim(name, `"`), sec); !ok {
+				continue
+			}
+		} else if name := strings.TrimPrefix(sec.Name(), destinationSection+" "); name != sec.Name() {
+			d = Destination{Name: strings.Trim(name, `"`)}
+			if err := sec.MapTo(&d); err != nil {
+				return ConfigError{Section: sec.Name(), Err: err}
+			}
+		} else {
+			continue
+		}
+		var replaced bool
+		for i := range cfg.Destinations {
+			if cfg.Destinations[i].Name == d.Name {
+				cfg.Destinations[i] = d
+				replaced = true
+			}
+		}
+		if !replaced {
+			cfg.Destinations = append(cfg.Destinations, d)
+		}
+	}
+	return nil
+}
+
+// loadTemplates adds the template sets declared in the ini file to the config,
+// replacing any inherited sets with the same name
+func loadTemplates(cfg *Config, f *ini.File) error {
+	for _, sec := range f.Sections() {
+		name := strings.TrimPrefix(sec.Name(), templateSection+" ")
+		if name == sec.Name() {
+			continue
+		}
+		ts := TemplateSet{Name: strings.Trim(name, `"`)}
+		if err := sec.MapTo(&ts); err != nil {
+			return ConfigError{Section: sec.Name(), Err: err}
+		}
+		if _, err := ts.Parse(); err != nil {
+			return withSection(err, sec.Name())
+		}
+		if cfg.Templates == nil {
+			cfg.Templates = map[string]TemplateSet{}
+		}
+		cfg.Templates[ts.Name] = ts
+	}
+	return nil
 }
 
 // DefaultConfig returns a config struct with defaults set
@@ -59,6 +649,13 @@ func DefaultConfig() Config {
 		IgnoreUnchangedPatchSet: true,
 		IgnoreWipPatchSet:       true,
 		IgnorePrivatePatchSet:   true,
+		Sink:                    SinkSlack,
+		MentionPolicy:           MentionPolicyAlways,
+		CILabel:                 "Verified",
+		ShowCommitMessage:       ShowCommitMessageNone,
+		MaxTextLength:           3000,
+		Verbosity:               VerbosityNormal,
+		Timezone:                "UTC",
 	}
 }
 
@@ -69,9 +666,26 @@ func encodeBranch(branch string) string {
 // LoadConfig loads the config for the sent project
 func LoadConfig(client *gerrit.Client, project string) (Config, error) {
 	cfg := DefaultConfig()
+	section := fmt.Sprintf(`plugin "%s"`, configPluginName)
 	projects := []string{project}
-	// first get a list of all of the parents
+	var files []*ini.File
+	// first get the config of the project and all of its parents
 	for {
+		contents, _, err := client.Projects.GetBranchContent(
+			project,
+			encodeBranch(projectConfigBranch),
+			projectConfigPath,
+		)
+		if err != nil {
+			return cfg, llog.ErrWithKV(err, llog.KV{"project": project})
+		}
+		// notify sections can list multiple types
+		c, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true}, []byte(contents))
+		if err != nil {
+			return cfg, configError(project, err)
+		}
+		files = append(files, c)
+
 		parent, _, err := client.Projects.GetProjectParent(project)
 		if err != nil {
 			return cfg, err
@@ -82,35 +696,466 @@ func LoadConfig(client *gerrit.Client, project string) (Config, error) {
 		projects = append(projects, parent)
 		project = parent
 	}
+	// the parents of the first project with inherit = false are only used for
+	// their final options
+	inherited := len(files)
+	for i, c := range files {
+		if !c.Section(section).Key("inherit").MustBool(true) {
+			inherited = i + 1
+			break
+		}
+	}
 	// now loop through that list backwards and build config
-	for i := len(projects) - 1; i >= 0; i-- {
-		contents, _, err := client.Projects.GetBranchContent(
-			projects[i],
-			encodeBranch(projectConfigBranch),
-			projectConfigPath,
-		)
-		if err != nil {
-			return cfg, llog.ErrWithKV(err, llog.KV{"project": projects[i]})
+	final := map[string]bool{}
+	for i := len(files) - 1; i >= 0; i-- {
+		sec := files[i].Section(section)
+		isFinal := sec.Key("final").MustBool(false)
+		if i >= inherited && !isFinal {
+			continue
 		}
-		c, err := ini.Load([]byte(contents))
-		if err != nil {
-			return cfg, llog.ErrWithKV(err, llog.KV{"project": projects[i]})
+		for _, k := range sec.KeyStrings() {
+			if final[k] {
+				llog.Warn("ignoring option that's final in a parent project", llog.KV{
+					"project": projects[i],
+					"option":  k,
+				})
+				sec.DeleteKey(k)
+			}
 		}
-		if err = c.Section(fmt.Sprintf(`plugin "%s"`, configPluginName)).MapTo(&cfg); err != nil {
-			return cfg, err
+		if err := sec.MapTo(&cfg); err != nil {
+			return cfg, configError(projects[i], err)
+		}
+		cfg.setSources(sec, projects[i])
+		if isFinal {
+			for _, k := range sec.KeyStrings() {
+				if k != "final" && k != "inherit" {
+					final[k] = true
+				}
+			}
+		}
+		if i >= inherited {
+			continue
+		}
+		if err := loadDestinations(&cfg, files[i]); err != nil {
+			return cfg, configError(projects[i], err)
+		}
+		if err := loadTemplates(&cfg, files[i]); err != nil {
+			return cfg, configError(projects[i], err)
+		}
+		if err := loadBranches(&cfg, files[i], final); err != nil {
+			return cfg, configError(projects[i], err)
 		}
 	}
 
+	cfg.finish()
+	cfg.project = projects[0]
+	if err := cfg.validate(); err != nil {
+		return cfg, configError(projects[0], err)
+	}
+	for _, d := range cfg.Destinations {
+		dcfg := d.apply(cfg)
+		if err := dcfg.validate(); err != nil {
+			return cfg, configError(projects[0], withSection(err, d.section()))
+		}
+	}
+	return cfg, nil
+}
+
+// secretNameRegexp matches valid secret names, they can't contain slashes or
+// start with a dot so they can't escape the secret store's directory or path
+var secretNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// finish fills in the options that default to, or are preset by, other options
+func (c *Config) finish() {
 	// now correct the wip-ready and public-to-private
-	if cfg.OrigPublishOnWipReady == nil {
-		cfg.PublishOnWipReady = cfg.PublishOnPatchSetCreated
+	if c.OrigPublishOnWipReady == nil {
+		c.PublishOnWipReady = c.PublishOnPatchSetCreated
 	} else {
-		cfg.PublishOnWipReady = *cfg.OrigPublishOnWipReady
+		c.PublishOnWipReady = *c.OrigPublishOnWipReady
 	}
-	if cfg.OrigPublishOnPrivatePublic == nil {
-		cfg.PublishOnPrivateToPublic = cfg.PublishOnPatchSetCreated
+	if c.OrigPublishOnPrivatePublic == nil {
+		c.PublishOnPrivateToPublic = c.PublishOnPatchSetCreated
 	} else {
-		cfg.PublishOnPrivateToPublic = *cfg.OrigPublishOnPrivatePublic
+		c.PublishOnPrivateToPublic = *c.OrigPublishOnPrivatePublic
 	}
-	return cfg, nil
+	applyVerbosity(c)
+}
+
+// loadBranches adds the branch subsections declared in the ini file to the
+// config without the options that are final
+func loadBranches(cfg *Config, f *ini.File, final map[string]bool) error {
+	prefix := fmt.Sprintf(`plugin "%s" "%s`, configPluginName, branchSubsectionPrefix)
+	for _, sec := range f.Sections() {
+		glob := strings.TrimPrefix(sec.Name(), prefix)
+		if glob == sec.Name() {
+			continue
+		}
+		glob = strings.TrimSuffix(glob, `"`)
+		if _, err := path.Match(glob, ""); err != nil {
+			return ConfigError{Section: sec.Name(), Err: err}
+		}
+		for _, k := range sec.KeyStrings() {
+			if final[k] {
+				sec.DeleteKey(k)
+			}
+		}
+		cfg.branches = append(cfg.branches, branchConfig{
+			glob:    glob,
+			section: sec,
+		})
+	}
+	return nil
+}
+
+// setSources records that the section's options were set by source
+func (c *Config) setSources(sec *ini.Section, source string) {
+	// the map might be shared with a config this was copied from
+	sources := make(map[string]string, len(c.sources))
+	for k, v := range c.sources {
+		sources[k] = v
+	}
+	for _, k := range sec.KeyStrings() {
+		sources[k] = source
+	}
+	c.sources = sources
+}
+
+// Source returns where the option, like channel, was set, which is usually the
+// name of the project whose project.config set it, or an empty string if it
+// wasn't set
+func (c Config) Source(option string) string {
+	return c.sources[option]
+}
+
+// ForBranch returns the config with the options of the branch subsections whose
+// glob matches the branch, like master, applied in the order they were declared
+func (c Config) ForBranch(branch string) (Config, error) {
+	var matched bool
+	for _, b := range c.branches {
+		if ok, _ := path.Match(b.glob, branch); !ok {
+			continue
+		}
+		// the pointers are shared with the original config so copy them
+		// before they might be overwritten
+		for _, p := range []**bool{&c.OrigPublishOnWipReady, &c.OrigPublishOnPrivatePublic} {
+			if *p != nil {
+				v := **p
+				*p = &v
+			}
+		}
+		if err := b.section.MapTo(&c); err != nil {
+			return c, configError(c.project, withSection(err, b.section.Name()))
+		}
+		c.setSources(b.section, c.project+" "+branchSubsectionPrefix+b.glob)
+		matched = true
+	}
+	if !matched {
+		return c, nil
+	}
+	c.finish()
+	if err := c.validate(); err != nil {
+		// any of the matching subsections could be responsible
+		return c, configError(c.project, withSection(err, fmt.Sprintf("branch %s", branch)))
+	}
+	return c, nil
+}
+
+// parseTimeRange parses a range like 20:00-08:00 into the minutes since
+// midnight of the start and end
+func parseTimeRange(r string) (int, int, error) {
+	parts := strings.SplitN(r, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, llog.ErrWithKV(errors.New("invalid time range"), llog.KV{"range": r})
+	}
+	start, err := time.Parse(TimeFormat, strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := time.Parse(TimeFormat, strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+// ParseWeekdayTime parses a weekday and time of day like Mon 09:00
+func ParseWeekdayTime(s string) (time.Weekday, time.Time, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 2 {
+		return 0, time.Time{}, llog.ErrWithKV(errors.New("invalid weekday and time"), llog.KV{"weekdayTime": s})
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if !strings.EqualFold(parts[0], d.String()[:3]) && !strings.EqualFold(parts[0], d.String()) {
+			continue
+		}
+		t, err := time.Parse(TimeFormat, parts[1])
+		return d, t, err
+	}
+	return 0, time.Time{}, llog.ErrWithKV(errors.New("invalid weekday"), llog.KV{"weekday": parts[0]})
+}
+
+// parseReactionVotes parses a list of emoji and votes like +1=Code-Review+1,
+// white_check_mark=Code-Review+2 into a map of the emoji to its vote
+func parseReactionVotes(s string) (map[string]ReactionVote, error) {
+	rvs := map[string]ReactionVote{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		// emoji like +1 start with a sign so split on the last =
+		i := strings.LastIndex(part, "=")
+		var j int
+		if i > 0 {
+			j = strings.LastIndexAny(part[i+1:], "+-") + i + 1
+		}
+		if i <= 0 || j <= i+1 {
+			return nil, llog.ErrWithKV(errors.New("invalid reaction vote"), llog.KV{"reactionVote": part})
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(part[j:], "+"))
+		if err != nil {
+			return nil, llog.ErrWithKV(err, llog.KV{"reactionVote": part})
+		}
+		emoji := strings.Trim(strings.TrimSpace(part[:i]), ":")
+		rvs[emoji] = ReactionVote{Label: strings.TrimSpace(part[i+1 : j]), Value: v}
+	}
+	return rvs, nil
+}
+
+// parseLabelValues parses a list of label values like Code-Review=+2|-2,
+// Verified=-1 into a map of the label to its values
+func parseLabelValues(s string) (map[string][]int, error) {
+	lvs := map[string][]int{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, llog.ErrWithKV(errors.New("invalid label values"), llog.KV{"labelValues": part})
+		}
+		label := strings.TrimSpace(kv[0])
+		for _, v := range strings.Split(kv[1], "|") {
+			i, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(v), "+"))
+			if err != nil {
+				return nil, llog.ErrWithKV(err, llog.KV{"labelValues": part})
+			}
+			lvs[label] = append(lvs[label], i)
+		}
+	}
+	return lvs, nil
+}
+
+// ReactionVote returns the vote cast by reacting with the emoji, if any
+func (c Config) ReactionVote(emoji string) (ReactionVote, bool) {
+	rv, ok := c.reactionVotes[emoji]
+	return rv, ok
+}
+
+// Escalates returns true if unreviewed changes are escalated
+func (c Config) Escalates() bool {
+	return c.EscalateReviewersAfter > 0 || c.EscalateUsergroupAfter > 0
+}
+
+// IsCIAccount returns true if the username is one of the CIAccounts
+func (c Config) IsCIAccount(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, a := range strings.Split(c.CIAccounts, ",") {
+		if strings.TrimSpace(a) == username {
+			return true
+		}
+	}
+	return false
+}
+
+// PublishVote returns true if a vote of value on label should be published
+// according to PublishOnlyNegativeVotes and PublishOnlyOnLabels. All votes are
+// published if neither is set.
+func (c Config) PublishVote(label, value string) bool {
+	if c.PublishOnlyOnLabels == "" && !c.PublishOnlyNegativeVotes {
+		return true
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(value, "+"))
+	if err != nil {
+		return false
+	}
+	if c.PublishOnlyNegativeVotes && i >= 0 {
+		return false
+	}
+	if c.PublishOnlyOnLabels == "" {
+		return true
+	}
+	for _, v := range c.labelValues[label] {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// ChannelFor returns the channel that messages for the event type, like
+// change-merged, are posted to
+func (c Config) ChannelFor(eventType string) string {
+	var channel string
+	switch eventType {
+	case "change-merged":
+		channel = c.ChannelOnChangeMerged
+	case "comment-added":
+		channel = c.ChannelOnCommentAdded
+	// wip-ready and private-to-public are published like a new patch set
+	case "patchset-created", "wip-state-changed", "private-state-changed":
+		channel = c.ChannelOnPatchSetCreated
+	case "reviewer-added":
+		channel = c.ChannelOnReviewerAdded
+	}
+	if channel == "" {
+		return c.Channel
+	}
+	return channel
+}
+
+// Location returns the location for the project's timezone
+func (c Config) Location() *time.Location {
+	if c.location == nil {
+		return time.UTC
+	}
+	return c.location
+}
+
+// Quiet returns true if messages shouldn't be sent at the given time
+func (c Config) Quiet(t time.Time) bool {
+	t = t.In(c.Location())
+	if c.QuietWeekends && (t.Weekday() == time.Saturday || t.Weekday() == time.Sunday) {
+		return true
+	}
+	if c.QuietHours == "" || c.quietStart == c.quietEnd {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	// the range might wrap around midnight
+	if c.quietStart < c.quietEnd {
+		return now >= c.quietStart && now < c.quietEnd
+	}
+	return now >= c.quietStart || now < c.quietEnd
+}
+
+// validate checks the config's options and parses any that need to be parsed
+func (c *Config) validate() error {
+	switch c.Sink {
+	case SinkSlack, SinkDiscord, SinkRocketChat, SinkEmail:
+	case SinkSlackAPI:
+		if c.Channel == "" {
+			return invalidOption("channel", c.Channel, errors.New("required by the slack-api sink"))
+		}
+	case SinkMatrix:
+		// messages can only be sent to room ids, not aliases
+		for option, ch := range map[string]string{
+			"channel":                      c.Channel,
+			"channel-on-change-merged":     c.ChannelOnChangeMerged,
+			"channel-on-comment-added":     c.ChannelOnCommentAdded,
+			"channel-on-patch-set-created": c.ChannelOnPatchSetCreated,
+			"channel-on-reviewer-added":    c.ChannelOnReviewerAdded,
+		} {
+			if ch != "" && !strings.HasPrefix(ch, "!") {
+				return invalidOption(option, ch, errors.New("must be a matrix room id"))
+			}
+		}
+	default:
+		return invalidOption("sink", c.Sink, nil)
+	}
+	switch c.MentionPolicy {
+	case MentionPolicyNever, MentionPolicyOwnerOnly, MentionPolicyActionNeeded, MentionPolicyAlways:
+	default:
+		// mentioning too many people is better than a project going silent
+		llog.Warn("unknown mention-policy, using the default", llog.KV{
+			"project":       c.project,
+			"mentionPolicy": c.MentionPolicy,
+			"default":       MentionPolicyAlways,
+		})
+		c.MentionPolicy = MentionPolicyAlways
+	}
+	if c.WebhookURLSecret != "" && !secretNameRegexp.MatchString(c.WebhookURLSecret) {
+		return invalidOption("webhookurl-secret", c.WebhookURLSecret, nil)
+	}
+	switch c.Verbosity {
+	case VerbosityCompact, VerbosityNormal, VerbosityVerbose:
+	default:
+		return invalidOption("verbosity", c.Verbosity, nil)
+	}
+	switch c.ShowCommitMessage {
+	case ShowCommitMessageNone, ShowCommitMessageFirstParagraph, ShowCommitMessageFull:
+	default:
+		return invalidOption("show-commit-message", c.ShowCommitMessage, nil)
+	}
+	if _, ok := c.TemplateSet(); c.Template != "" && !ok {
+		return invalidOption("template", c.Template, errors.New("no such template set"))
+	}
+	var err error
+	if c.location, err = time.LoadLocation(c.Timezone); err != nil {
+		return invalidOption("timezone", c.Timezone, err)
+	}
+	if c.Debounce < 0 {
+		return invalidOption("debounce", c.Debounce.String(), nil)
+	}
+	if c.EscalateReviewersAfter < 0 {
+		return invalidOption("escalate-reviewers-after", c.EscalateReviewersAfter.String(), nil)
+	}
+	if c.EscalateUsergroupAfter < 0 {
+		return invalidOption("escalate-usergroup-after", c.EscalateUsergroupAfter.String(), nil)
+	} else if c.EscalateUsergroupAfter > 0 && c.EscalateUsergroup == "" {
+		return invalidOption("escalate-usergroup", c.EscalateUsergroup, errors.New("required by escalate-usergroup-after"))
+	}
+	if c.DigestTime != "" {
+		if _, err := time.Parse(TimeFormat, c.DigestTime); err != nil {
+			return invalidOption("digest-time", c.DigestTime, err)
+		}
+	}
+	if c.ReportTime != "" {
+		if _, _, err := ParseWeekdayTime(c.ReportTime); err != nil {
+			return invalidOption("report-time", c.ReportTime, err)
+		}
+	}
+	if c.QuietHours != "" {
+		if c.quietStart, c.quietEnd, err = parseTimeRange(c.QuietHours); err != nil {
+			return invalidOption("quiet-hours", c.QuietHours, err)
+		}
+	}
+	if c.ReactionVotes != "" {
+		if c.reactionVotes, err = parseReactionVotes(c.ReactionVotes); err != nil {
+			return invalidOption("reaction-votes", c.ReactionVotes, err)
+		}
+	}
+	if c.PublishOnlyOnLabels != "" {
+		if c.labelValues, err = parseLabelValues(c.PublishOnlyOnLabels); err != nil {
+			return invalidOption("publish-only-on-labels", c.PublishOnlyOnLabels, err)
+		}
+	}
+	for _, o := range []struct{ option, value string }{
+		{"notify-owner-on-ci-failure", c.NotifyOwnerOnCIFailure},
+		{"notify-owner-on-merge-conflict", c.NotifyOwnerOnMergeConflict},
+		{"notify-owner-on-submittable", c.NotifyOwnerOnSubmittable},
+	} {
+		switch o.value {
+		case "", NotifyOwnerDM, NotifyOwnerThread:
+		default:
+			return invalidOption(o.option, o.value, nil)
+		}
+	}
+	for _, o := range []struct{ option, pattern string }{
+		{"ignore", c.IgnoreCommitMessage},
+		{"ignore-authors", c.IgnoreAuthors},
+		{"ignore-only-labels", c.IgnoreOnlyLabels},
+		{"ignore-branches", c.IgnoreBranches},
+		{"ignore-hashtags", c.IgnoreHashtags},
+		{"release-tags", c.ReleaseTags},
+	} {
+		if o.pattern == "" {
+			continue
+		}
+		if _, err := CompileRegexp(o.pattern); err != nil {
+			return invalidOption(o.option, o.pattern, err)
+		}
+	}
+	return nil
 }
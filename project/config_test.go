@@ -0,0 +1,154 @@
+package project
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		r          string
+		start, end int
+		err        bool
+	}{
+		{r: "20:00-08:00", start: 20 * 60, end: 8 * 60},
+		{r: "09:30 - 17:15", start: 9*60 + 30, end: 17*60 + 15},
+		{r: "00:00-23:59", start: 0, end: 23*60 + 59},
+		{r: "20:00", err: true},
+		{r: "20:00-", err: true},
+		{r: "8pm-8am", err: true},
+		{r: "25:00-08:00", err: true},
+	}
+	for _, test := range tests {
+		start, end, err := parseTimeRange(test.r)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseTimeRange(%q) didn't return an error", test.r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTimeRange(%q) returned error: %v", test.r, err)
+		} else if start != test.start || end != test.end {
+			t.Errorf("parseTimeRange(%q) = %d, %d, want %d, %d", test.r, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestParseLabelValues(t *testing.T) {
+	tests := []struct {
+		s   string
+		lvs map[string][]int
+		err bool
+	}{
+		{s: "", lvs: map[string][]int{}},
+		{s: "Code-Review=+2", lvs: map[string][]int{"Code-Review": {2}}},
+		{
+			s:   "Code-Review=+2|-2, Verified=-1",
+			lvs: map[string][]int{"Code-Review": {2, -2}, "Verified": {-1}},
+		},
+		{s: " Verified = 1 | -1 ,", lvs: map[string][]int{"Verified": {1, -1}}},
+		{s: "Code-Review", err: true},
+		{s: "=+1", err: true},
+		{s: "Code-Review=two", err: true},
+	}
+	for _, test := range tests {
+		lvs, err := parseLabelValues(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseLabelValues(%q) didn't return an error", test.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLabelValues(%q) returned error: %v", test.s, err)
+		} else if !reflect.DeepEqual(lvs, test.lvs) {
+			t.Errorf("parseLabelValues(%q) = %v, want %v", test.s, lvs, test.lvs)
+		}
+	}
+}
+
+func TestParseReactionVotes(t *testing.T) {
+	tests := []struct {
+		s   string
+		rvs map[string]ReactionVote
+		err bool
+	}{
+		{s: "", rvs: map[string]ReactionVote{}},
+		{
+			s: "+1=Code-Review+1, -1=Code-Review-1",
+			rvs: map[string]ReactionVote{
+				"+1": {Label: "Code-Review", Value: 1},
+				"-1": {Label: "Code-Review", Value: -1},
+			},
+		},
+		{
+			s:   ":white_check_mark: = Verified+1",
+			rvs: map[string]ReactionVote{"white_check_mark": {Label: "Verified", Value: 1}},
+		},
+		{s: "ship=Code-Review+2", rvs: map[string]ReactionVote{"ship": {Label: "Code-Review", Value: 2}}},
+		{s: "+1", err: true},
+		{s: "=Code-Review+1", err: true},
+		{s: "+1=+1", err: true},
+		{s: "+1=Code-Review", err: true},
+		{s: "+1=Code-Review+x", err: true},
+	}
+	for _, test := range tests {
+		rvs, err := parseReactionVotes(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseReactionVotes(%q) didn't return an error", test.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseReactionVotes(%q) returned error: %v", test.s, err)
+		} else if !reflect.DeepEqual(rvs, test.rvs) {
+			t.Errorf("parseReactionVotes(%q) = %v, want %v", test.s, rvs, test.rvs)
+		}
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	templates := map[string]TemplateSet{"terse": {Name: "terse", Text: "{{.Event.Change.Subject}}"}}
+	tests := []struct {
+		template string
+		err      bool
+	}{
+		{template: ""},
+		{template: "terse"},
+		{template: "verbose", err: true},
+	}
+	for _, test := range tests {
+		c := DefaultConfig()
+		c.Template = test.template
+		c.Templates = templates
+		if err := c.validate(); test.err && err == nil {
+			t.Errorf("validate() with template %q didn't return an error", test.template)
+		} else if !test.err && err != nil {
+			t.Errorf("validate() with template %q returned error: %v", test.template, err)
+		}
+	}
+}
+
+func TestValidateMentionPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{MentionPolicyNever, MentionPolicyNever},
+		{MentionPolicyOwnerOnly, MentionPolicyOwnerOnly},
+		{MentionPolicyActionNeeded, MentionPolicyActionNeeded},
+		{MentionPolicyAlways, MentionPolicyAlways},
+		{"sometimes", MentionPolicyAlways},
+	}
+	for _, test := range tests {
+		c := DefaultConfig()
+		c.MentionPolicy = test.policy
+		if err := c.validate(); err != nil {
+			t.Errorf("validate() with mention-policy %q returned error: %v", test.policy, err)
+		} else if c.MentionPolicy != test.want {
+			t.Errorf("validate() with mention-policy %q set it to %q, want %q", test.policy, c.MentionPolicy, test.want)
+		}
+	}
+}
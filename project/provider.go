@@ -0,0 +1,191 @@
+package project
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/go-ini/ini"
+	llog "github.com/levenlabs/go-llog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Provider loads the configs of projects
+type Provider interface {
+	LoadConfig(project string) (Config, error)
+}
+
+// GerritProvider loads configs from the project.config in each project's
+// refs/meta/config, see LoadConfig
+type GerritProvider struct {
+	Client *gerrit.Client
+}
+
+// LoadConfig implements the Provider interface
+func (p GerritProvider) LoadConfig(project string) (Config, error) {
+	return LoadConfig(p.Client, project)
+}
+
+// fileProject is an entry in a FileProvider's file
+type fileProject struct {
+	// Match is a glob, like platform/*, matched against the project's name
+	Match string `yaml:"match"`
+	// Options are the same options as the slack-integration section
+	Options map[string]string `yaml:"options"`
+}
+
+// FileProvider loads configs from a single yaml file that maps globs of project
+// names to their options, like:
+//
+//	projects:
+//	  - match: "*"
+//	    options:
+//	      enabled: true
+//	  - match: platform/*
+//	    options:
+//	      channel: platform
+//
+// The options of every matching entry are applied in order. The file is
+// re-read whenever it's modified.
+type FileProvider struct {
+	path string
+
+	l        sync.Mutex
+	modTime  time.Time
+	projects []fileProject
+}
+
+// NewFileProvider returns a FileProvider for the yaml file at path
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+// load returns the file's entries, re-reading it if it was modified
+func (p *FileProvider) load() ([]fileProject, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": p.path})
+	}
+	if p.projects != nil && fi.ModTime().Equal(p.modTime) {
+		return p.projects, nil
+	}
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": p.path})
+	}
+	var f struct {
+		Projects []fileProject `yaml:"projects"`
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": p.path})
+	}
+	for _, fp := range f.Projects {
+		if _, err := path.Match(fp.Match, ""); err != nil {
+			return nil, llog.ErrWithKV(err, llog.KV{"path": p.path, "match": fp.Match})
+		}
+	}
+	p.projects = append([]fileProject{}, f.Projects...)
+	p.modTime = fi.ModTime()
+	return p.projects, nil
+}
+
+// LoadConfig implements the Provider interface
+func (p *FileProvider) LoadConfig(project string) (Config, error) {
+	cfg := DefaultConfig()
+	fps, err := p.load()
+	if err != nil {
+		return cfg, err
+	}
+	f := ini.Empty()
+	for i, fp := range fps {
+		if ok, _ := path.Match(fp.Match, project); !ok {
+			continue
+		}
+		sec, err := f.NewSection(fmt.Sprintf("project %d", i))
+		if err != nil {
+			return cfg, err
+		}
+		for k, v := range fp.Options {
+			if _, err := sec.NewKey(k, v); err != nil {
+				return cfg, configError(project, withSection(err, fp.Match))
+			}
+		}
+		if err := sec.MapTo(&cfg); err != nil {
+			return cfg, configError(project, withSection(err, fp.Match))
+		}
+		cfg.setSources(sec, "projects-file "+fp.Match)
+	}
+	cfg.finish()
+	cfg.project = project
+	if err := cfg.validate(); err != nil {
+		return cfg, configError(project, err)
+	}
+	return cfg, nil
+}
+
+// cachedConfig is a config loaded by a CachedProvider
+type cachedConfig struct {
+	cfg    Config
+	loaded time.Time
+}
+
+// CachedProvider caches the configs loaded by another Provider for a while so
+// that each event doesn't fetch the project.config of its project and all of
+// its parents. Errors aren't cached.
+type CachedProvider struct {
+	provider Provider
+	ttl      time.Duration
+
+	l    sync.Mutex
+	cfgs map[string]cachedConfig
+	// gen is incremented by Invalidate so configs that were being loaded
+	// while it was called aren't cached
+	gen int
+}
+
+// NewCachedProvider returns a CachedProvider that caches the configs loaded by
+// p for ttl
+func NewCachedProvider(p Provider, ttl time.Duration) *CachedProvider {
+	return &CachedProvider{
+		provider: p,
+		ttl:      ttl,
+		cfgs:     map[string]cachedConfig{},
+	}
+}
+
+// LoadConfig implements the Provider interface
+func (p *CachedProvider) LoadConfig(project string) (Config, error) {
+	p.l.Lock()
+	cc, ok := p.cfgs[project]
+	gen := p.gen
+	p.l.Unlock()
+	if ok && time.Since(cc.loaded) < p.ttl {
+		return cc.cfg, nil
+	}
+	loaded := time.Now()
+	cfg, err := p.provider.LoadConfig(project)
+	if err != nil {
+		return cfg, err
+	}
+	p.l.Lock()
+	if p.gen == gen {
+		p.cfgs[project] = cachedConfig{cfg: cfg, loaded: loaded}
+	}
+	p.l.Unlock()
+	return cfg, nil
+}
+
+// Invalidate removes every config from the cache. Since projects inherit their
+// parents' configs, a change to any project's config can change the others.
+func (p *CachedProvider) Invalidate() {
+	p.l.Lock()
+	p.cfgs = map[string]cachedConfig{}
+	p.gen++
+	p.l.Unlock()
+}
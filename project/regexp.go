@@ -0,0 +1,36 @@
+package project
+
+import (
+	"regexp"
+	"sync"
+)
+
+// compiledRegexp is the result of compiling a pattern
+type compiledRegexp struct {
+	r   *regexp.Regexp
+	err error
+}
+
+// regexps caches the compiled patterns of every config's regex options, keyed
+// by the pattern. Configs are loaded for every event so this saves compiling
+// the same few patterns over and over.
+var regexps = struct {
+	sync.Mutex
+	m map[string]compiledRegexp
+}{m: map[string]compiledRegexp{}}
+
+// CompileRegexp compiles the pattern, or returns the result of compiling it the
+// last time
+func CompileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexps.Lock()
+	cr, ok := regexps.m[pattern]
+	regexps.Unlock()
+	if ok {
+		return cr.r, cr.err
+	}
+	cr.r, cr.err = regexp.Compile(pattern)
+	regexps.Lock()
+	regexps.m[pattern] = cr
+	regexps.Unlock()
+	return cr.r, cr.err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+// reactionEvent is slack's reaction_added event
+type reactionEvent struct {
+	Type     string `json:"type"`
+	User     string `json:"user"`
+	Reaction string `json:"reaction"`
+	Item     struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	} `json:"item"`
+}
+
+// reactionVoter casts the votes for emoji reactions on the first messages of
+// changes, as set by each project's reaction-votes, on behalf of whoever
+// reacted
+type reactionVoter struct {
+	eh eventHandler
+	// labels are the only labels that are voted on
+	labels map[string]bool
+}
+
+func newReactionVoter(eh eventHandler, labels string) *reactionVoter {
+	rv := &reactionVoter{eh: eh, labels: map[string]bool{}}
+	for _, l := range strings.Split(labels, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			rv.labels[l] = true
+		}
+	}
+	return rv
+}
+
+// handle handles one of slack's events, only reaction_added events are used
+func (rv *reactionVoter) handle(raw json.RawMessage) {
+	var ev reactionEvent
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		llog.Warn("error unmarshaling slack event", llog.ErrKV(err))
+		return
+	}
+	if ev.Type != "reaction_added" || ev.Item.Type != "message" {
+		return
+	}
+	// skin tones are suffixed like +1::skin-tone-2
+	emoji := strings.SplitN(ev.Reaction, "::", 2)[0]
+	kv := llog.KV{"channel": ev.Item.Channel, "ts": ev.Item.TS, "reaction": emoji, "user": ev.User}
+	change, ok, err := rv.eh.changes.FindMessage(ev.Item.Channel, ev.Item.TS)
+	if err != nil {
+		llog.Error("error finding change for reaction", llog.ErrKV(err), kv)
+		return
+	} else if !ok {
+		return
+	}
+	kv["project"], kv["number"] = change.Project, change.Number
+	pcfg, err := rv.eh.configs.LoadConfig(change.Project)
+	if err != nil {
+		llog.Error("error loading config", llog.ErrKV(err), kv)
+		rv.eh.alerts.alert(err)
+		return
+	} else if !pcfg.Enabled {
+		return
+	}
+	vote, ok := pcfg.ReactionVote(emoji)
+	if !ok {
+		return
+	}
+	if !rv.labels[vote.Label] {
+		llog.Warn("reaction vote's label isn't allowed by reaction-vote-labels", kv, llog.KV{"label": vote.Label})
+		return
+	}
+	email, err := rv.eh.state.Email(ev.User)
+	if err != nil {
+		llog.Error("error getting email of slack user", llog.ErrKV(err), kv)
+		return
+	} else if email == "" {
+		llog.Debug("slack user has no email to vote as", kv)
+		return
+	}
+	kv["email"] = email
+	_, _, err = rv.eh.client.Changes.SetReview(gerritssh.ChangeIDWithProjectNumber(change.Project, change.Number), "current", &gerrit.ReviewInput{
+		Labels:     map[string]string{vote.Label: fmt.Sprintf("%+d", vote.Value)},
+		OnBehalfOf: email,
+	})
+	if err != nil {
+		llog.Error("error voting for reaction", llog.ErrKV(err), kv)
+		return
+	}
+	llog.Info("voted for reaction", kv, llog.KV{"label": vote.Label, "value": vote.Value})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+// deletedRevision is the new revision of a ref-updated event when the ref was
+// deleted
+const deletedRevision = "0000000000000000000000000000000000000000"
+
+// notifyBranchChange posts the branch that the event created or deleted to the
+// admin channel, if notify-branch-changes is set
+func (eh eventHandler) notifyBranchChange(e gerritssh.Event) {
+	if eh.branchWebhookURL == "" {
+		return
+	}
+	branch := strings.TrimPrefix(e.RefUpdate.RefName, "refs/heads/")
+	msg := events.BranchMessage(e, branch, e.RefUpdate.NewRevision == deletedRevision)
+	msg.Channel = eh.branchChannel
+	eh.sch <- webhookSubmit{
+		Message:    msg,
+		WebhookURL: eh.branchWebhookURL,
+		SourceType: "branch",
+	}
+}
+
+// handleRefUpdated posts created and deleted branches, and checks the updated
+// branch for merge conflicts or announces the new tag depending on the
+// project's config
+func (eh eventHandler) handleRefUpdated(ctx context.Context, e gerritssh.Event) {
+	ru := e.RefUpdate
+	if strings.HasPrefix(ru.RefName, "refs/heads/") &&
+		(ru.OldRevision == deletedRevision || ru.NewRevision == deletedRevision) {
+		eh.notifyBranchChange(e)
+	}
+	if ru.NewRevision == deletedRevision {
+		return
+	}
+	var branch, tag string
+	switch {
+	case strings.HasPrefix(ru.RefName, "refs/heads/"):
+		branch = strings.TrimPrefix(ru.RefName, "refs/heads/")
+	case strings.HasPrefix(ru.RefName, "refs/tags/"):
+		tag = strings.TrimPrefix(ru.RefName, "refs/tags/")
+	default:
+		return
+	}
+	pcfg, err := eh.configs.LoadConfig(ru.Project)
+	if err == nil && branch != "" {
+		pcfg, err = pcfg.ForBranch(branch)
+	}
+	if err != nil {
+		llog.Error("error loading config", llog.ErrKV(err), e.KV())
+		eh.alerts.alert(err)
+		return
+	} else if !pcfg.Enabled {
+		return
+	}
+	if tag != "" {
+		if pcfg.ReleaseTags != "" {
+			eh.announceRelease(ctx, e, tag, pcfg)
+		}
+		return
+	}
+	if pcfg.NotifyOwnerOnMergeConflict != "" {
+		eh.checkMergeConflicts(ctx, e, branch, pcfg)
+	}
+}
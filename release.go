@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/go-llog"
+)
+
+// releaseMaxChanges is the most commits listed in a release announcement
+var releaseMaxChanges = 50
+
+// announceRelease posts the new tag, if it matches release-tags, with the
+// changes merged since the previous matching tag
+func (eh eventHandler) announceRelease(ctx context.Context, e gerritssh.Event, tag string, pcfg project.Config) {
+	r, err := project.CompileRegexp(pcfg.ReleaseTags)
+	if err != nil {
+		// the config was validated when it was loaded
+		llog.Error("invalid release-tags", llog.ErrKV(err), e.KV())
+		return
+	} else if !r.MatchString(tag) {
+		return
+	}
+	ctx, span := startSpan(ctx, "release")
+	defer span.End()
+	// one more is fetched to know if the changelog was cut short
+	prev, changelog, err := gerritssh.Changelog(eh.client, e.RefUpdate.Project, tag, r.MatchString, releaseMaxChanges+1)
+	if err != nil {
+		span.RecordError(err)
+		llog.Error("error getting release changelog", llog.ErrKV(err), e.KV(), llog.KV{"tag": tag})
+		return
+	}
+	var more bool
+	if len(changelog) > releaseMaxChanges {
+		changelog = changelog[:releaseMaxChanges]
+		more = true
+	}
+	msg := events.ReleaseMessage(e.RefUpdate.Project, tag, prev, changelog, more)
+	msg.Channel = pcfg.Channel
+	if pcfg.ReleaseChannel != "" {
+		msg.Channel = pcfg.ReleaseChannel
+	}
+	eh.sch <- webhookSubmit{
+		Message:       msg,
+		WebhookURL:    pcfg.WebhookURL,
+		SourceType:    "release",
+		ProjectConfig: pcfg,
+		ctx:           ctx,
+	}
+}
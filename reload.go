@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/go-ini/ini"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+// credentialReloader re-reads the credentials from the config file and applies
+// them to the running clients so secrets can be rotated without restarting
+type credentialReloader struct {
+	path   string
+	client *gerrit.Client
+	// sshc is nil unless events are streamed over ssh
+	sshc  *gerritssh.Client
+	state *slackState
+	// token is nil unless gerrit is sent a bearer token
+	token *gerritToken
+}
+
+// reload reads the gerrit password or token, private key and slack token from
+// the config file, applies them and reconnects the ssh stream
+func (r credentialReloader) reload() error {
+	f, err := ini.Load(r.path)
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": r.path})
+	}
+	var cfg config
+	if err := f.Section("gerrit").MapTo(&cfg); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": r.path})
+	}
+
+	// parse the private key first so nothing changes if it's invalid
+	if r.sshc != nil && !cfg.SSHAgent {
+		pk, err := ioutil.ReadFile(cfg.PrivateKeyPath)
+		if err != nil {
+			return llog.ErrWithKV(err, llog.KV{"path": cfg.PrivateKeyPath})
+		}
+		passphrase := cfg.Passphrase
+		if passphrase == "" {
+			passphrase = os.Getenv(passphraseEnv)
+		}
+		if err := r.sshc.SetPrivateKey(pk, []byte(passphrase)); err != nil {
+			return llog.ErrWithKV(err, llog.KV{"path": cfg.PrivateKeyPath})
+		}
+	}
+	r.client.Authentication.SetBasicAuth(cfg.Username, cfg.Password)
+	if r.token != nil {
+		r.token.set(cfg.HTTPToken, cfg.HTTPTokenCommand)
+	}
+	r.state.SetToken(cfg.SlackToken)
+	if r.sshc != nil {
+		r.sshc.Redial()
+	}
+	llog.Info("reloaded credentials", llog.KV{"path": r.path})
+	return nil
+}
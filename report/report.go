@@ -0,0 +1,188 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/events"
+)
+
+// maxChanges is the most changes that are looked at for a single report
+const maxChanges = 500
+
+// maxReviewers is the most reviewers listed in the report
+const maxReviewers = 5
+
+// queryTimeFormat is the format of times in gerrit's after: search operator
+const queryTimeFormat = "2006-01-02 15:04:05 -0700"
+
+// stats is the review throughput of a project over a period
+type stats struct {
+	opened, merged, abandoned int
+	// firstReview is how long each change opened in the period waited for
+	// its first review
+	firstReview []time.Duration
+	// reviews is how many changes each reviewer commented on in the period
+	reviews map[string]int
+	// truncated is true if there were more than maxChanges changes
+	truncated bool
+}
+
+// Message builds a report of the project's review statistics between since and
+// until. Comments by the accounts that ignore returns true for, like CI, aren't
+// counted as reviews. Changes with the optOutHashtag, if it's set, are left out.
+// If nothing happened in the period then false is returned.
+func Message(client *gerrit.Client, project string, since, until time.Time, optOutHashtag string, ignore func(username string) bool) (events.Message, bool, error) {
+	var m events.Message
+	var optOut string
+	if optOutHashtag != "" {
+		optOut = fmt.Sprintf(` -hashtag:"%s"`, optOutHashtag)
+	}
+	cs, _, err := client.Changes.QueryChanges(&gerrit.QueryChangeOptions{
+		QueryOptions: gerrit.QueryOptions{
+			Query: []string{fmt.Sprintf(`project:"%s" -is:private after:"%s"%s`, project, since.UTC().Format(queryTimeFormat), optOut)},
+			Limit: maxChanges,
+		},
+		ChangeOptions: gerrit.ChangeOptions{
+			AdditionalFields: []string{"DETAILED_ACCOUNTS", "MESSAGES"},
+		},
+	})
+	if err != nil {
+		return m, false, err
+	}
+	s := collect(*cs, since, until, ignore)
+	if s.opened+s.merged+s.abandoned+len(s.reviews) == 0 {
+		return m, false, nil
+	}
+
+	m.Pretext = fmt.Sprintf("Weekly review report for %s", project)
+	m.Fallback = m.Pretext
+	m.Fields = append(m.Fields,
+		events.MessageField{Title: "Opened", Value: fmt.Sprint(s.opened), Short: true},
+		events.MessageField{Title: "Merged", Value: fmt.Sprint(s.merged), Short: true},
+		events.MessageField{Title: "Abandoned", Value: fmt.Sprint(s.abandoned), Short: true},
+	)
+	if len(s.firstReview) > 0 {
+		m.Fields = append(m.Fields, events.MessageField{
+			Title: "Median time to first review",
+			Value: formatDuration(median(s.firstReview)),
+			Short: true,
+		})
+	}
+	if len(s.reviews) > 0 {
+		m.Fields = append(m.Fields, events.MessageField{
+			Title: "Top reviewers",
+			Value: topReviewers(s.reviews),
+		})
+	}
+	if s.truncated {
+		m.Text = fmt.Sprintf("Only the %d most recently updated changes were counted", maxChanges)
+	}
+	return m, true, nil
+}
+
+// collect computes the stats of the changes between since and until
+func collect(cs []gerrit.ChangeInfo, since, until time.Time, ignore func(string) bool) stats {
+	s := stats{reviews: map[string]int{}}
+	in := func(t time.Time) bool {
+		return !t.Before(since) && t.Before(until)
+	}
+	for _, c := range cs {
+		if c.MoreChanges {
+			s.truncated = true
+		}
+		opened := in(c.Created.Time)
+		if opened {
+			s.opened++
+		}
+		switch c.Status {
+		case "MERGED":
+			if c.Submitted != nil && in(c.Submitted.Time) {
+				s.merged++
+			}
+		case "ABANDONED":
+			// the time it was abandoned isn't known so this assumes that it
+			// was the last update
+			if in(c.Updated.Time) {
+				s.abandoned++
+			}
+		}
+
+		var reviewed bool
+		reviewers := map[string]bool{}
+		for _, msg := range c.Messages {
+			a := msg.Author
+			// messages from gerrit itself don't have an author
+			if a.AccountID == 0 || a.AccountID == c.Owner.AccountID || ignore(a.Username) {
+				continue
+			}
+			if opened && !reviewed && msg.Date.Before(until) {
+				s.firstReview = append(s.firstReview, msg.Date.Sub(c.Created.Time))
+				reviewed = true
+			}
+			if in(msg.Date.Time) {
+				reviewers[accountName(a)] = true
+			}
+		}
+		for name := range reviewers {
+			s.reviews[name]++
+		}
+	}
+	return s
+}
+
+func accountName(a gerrit.AccountInfo) string {
+	switch {
+	case a.Name != "":
+		return a.Name
+	case a.Username != "":
+		return a.Username
+	default:
+		return a.Email
+	}
+}
+
+func median(ds []time.Duration) time.Duration {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	if len(ds)%2 == 1 {
+		return ds[len(ds)/2]
+	}
+	return (ds[len(ds)/2-1] + ds[len(ds)/2]) / 2
+}
+
+// formatDuration formats the duration in days, hours or minutes
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%.1f days", d.Hours()/24)
+	case d >= time.Hour:
+		return fmt.Sprintf("%.1f hours", d.Hours())
+	default:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+}
+
+// topReviewers lists the reviewers that reviewed the most changes
+func topReviewers(reviews map[string]int) string {
+	names := make([]string, 0, len(reviews))
+	for name := range reviews {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if reviews[names[i]] != reviews[names[j]] {
+			return reviews[names[i]] > reviews[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > maxReviewers {
+		names = names[:maxReviewers]
+	}
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("%s (%d)", name, reviews[name])
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,105 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+)
+
+func ts(t time.Time) gerrit.Timestamp {
+	return gerrit.Timestamp{Time: t}
+}
+
+func TestCollect(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(7 * 24 * time.Hour)
+	before := since.Add(-time.Hour)
+	owner := gerrit.AccountInfo{AccountID: 1, Name: "Owner"}
+	alice := gerrit.AccountInfo{AccountID: 2, Name: "Alice"}
+	bob := gerrit.AccountInfo{AccountID: 3, Username: "bob"}
+	ci := gerrit.AccountInfo{AccountID: 4, Username: "ci"}
+	gerritItself := gerrit.AccountInfo{}
+	submitted := ts(since.Add(3 * time.Hour))
+
+	cs := []gerrit.ChangeInfo{
+		{
+			// opened and merged in the period, ci's and gerrit's comments
+			// don't count as the first review
+			Status:    "MERGED",
+			Owner:     owner,
+			Created:   ts(since.Add(time.Hour)),
+			Updated:   submitted,
+			Submitted: &submitted,
+			Messages: []gerrit.ChangeMessageInfo{
+				{Author: gerritItself, Date: ts(since.Add(time.Hour))},
+				{Author: ci, Date: ts(since.Add(70 * time.Minute))},
+				{Author: owner, Date: ts(since.Add(80 * time.Minute))},
+				{Author: alice, Date: ts(since.Add(2 * time.Hour))},
+				{Author: alice, Date: ts(since.Add(150 * time.Minute))},
+			},
+		},
+		{
+			// opened before the period so only the review counts
+			Status:  "NEW",
+			Owner:   owner,
+			Created: ts(before),
+			Updated: ts(since.Add(time.Hour)),
+			Messages: []gerrit.ChangeMessageInfo{
+				{Author: bob, Date: ts(before)},
+				{Author: alice, Date: ts(since.Add(time.Hour))},
+			},
+		},
+		{
+			// abandoned in the period
+			Status:  "ABANDONED",
+			Owner:   owner,
+			Created: ts(since.Add(2 * time.Hour)),
+			Updated: ts(since.Add(5 * time.Hour)),
+			Messages: []gerrit.ChangeMessageInfo{
+				{Author: bob, Date: ts(since.Add(6 * time.Hour))},
+			},
+		},
+		{
+			// updated after the period
+			Status:  "ABANDONED",
+			Owner:   owner,
+			Created: ts(until),
+			Updated: ts(until.Add(time.Hour)),
+			Messages: []gerrit.ChangeMessageInfo{
+				{Author: alice, Date: ts(until.Add(time.Hour))},
+			},
+			MoreChanges: true,
+		},
+	}
+	s := collect(cs, since, until, func(username string) bool { return username == "ci" })
+	want := stats{
+		opened:      2,
+		merged:      1,
+		abandoned:   1,
+		firstReview: []time.Duration{time.Hour, 4 * time.Hour},
+		reviews:     map[string]int{"Alice": 2, "bob": 1},
+		truncated:   true,
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("collect() = %+v, want %+v", s, want)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		ds     []time.Duration
+		median time.Duration
+	}{
+		{[]time.Duration{time.Minute}, time.Minute},
+		{[]time.Duration{3 * time.Minute, time.Minute, 2 * time.Minute}, 2 * time.Minute},
+		{[]time.Duration{4 * time.Minute, time.Minute}, 150 * time.Second},
+		{[]time.Duration{time.Hour, time.Minute, 2 * time.Minute, 3 * time.Minute}, 150 * time.Second},
+	}
+	for _, test := range tests {
+		if m := median(test.ds); m != test.median {
+			t.Errorf("median(%v) = %v, want %v", test.ds, m, test.median)
+		}
+	}
+}
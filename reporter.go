@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/levenlabs/go-llog"
+)
+
+// deliveryFailureThreshold is how many times a message has to fail to be
+// posted before it's reported
+const deliveryFailureThreshold = 5
+
+// sentryEnabled is true once initErrorReporting succeeds
+var sentryEnabled bool
+
+// initErrorReporting sets up reporting errors to the Sentry-compatible dsn and
+// returns a function that flushes any reports that haven't been sent yet
+func initErrorReporting(dsn string) (func(), error) {
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn: dsn,
+	})
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"dsn": dsn})
+	}
+	sentryEnabled = true
+	return func() {
+		sentry.Flush(5 * time.Second)
+	}, nil
+}
+
+// reportError sends the error to Sentry, if it's configured, with the kvs as
+// extra context
+func reportError(err error, kvs ...llog.KV) {
+	if !sentryEnabled {
+		return
+	}
+	kv := llog.Merge(append(kvs, llog.ErrKV(err))...)
+	sentry.WithScope(func(scope *sentry.Scope) {
+		for k, v := range kv {
+			scope.SetExtra(k, v)
+		}
+		sentry.CaptureException(err)
+	})
+}
+
+// reportPanic recovers from a panic, logs it and reports it. It must be called
+// with defer.
+func reportPanic(kvs ...llog.KV) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+	llog.Error("recovered from panic", append(kvs, llog.ErrKV(err))...)
+	reportError(err, kvs...)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+const (
+	secretStoreEnv   = "env"
+	secretStoreFile  = "file"
+	secretStoreVault = "vault"
+
+	// secretEnvPrefix is prepended to a secret's name to get the environment
+	// variable it's read from, so projects can't reference arbitrary variables
+	secretEnvPrefix = "GERRIT_SLACK_SECRET_"
+)
+
+// secretTTL is how long a secret is cached before it's read again
+var secretTTL = 5 * time.Minute
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// secretStore resolves the names that projects use, like in webhookurl-secret,
+// into secrets
+type secretStore struct {
+	kind string
+	// dir is the directory of files, one per secret, for the file store
+	dir string
+	// vaultAddress, vaultToken and vaultPath are for the vault store, secrets
+	// are read from the value key of vaultPath/<name>
+	vaultAddress string
+	vaultToken   string
+	vaultPath    string
+
+	l     sync.Mutex
+	cache map[string]cachedSecret
+}
+
+func newSecretStore(cfg config) *secretStore {
+	return &secretStore{
+		kind:         cfg.SecretStore,
+		dir:          cfg.SecretDir,
+		vaultAddress: cfg.VaultAddress,
+		vaultToken:   cfg.VaultToken,
+		vaultPath:    cfg.VaultPath,
+		cache:        map[string]cachedSecret{},
+	}
+}
+
+// Secret returns the secret with the given name
+func (ss *secretStore) Secret(name string) (string, error) {
+	ss.l.Lock()
+	c, ok := ss.cache[name]
+	ss.l.Unlock()
+	if ok && time.Since(c.fetched) < secretTTL {
+		return c.value, nil
+	}
+	v, err := ss.read(name)
+	if err != nil {
+		return "", llog.ErrWithKV(err, llog.KV{"secret": name, "secretStore": ss.kind})
+	}
+	ss.l.Lock()
+	ss.cache[name] = cachedSecret{value: v, fetched: time.Now()}
+	ss.l.Unlock()
+	return v, nil
+}
+
+func (ss *secretStore) read(name string) (string, error) {
+	switch ss.kind {
+	case secretStoreEnv:
+		v, ok := os.LookupEnv(secretEnvPrefix + name)
+		if !ok {
+			return "", errors.New("secret environment variable not set")
+		}
+		return v, nil
+	case secretStoreFile:
+		b, err := ioutil.ReadFile(filepath.Join(ss.dir, name))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case secretStoreVault:
+		return ss.readVault(name)
+	case "":
+		return "", errors.New("secret-store is not set")
+	}
+	return "", errors.New("unknown secret-store")
+}
+
+// readVault reads the secret from vault's kv secrets engine, either version
+func (ss *secretStore) readVault(name string) (string, error) {
+	u := fmt.Sprintf("%s/v1/%s/%s",
+		strings.TrimSuffix(ss.vaultAddress, "/"),
+		strings.Trim(ss.vaultPath, "/"),
+		name,
+	)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", ss.vaultToken)
+	c := &http.Client{Timeout: 10 * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", llog.ErrWithKV(errors.New("unexpected status reading from vault"), llog.KV{
+			"status": resp.StatusCode,
+		})
+	}
+	var res struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	// version 2 of the kv engine nests the secret's data inside data
+	data := res.Data
+	if raw, ok := data["data"]; ok {
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return "", err
+		}
+	}
+	var v string
+	if raw, ok := data["value"]; !ok {
+		return "", errors.New("vault secret has no value key")
+	} else if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
@@ -0,0 +1,119 @@
+package sink
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/levenlabs/gerrit-slack/events"
+)
+
+// discordEmbed is a rich embed in a discord webhook message, from
+// https://discord.com/developers/docs/resources/channel#embed-object
+type discordEmbed struct {
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	URL         string              `json:"url,omitempty"`
+	Color       int                 `json:"color,omitempty"`
+	Fields      []discordEmbedField `json:"fields,omitempty"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+// discordMessage is the body of a discord webhook request
+type discordMessage struct {
+	Username string         `json:"username,omitempty"`
+	Content  string         `json:"content,omitempty"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+// discordColors maps slack's named attachment colors to discord's colors
+var discordColors = map[string]int{
+	"good":    0x2eb886,
+	"warning": 0xdaa038,
+	"danger":  0xa30200,
+}
+
+// slackLinkRegexp matches a slack link like <url|text> or <url>
+var slackLinkRegexp = regexp.MustCompile(`<([^|>]+)(?:\|([^>]+))?>`)
+
+// discordText converts slack's mrkdwn into discord's markdown
+func discordText(s string) string {
+	s = slackLinkRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		parts := slackLinkRegexp.FindStringSubmatch(m)
+		if parts[2] == "" {
+			return parts[1]
+		}
+		return "[" + parts[2] + "](" + parts[1] + ")"
+	})
+	// slack uses single characters for bold and strikethrough
+	s = mdSlackBoldRegexp.ReplaceAllString(s, "**$1**")
+	s = mdSlackStrikeRegexp.ReplaceAllString(s, "~~$1~~")
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(s)
+}
+
+var (
+	mdSlackBoldRegexp   = regexp.MustCompile(`\*([^*\n]+)\*`)
+	mdSlackStrikeRegexp = regexp.MustCompile(`~([^~\n]+)~`)
+)
+
+// discordColor converts a slack attachment color, which is either a name or a
+// hex code like #439FE0, into a discord color
+func discordColor(c string) int {
+	if v, ok := discordColors[c]; ok {
+		return v
+	}
+	v, err := strconv.ParseInt(strings.TrimPrefix(c, "#"), 16, 32)
+	if err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+// Discord posts messages to a discord webhook as embeds
+type Discord struct {
+	client *http.Client
+}
+
+// Deliver implements the Sink interface
+func (d Discord) Deliver(m Message) error {
+	if m.WebhookURL == "" {
+		return nil
+	}
+	return postJSON(d.client, m.WebhookURL, newDiscordMessage(m.Message, m.Username))
+}
+
+// Capabilities implements the Sink interface
+func (Discord) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// newDiscordMessage converts a message into a discord webhook message
+func newDiscordMessage(m events.Message, username string) discordMessage {
+	e := discordEmbed{
+		Title:       discordText(m.Title),
+		URL:         m.TitleLink,
+		Description: discordText(m.Text),
+		Color:       discordColor(m.Color),
+	}
+	for _, f := range m.Fields {
+		if f.Value == "" {
+			continue
+		}
+		e.Fields = append(e.Fields, discordEmbedField{
+			Name:   f.Title,
+			Value:  discordText(f.Value),
+			Inline: f.Short,
+		})
+	}
+	return discordMessage{
+		Username: username,
+		Content:  discordText(m.Pretext),
+		Embeds:   []discordEmbed{e},
+	}
+}
@@ -0,0 +1,180 @@
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/go-llog"
+)
+
+// Email emails messages to their recipients through an smtp server
+type Email struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+// emailLinkText replaces slack links in s with the result of link and passes
+// everything else, unescaped, through text
+func emailLinkText(s string, link func(url, text string) string, text func(string) string) string {
+	unescape := strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+	var b strings.Builder
+	var last int
+	for _, m := range slackLinkRegexp.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(text(unescape.Replace(s[last:m[0]])))
+		url := s[m[2]:m[3]]
+		t := url
+		if m[4] >= 0 {
+			t = s[m[4]:m[5]]
+		}
+		b.WriteString(link(url, unescape.Replace(t)))
+		last = m[1]
+	}
+	b.WriteString(text(unescape.Replace(s[last:])))
+	return b.String()
+}
+
+// emailPlain converts slack's mrkdwn into plain text
+func emailPlain(s string) string {
+	return emailLinkText(s, func(url, text string) string {
+		if text == url {
+			return url
+		}
+		return text + " (" + url + ")"
+	}, func(s string) string { return s })
+}
+
+// emailHTML converts slack's mrkdwn into html
+func emailHTML(s string) string {
+	return emailLinkText(s, func(url, text string) string {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), html.EscapeString(text))
+	}, func(s string) string {
+		return strings.Replace(html.EscapeString(s), "\n", "<br>\n", -1)
+	})
+}
+
+// emailBodies renders the message as plain text and html
+func emailBodies(m events.Message) (string, string) {
+	var t, h strings.Builder
+	if m.Pretext != "" {
+		fmt.Fprintf(&t, "%s\n\n", emailPlain(m.Pretext))
+		fmt.Fprintf(&h, "<p>%s</p>\n", emailHTML(m.Pretext))
+	}
+	if m.Title != "" {
+		title := m.Title
+		if m.TitleLink != "" {
+			title = "<" + m.TitleLink + "|" + m.Title + ">"
+		}
+		fmt.Fprintf(&t, "%s\n\n", emailPlain(title))
+		fmt.Fprintf(&h, "<h3>%s</h3>\n", emailHTML(title))
+	}
+	if m.Text != "" {
+		fmt.Fprintf(&t, "%s\n\n", emailPlain(m.Text))
+		fmt.Fprintf(&h, "<p>%s</p>\n", emailHTML(m.Text))
+	}
+	var fields bool
+	for _, f := range m.Fields {
+		if f.Value == "" {
+			continue
+		}
+		if !fields {
+			h.WriteString("<table>\n")
+			fields = true
+		}
+		fmt.Fprintf(&t, "%s: %s\n", f.Title, emailPlain(f.Value))
+		fmt.Fprintf(&h, "<tr><th align=\"left\">%s</th><td>%s</td></tr>\n", html.EscapeString(f.Title), emailHTML(f.Value))
+	}
+	if fields {
+		h.WriteString("</table>\n")
+	}
+	return t.String(), h.String()
+}
+
+// compose returns the email for the message with both a plain text and an html
+// part
+func (ml Email) compose(m events.Message, to []string) ([]byte, error) {
+	subject := m.Fallback
+	if subject == "" {
+		subject = m.Pretext
+	}
+	// headers can't have newlines
+	subject = strings.Join(strings.Fields(emailPlain(subject)), " ")
+	text, htm := emailBodies(m)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", htm},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", ml.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	b.Write(body.Bytes())
+	return b.Bytes(), nil
+}
+
+// Deliver implements the Sink interface
+func (ml Email) Deliver(m Message) error {
+	to := m.Recipients
+	if len(to) == 0 {
+		return nil
+	}
+	if ml.addr == "" {
+		return Permanent(errors.New("smtp-address is not set"))
+	}
+	b, err := ml.compose(m.Message, to)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if ml.username != "" {
+		host, _, err := net.SplitHostPort(ml.addr)
+		if err != nil {
+			return llog.ErrWithKV(err, llog.KV{"addr": ml.addr})
+		}
+		auth = smtp.PlainAuth("", ml.username, ml.password, host)
+	}
+	if err := smtp.SendMail(ml.addr, auth, ml.from, to, b); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"addr": ml.addr})
+	}
+	return nil
+}
+
+// Capabilities implements the Sink interface
+func (Email) Capabilities() Capabilities {
+	return Capabilities{Recipients: true}
+}
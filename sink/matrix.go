@@ -0,0 +1,89 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// matrixTxnCounter makes transaction ids unique within this process
+var matrixTxnCounter int64
+
+// matrixMessage is the content of an m.room.message event, from
+// https://spec.matrix.org/v1.8/client-server-api/#mroommessage
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+// Matrix sends messages to matrix rooms, using the message's channel as the
+// room id
+type Matrix struct {
+	client      *http.Client
+	homeserver  string
+	accessToken string
+}
+
+// Deliver implements the Sink interface. The message is sent as a notice so
+// bots don't respond to it.
+func (mc Matrix) Deliver(m Message) error {
+	if mc.homeserver == "" || mc.accessToken == "" {
+		return Permanent(errors.New("matrix-homeserver and matrix-access-token must be set"))
+	}
+	room := m.Channel
+	text, htm := emailBodies(m.Message)
+	b, err := json.Marshal(matrixMessage{
+		MsgType:       "m.notice",
+		Body:          strings.TrimSpace(text),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htm,
+	})
+	if err != nil {
+		return err
+	}
+	txn := fmt.Sprintf("%d.%d", time.Now().UnixNano(), atomic.AddInt64(&matrixTxnCounter, 1))
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(mc.homeserver, "/"),
+		url.PathEscape(room),
+		txn,
+	)
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+mc.accessToken)
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"room": room})
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if len(body) > 250 {
+			body = body[:250]
+		}
+		return llog.ErrWithKV(errors.New("unexpected status sending to matrix"), llog.KV{
+			"room":   room,
+			"status": resp.StatusCode,
+			"body":   string(body),
+		})
+	}
+	return nil
+}
+
+// Capabilities implements the Sink interface
+func (Matrix) Capabilities() Capabilities {
+	return Capabilities{}
+}
@@ -0,0 +1,90 @@
+package sink
+
+import (
+	"net/http"
+
+	"github.com/levenlabs/gerrit-slack/events"
+)
+
+// rocketChatAttachment is an attachment in a rocket.chat incoming webhook
+// message, from
+// https://developer.rocket.chat/reference/api/rest-api/endpoints/messaging/chat-endpoints/postmessage#attachments-detail
+type rocketChatAttachment struct {
+	Title     string                `json:"title,omitempty"`
+	TitleLink string                `json:"title_link,omitempty"`
+	Text      string                `json:"text,omitempty"`
+	Color     string                `json:"color,omitempty"`
+	Fields    []events.MessageField `json:"fields,omitempty"`
+}
+
+// rocketChatMessage is the body of a rocket.chat incoming webhook request
+type rocketChatMessage struct {
+	Channel     string                 `json:"channel,omitempty"`
+	Alias       string                 `json:"alias,omitempty"`
+	Text        string                 `json:"text"`
+	Attachments []rocketChatAttachment `json:"attachments"`
+}
+
+// rocketChatColors maps slack's named attachment colors to hex colors since
+// rocket.chat only supports those
+var rocketChatColors = map[string]string{
+	"good":    "#2eb886",
+	"warning": "#daa038",
+	"danger":  "#a30200",
+}
+
+// rocketChatText converts slack's links into markdown links, which is all that
+// differs from rocket.chat's markdown
+func rocketChatText(s string) string {
+	return slackLinkRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		parts := slackLinkRegexp.FindStringSubmatch(m)
+		if parts[2] == "" {
+			return parts[1]
+		}
+		return "[" + parts[2] + "](" + parts[1] + ")"
+	})
+}
+
+// newRocketChatMessage converts a message into a rocket.chat webhook message
+func newRocketChatMessage(m events.Message, username string) rocketChatMessage {
+	a := rocketChatAttachment{
+		Title:     m.Title,
+		TitleLink: m.TitleLink,
+		Text:      rocketChatText(m.Text),
+		Color:     m.Color,
+	}
+	if c, ok := rocketChatColors[m.Color]; ok {
+		a.Color = c
+	}
+	for _, f := range m.Fields {
+		if f.Value == "" {
+			continue
+		}
+		f.Value = rocketChatText(f.Value)
+		a.Fields = append(a.Fields, f)
+	}
+	return rocketChatMessage{
+		Channel:     m.Channel,
+		Alias:       username,
+		Text:        rocketChatText(m.Pretext),
+		Attachments: []rocketChatAttachment{a},
+	}
+}
+
+// RocketChat posts messages to a rocket.chat incoming webhook as attachments
+type RocketChat struct {
+	client *http.Client
+}
+
+// Deliver implements the Sink interface
+func (rc RocketChat) Deliver(m Message) error {
+	if m.WebhookURL == "" {
+		return nil
+	}
+	return postJSON(rc.client, m.WebhookURL, newRocketChatMessage(m.Message, m.Username))
+}
+
+// Capabilities implements the Sink interface
+func (RocketChat) Capabilities() Capabilities {
+	return Capabilities{}
+}
@@ -0,0 +1,130 @@
+// Package sink delivers messages to the chat backends, and email, that projects
+// can send their messages to
+package sink
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/project"
+)
+
+// Message is a message along with where it's being delivered
+type Message struct {
+	events.Message
+	// WebhookURL is the project's webhookurl, it's empty for sinks that don't
+	// use webhooks
+	WebhookURL string
+	// Username is who the message is posted as, if the sink supports it
+	Username string
+	// Recipients are who the message is for if the sink's capabilities have
+	// Recipients set
+	Recipients []string
+}
+
+// Capabilities describes what a Sink supports so messages can be tailored to
+// it
+type Capabilities struct {
+	// Mentions is true if slack user mentions, like <@U123>, are rendered
+	Mentions bool
+	// Recipients is true if the message needs its Recipients, the change's
+	// owner and reviewers, set
+	Recipients bool
+}
+
+// Sink delivers messages to a backend
+type Sink interface {
+	// Deliver delivers the message and returns an error if it should be
+	// retried, unless the error is Permanent
+	Deliver(Message) error
+	Capabilities() Capabilities
+}
+
+// Posted identifies a posted message
+type Posted struct {
+	Channel string
+	TS      string
+}
+
+// Poster is implemented by sinks that can report where each message was posted
+type Poster interface {
+	Sink
+	// Post is like Deliver but also returns where the message was posted
+	Post(Message) (Posted, error)
+}
+
+// Editor is implemented by sinks that can replace a message they posted
+type Editor interface {
+	Edit(Posted, Message) error
+}
+
+// Config holds the daemon's options for the sinks that need them
+type Config struct {
+	// SlackToken returns the token used to post with slack's web api and for
+	// direct messages. It's called for each message so the token can be
+	// reloaded.
+	SlackToken func() string
+
+	SMTPAddress  string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+
+	MatrixHomeserver  string
+	MatrixAccessToken string
+
+	// HTTPClient is used for every request, it defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// New returns the sinks keyed by the name projects use for them in their sink
+// option, along with the SlackDM sink
+func New(cfg Config) map[string]Sink {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	token := cfg.SlackToken
+	if token == nil {
+		token = func() string { return "" }
+	}
+	return map[string]Sink{
+		project.SinkSlack:      Slack{client: client},
+		project.SinkDiscord:    Discord{client: client},
+		project.SinkRocketChat: RocketChat{client: client},
+		project.SinkEmail: Email{
+			addr:     cfg.SMTPAddress,
+			from:     cfg.SMTPFrom,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+		},
+		project.SinkMatrix: Matrix{
+			client:      client,
+			homeserver:  cfg.MatrixHomeserver,
+			accessToken: cfg.MatrixAccessToken,
+		},
+		project.SinkSlackAPI: SlackAPI{client: client, token: token},
+		SlackDMName:          SlackAPI{client: client, token: token},
+	}
+}
+
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// Permanent wraps the error to indicate that delivering the message will never
+// succeed so it shouldn't be retried
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent returns true if the error was returned from Permanent
+func IsPermanent(err error) bool {
+	var perr permanentError
+	return errors.As(err, &perr)
+}
@@ -0,0 +1,64 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// postJSON posts v to the webhook and returns an error unless it responds with
+// a 2xx. The error is permanent if the webhook doesn't exist or is archived.
+func postJSON(client *http.Client, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// we can't magically marshal it later
+		return Permanent(err)
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	var sbody string
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		sbody = string(body)
+		if len(sbody) > 250 {
+			sbody = sbody[:250]
+		}
+	}
+	err = llog.ErrWithKV(errors.New("unexpected status posting to webhook"), llog.KV{
+		"status": resp.StatusCode,
+		"body":   sbody,
+	})
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return Permanent(err)
+	}
+	return err
+}
+
+// Slack posts messages to a slack incoming webhook
+type Slack struct {
+	client *http.Client
+}
+
+// Deliver implements the Sink interface
+func (s Slack) Deliver(m Message) error {
+	if m.WebhookURL == "" {
+		return nil
+	}
+	return postJSON(s.client, m.WebhookURL, m.Message)
+}
+
+// Capabilities implements the Sink interface
+func (Slack) Capabilities() Capabilities {
+	return Capabilities{Mentions: true}
+}
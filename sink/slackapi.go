@@ -0,0 +1,112 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/go-llog"
+)
+
+// SlackDMName is the name of the sink for direct messages. It isn't a project
+// sink, it's only used for the direct messages users opt into.
+const SlackDMName = "slack-dm"
+
+var (
+	// slackPostMessageURL is slack's api for posting a message as the bot
+	slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+
+	// slackUpdateURL is slack's api for replacing a message the bot posted
+	slackUpdateURL = "https://slack.com/api/chat.update"
+)
+
+// SlackAPI posts messages with slack's web api using the slack-token instead of
+// a webhook so it can report where each message was posted. The message's
+// Channel is a channel or, for direct messages, a user's id.
+type SlackAPI struct {
+	client *http.Client
+	token  func() string
+}
+
+// slackAPIResponse is the part of slack's response that we use
+type slackAPIResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// call posts v as json to slack's api at u
+func (s SlackAPI) call(u string, v interface{}) (slackAPIResponse, error) {
+	var res slackAPIResponse
+	token := s.token()
+	if token == "" {
+		return res, Permanent(errors.New("slack-token is not set"))
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return res, Permanent(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewBuffer(b))
+	if err != nil {
+		return res, Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, llog.ErrWithKV(errors.New("unexpected status from slack api"), llog.KV{
+			"status": resp.StatusCode,
+			"url":    u,
+		})
+	}
+	// slack responds with a 200 even if the call failed
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, err
+	}
+	if res.OK {
+		return res, nil
+	}
+	err = llog.ErrWithKV(errors.New("error from slack api"), llog.KV{"error": res.Error, "url": u})
+	switch res.Error {
+	case "ratelimited", "internal_error", "service_unavailable", "request_timeout":
+		return res, err
+	}
+	return res, Permanent(err)
+}
+
+// Post implements the Poster interface
+func (s SlackAPI) Post(m Message) (Posted, error) {
+	res, err := s.call(slackPostMessageURL, m.Message)
+	if err != nil {
+		return Posted{}, err
+	}
+	return Posted{Channel: res.Channel, TS: res.TS}, nil
+}
+
+// Edit implements the Editor interface
+func (s SlackAPI) Edit(p Posted, m Message) error {
+	_, err := s.call(slackUpdateURL, struct {
+		Channel     string              `json:"channel"`
+		TS          string              `json:"ts"`
+		Attachments []events.Attachment `json:"attachments"`
+	}{p.Channel, p.TS, []events.Attachment{m.Attachment}})
+	return err
+}
+
+// Deliver implements the Sink interface
+func (s SlackAPI) Deliver(m Message) error {
+	_, err := s.Post(m)
+	return err
+}
+
+// Capabilities implements the Sink interface
+func (SlackAPI) Capabilities() Capabilities {
+	return Capabilities{Mentions: true}
+}
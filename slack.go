@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/nlopes/slack"
+)
+
+var (
+	// slackUserTTL is how long a looked up user is cached before it's refreshed
+	slackUserTTL = time.Hour
+
+	// slackMissTTL is how long we wait before looking up an email that didn't
+	// have a user again, this is shorter so new users get mentioned quickly
+	slackMissTTL = 5 * time.Minute
+
+	// slackRefreshInterval is how often the cache is checked for stale users
+	slackRefreshInterval = 10 * time.Minute
+
+	// slackLookupWait is how long a message waits for a user to be looked up
+	// before it's sent without mentioning them, the lookup still finishes in
+	// the background so later messages mention them
+	slackLookupWait = 2 * time.Second
+
+	// slackDownBackoff is how long users aren't looked up after a lookup fails
+	// so that messages aren't each delayed while slack is having problems
+	slackDownBackoff = time.Minute
+)
+
+// slackUser is a cached result of looking up a user by their email. An empty
+// id means that there is no slack user with that email.
+type slackUser struct {
+	id      string
+	fetched time.Time
+}
+
+// slackState holds various slack metadata that can be used to improve messages
+type slackState struct {
+	client *http.Client
+
+	l           sync.Mutex
+	token       string
+	sapi        *slack.Client
+	emailToUser map[string]slackUser
+	// lookups is closed once the email's lookup finishes
+	lookups map[string]chan struct{}
+	// downUntil is when users can be looked up again after a lookup failed
+	downUntil time.Time
+}
+
+func newSlackState(token string, client *http.Client) *slackState {
+	s := &slackState{
+		client:      client,
+		emailToUser: map[string]slackUser{},
+		lookups:     map[string]chan struct{}{},
+	}
+	s.SetToken(token)
+	return s
+}
+
+// SetToken replaces the slack token, an empty token disables looking up users
+func (s *slackState) SetToken(token string) {
+	var sapi *slack.Client
+	if token != "" {
+		sapi = slack.New(token, slack.OptionHTTPClient(s.client))
+	}
+	s.l.Lock()
+	s.token = token
+	s.sapi = sapi
+	s.l.Unlock()
+}
+
+// Token returns the current slack token
+func (s *slackState) Token() string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.token
+}
+
+// api returns the current slack client, which is nil if there's no token
+func (s *slackState) api() *slack.Client {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.sapi
+}
+
+// lookup asks slack for the user with the given email and caches the result
+func (s *slackState) lookup(email string) (slackUser, error) {
+	u := slackUser{fetched: time.Now()}
+	su, err := s.api().GetUserByEmail(email)
+	if err != nil {
+		// users_not_found isn't really an error, there's just no user with that
+		// email and we cache that too so we don't keep asking
+		if err.Error() != "users_not_found" {
+			s.l.Lock()
+			s.downUntil = time.Now().Add(slackDownBackoff)
+			s.l.Unlock()
+			return u, llog.ErrWithKV(err, llog.KV{"email": email})
+		}
+	} else {
+		u.id = su.ID
+	}
+	s.l.Lock()
+	s.emailToUser[email] = u
+	s.l.Unlock()
+	return u, nil
+}
+
+// lookupAsync looks up the user with the email in the background, unless it's
+// already being looked up, and returns a channel that's closed once it's done
+func (s *slackState) lookupAsync(email string) <-chan struct{} {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if done, ok := s.lookups[email]; ok {
+		return done
+	}
+	done := make(chan struct{})
+	s.lookups[email] = done
+	go func() {
+		if _, err := s.lookup(email); err != nil {
+			llog.Error("error looking up slack user", llog.ErrKV(err))
+		}
+		s.l.Lock()
+		delete(s.lookups, email)
+		s.l.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// down returns true if a lookup recently failed
+func (s *slackState) down() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return time.Now().Before(s.downUntil)
+}
+
+// refreshLoop periodically looks up stale users again so MentionUser rarely
+// has to wait on slack
+func (s *slackState) refreshLoop() {
+	tick := time.NewTicker(slackRefreshInterval)
+	defer tick.Stop()
+	for range tick.C {
+		// the token can be added later so check on every tick
+		if s.api() == nil || s.down() {
+			continue
+		}
+		var stale []string
+		s.l.Lock()
+		for email, u := range s.emailToUser {
+			if time.Since(u.fetched) > slackUserTTL {
+				stale = append(stale, email)
+			}
+		}
+		s.l.Unlock()
+		for _, email := range stale {
+			if _, err := s.lookup(email); err != nil {
+				llog.Error("error refreshing slack user", llog.ErrKV(err))
+			}
+		}
+		llog.Debug("refreshed slack users", llog.KV{"numUsers": len(stale)})
+	}
+}
+
+// ping makes sure that the slack api is reachable with the token
+func (s *slackState) ping() error {
+	sapi := s.api()
+	if sapi == nil {
+		return nil
+	}
+	_, err := sapi.AuthTest()
+	return err
+}
+
+// UserID returns the id of the slack user with the email or an empty string if
+// there isn't one or there's no token. If the user isn't cached and slack is
+// slow or failing, an empty string is returned rather than holding up the
+// message.
+func (s *slackState) UserID(email string) string {
+	if s.api() == nil || email == "" {
+		return ""
+	}
+	email = strings.ToLower(email)
+	llog.Debug("looking up user", llog.KV{"email": email})
+	s.l.Lock()
+	u, ok := s.emailToUser[email]
+	s.l.Unlock()
+	// if we previously didn't find them, try again in case they were just added
+	if ok && (u.id != "" || time.Since(u.fetched) <= slackMissTTL) {
+		return u.id
+	}
+	if s.down() {
+		return u.id
+	}
+	select {
+	case <-s.lookupAsync(email):
+	case <-time.After(slackLookupWait):
+		llog.Warn("slack user lookup is slow, not waiting for it", llog.KV{"email": email})
+		return u.id
+	}
+	s.l.Lock()
+	u = s.emailToUser[email]
+	s.l.Unlock()
+	return u.id
+}
+
+// Email returns the email of the slack user with the id
+func (s *slackState) Email(id string) (string, error) {
+	sapi := s.api()
+	if sapi == nil {
+		return "", errors.New("slack-token is not set")
+	}
+	u, err := sapi.GetUserInfo(id)
+	if err != nil {
+		return "", llog.ErrWithKV(err, llog.KV{"user": id})
+	}
+	return u.Profile.Email, nil
+}
+
+// LookupUserID is like UserID but waits for the lookup and returns an error if
+// it fails, rather than an empty string, for callers that aren't holding up a
+// message
+func (s *slackState) LookupUserID(email string) (string, error) {
+	if s.api() == nil {
+		return "", errors.New("slack-token is not set")
+	}
+	email = strings.ToLower(email)
+	s.l.Lock()
+	u, ok := s.emailToUser[email]
+	s.l.Unlock()
+	if ok && time.Since(u.fetched) <= slackMissTTL {
+		return u.id, nil
+	}
+	u, err := s.lookup(email)
+	return u.id, err
+}
+
+// UsergroupMembers returns the ids of the users in the slack usergroup
+func (s *slackState) UsergroupMembers(id string) ([]string, error) {
+	sapi := s.api()
+	if sapi == nil {
+		return nil, errors.New("slack-token is not set")
+	}
+	ids, err := sapi.GetUserGroupMembers(id)
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"usergroup": id})
+	}
+	return ids, nil
+}
+
+// SetUsergroupMembers replaces the users in the slack usergroup
+func (s *slackState) SetUsergroupMembers(id string, userIDs []string) error {
+	sapi := s.api()
+	if sapi == nil {
+		return errors.New("slack-token is not set")
+	}
+	if _, err := sapi.UpdateUserGroupMembers(id, strings.Join(userIDs, ",")); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"usergroup": id})
+	}
+	return nil
+}
+
+// MentionUser either returns just their name or it @ mentions them
+// MentionUser implements the events.MessageEnricher interface
+func (s *slackState) MentionUser(email string, name string) string {
+	if id := s.UserID(email); id != "" {
+		return fmt.Sprintf("<@%s>", id)
+	}
+	return name
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/levenlabs/go-llog"
+)
+
+// slackConnectionsOpenURL is slack's api for getting a socket mode url
+var slackConnectionsOpenURL = "https://slack.com/api/apps.connections.open"
+
+// socketEnvelope is a message from slack's socket mode connection
+type socketEnvelope struct {
+	Type       string          `json:"type"`
+	EnvelopeID string          `json:"envelope_id"`
+	Reason     string          `json:"reason"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// socketMode receives events and slash commands from slack over a websocket,
+// using the app-level slack-app-token, so no public endpoint is needed. They're
+// passed to handleEvent and handleCommand after they're acknowledged.
+type socketMode struct {
+	token         string
+	client        *http.Client
+	handleEvent   func(event json.RawMessage)
+	handleCommand func(cmd slashCommand)
+	// handlers tracks the running handlers, if it's set, so they can be waited
+	// for. It must already be counting run.
+	handlers *sync.WaitGroup
+}
+
+// open asks slack for the url to connect to
+func (sm socketMode) open() (string, error) {
+	req, err := http.NewRequest(http.MethodPost, slackConnectionsOpenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+sm.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := sm.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		URL   string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", llog.ErrWithKV(err, llog.KV{"status": resp.StatusCode})
+	}
+	if !res.OK {
+		return "", llog.ErrWithKV(errors.New("error opening socket mode connection"), llog.KV{"error": res.Error})
+	}
+	return res.URL, nil
+}
+
+// connect reads events from a single connection until slack asks us to
+// reconnect, the connection fails or the context is cancelled
+func (sm socketMode) connect(ctx context.Context) error {
+	u, err := sm.open()
+	if err != nil {
+		return err
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	for {
+		var env socketEnvelope
+		if err := conn.ReadJSON(&env); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		switch env.Type {
+		case "hello":
+			llog.Info("connected to slack socket mode")
+		case "disconnect":
+			llog.Debug("slack socket mode asked to reconnect", llog.KV{"reason": env.Reason})
+			return nil
+		}
+		if env.EnvelopeID == "" {
+			continue
+		}
+		// slack retries the event if it isn't acknowledged within 3 seconds
+		if err := conn.WriteJSON(struct {
+			EnvelopeID string `json:"envelope_id"`
+		}{env.EnvelopeID}); err != nil {
+			return err
+		}
+		sm.dispatch(env)
+	}
+}
+
+// dispatch passes the envelope's event or slash command to its handler
+func (sm socketMode) dispatch(env socketEnvelope) {
+	switch env.Type {
+	case "events_api":
+		var p struct {
+			Event json.RawMessage `json:"event"`
+		}
+		if err := json.Unmarshal(env.Payload, &p); err != nil || len(p.Event) == 0 {
+			llog.Warn("invalid slack event payload", llog.KV{"envelopeID": env.EnvelopeID})
+			return
+		}
+		if sm.handleEvent != nil {
+			sm.spawn(func() { sm.handleEvent(p.Event) })
+		}
+	case "slash_commands":
+		var cmd slashCommand
+		if err := json.Unmarshal(env.Payload, &cmd); err != nil {
+			llog.Warn("invalid slack slash command payload", llog.ErrKV(err), llog.KV{"envelopeID": env.EnvelopeID})
+			return
+		}
+		if sm.handleCommand != nil {
+			sm.spawn(func() { sm.handleCommand(cmd) })
+		}
+	}
+}
+
+// spawn runs the handler in its own goroutine, tracked by handlers
+func (sm socketMode) spawn(handle func()) {
+	if sm.handlers == nil {
+		go handle()
+		return
+	}
+	sm.handlers.Add(1)
+	go func() {
+		defer sm.handlers.Done()
+		handle()
+	}()
+}
+
+// run connects to slack's socket mode, reconnecting as needed, until the
+// context is cancelled
+func (sm socketMode) run(ctx context.Context) {
+	b := backoff{min: time.Second, max: time.Minute}
+	for ctx.Err() == nil {
+		start := time.Now()
+		if err := sm.connect(ctx); err != nil {
+			llog.Error("error in slack socket mode connection", llog.ErrKV(err))
+		}
+		// a connection that lasted a while was healthy so start over
+		if time.Since(start) > time.Minute {
+			b.reset()
+		}
+		select {
+		case <-time.After(b.next()):
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/go-llog"
+)
+
+const (
+	// sourceSSH streams events over ssh
+	sourceSSH = "ssh"
+
+	// sourcePoll polls the REST api for events
+	sourcePoll = "poll"
+)
+
+// passphraseEnv is the environment variable that holds the private key's
+// passphrase if it's not in the config
+const passphraseEnv = "GERRIT_SLACK_KEY_PASSPHRASE"
+
+var (
+	sshRetryMinDelay = time.Second
+	sshRetryMaxDelay = 2 * time.Minute
+)
+
+// stateEventTypes aren't posted but are streamed along with the types that
+// have handlers since they change the state of changes and refs
+var stateEventTypes = []string{
+	gerritssh.EventTypeChangeAbandoned,
+	gerritssh.EventTypeChangeRestored,
+	gerritssh.EventTypeReviewerDeleted,
+	gerritssh.EventTypeRefUpdated,
+}
+
+// streamedEventTypes returns the types of events to stream
+func streamedEventTypes() []string {
+	set := map[string]bool{}
+	for _, typ := range append(events.Types(), stateEventTypes...) {
+		set[typ] = true
+	}
+	types := make([]string, 0, len(set))
+	for typ := range set {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func newSSHClient(cfg config) (*gerritssh.Client, error) {
+	var sshc *gerritssh.Client
+	var err error
+	if cfg.SSHAgent {
+		sshc, err = gerritssh.NewAgentClient(cfg.SSHAddress, cfg.Username, []byte(cfg.HostKey))
+	} else {
+		var pk []byte
+		pk, err = ioutil.ReadFile(cfg.PrivateKeyPath)
+		if err != nil {
+			return nil, llog.ErrWithKV(err, llog.KV{"path": cfg.PrivateKeyPath})
+		}
+		passphrase := cfg.Passphrase
+		if passphrase == "" {
+			passphrase = os.Getenv(passphraseEnv)
+		}
+		sshc, err = gerritssh.NewClient(cfg.SSHAddress, cfg.Username, pk, []byte(passphrase), []byte(cfg.HostKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.KnownHosts != "" {
+		if err := sshc.SetKnownHostsFile(cfg.KnownHosts); err != nil {
+			return nil, err
+		}
+	}
+	sshc.KeepAliveInterval = cfg.SSHKeepAliveInterval
+	return sshc, nil
+}
+
+// lastEvents is the events that were streamed in the same second as the last
+// one. Events are recovered from that second on after reconnecting, since
+// others could have happened in it, so these are skipped.
+type lastEvents struct {
+	l   sync.Mutex
+	ts  int64
+	evs []gerritssh.Event
+}
+
+// add records the streamed event
+func (le *lastEvents) add(e gerritssh.Event) {
+	le.l.Lock()
+	defer le.l.Unlock()
+	if e.TSCreated != le.ts {
+		le.ts = e.TSCreated
+		le.evs = nil
+	}
+	le.evs = append(le.evs, e)
+}
+
+// get returns the time of the last streamed event and the events streamed in
+// that second
+func (le *lastEvents) get() (int64, []gerritssh.Event) {
+	le.l.Lock()
+	defer le.l.Unlock()
+	return le.ts, append([]gerritssh.Event(nil), le.evs...)
+}
+
+// skipStreamed returns the recovered events without the ones at ts that were
+// already streamed. The recovered events' timestamps come from the REST api,
+// which can differ from the streamed ones', so they aren't compared.
+func skipStreamed(evs []gerritssh.Event, ts int64, streamed []gerritssh.Event) []gerritssh.Event {
+	keys := map[string]bool{}
+	for _, e := range streamed {
+		e.TSCreated = 0
+		keys[dedupKey(e)] = true
+	}
+	var skipped []gerritssh.Event
+	for _, e := range evs {
+		key := e
+		key.TSCreated = 0
+		if e.TSCreated == ts && keys[dedupKey(key)] {
+			continue
+		}
+		skipped = append(skipped, e)
+	}
+	return skipped
+}
+
+// sshSource streams events over ssh to ech until the context is cancelled
+func sshSource(ctx context.Context, client *gerrit.Client, sshc *gerritssh.Client, ech chan<- gerritssh.Event) {
+	// keep track of the last events we got so we can recover any events that
+	// were missed while reconnecting
+	var last lastEvents
+	sshCh := make(chan gerritssh.Event, 10)
+	forwardDone := make(chan struct{})
+	go func() {
+		for e := range sshCh {
+			last.add(e)
+			ech <- e
+		}
+		close(forwardDone)
+	}()
+
+	// only stream the events we can handle
+	types := streamedEventTypes()
+	llog.Info("streaming events", llog.KV{"types": strings.Join(types, ",")})
+	b := backoff{min: sshRetryMinDelay, max: sshRetryMaxDelay}
+	// recoverWG tracks the goroutines recovering missed events which send to ech
+	var recoverWG sync.WaitGroup
+	for ctx.Err() == nil {
+		start := time.Now()
+		if ts, streamed := last.get(); ts > 0 {
+			recoverWG.Add(1)
+			go func() {
+				defer recoverWG.Done()
+				recoverMissedEvents(ctx, client, ts, streamed, start, ech)
+			}()
+		}
+		if err := sshc.StreamEvents(ctx, sshCh, types...); err != nil && ctx.Err() == nil {
+			llog.Error("error streaming events", llog.ErrKV(err))
+		}
+		// if we were connected for a while then this isn't a repeated failure
+		if time.Since(start) > sshRetryMaxDelay {
+			b.reset()
+		}
+		select {
+		case <-time.After(b.next()):
+		case <-ctx.Done():
+		}
+	}
+	close(sshCh)
+	<-forwardDone
+	recoverWG.Wait()
+}
+
+// recoverMissedEvents sends any events that happened between the last streamed
+// event, at ts, and until to ech, other than the streamed ones, unless the
+// context is cancelled
+func recoverMissedEvents(ctx context.Context, client *gerrit.Client, ts int64, streamed []gerritssh.Event, until time.Time, ech chan<- gerritssh.Event) {
+	since := time.Unix(ts, 0)
+	evs, err := gerritssh.MissedEvents(client, since, until)
+	if err != nil {
+		llog.Error("error recovering missed events", llog.ErrKV(err), llog.KV{"since": since})
+		return
+	}
+	evs = skipStreamed(evs, ts, streamed)
+	llog.Info("recovered missed events", llog.KV{"since": since, "numEvents": len(evs)})
+	for _, e := range evs {
+		select {
+		case ech <- e:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+func TestSkipStreamed(t *testing.T) {
+	change := gerritssh.EventChange{Project: "proj", Number: 1}
+	comment := func(ts int64, username string) gerritssh.Event {
+		return gerritssh.Event{
+			Type:      gerritssh.EventTypeCommentAdded,
+			Change:    change,
+			PatchSet:  gerritssh.EventPatchSet{Number: 1},
+			Author:    gerritssh.EventAccount{Username: username},
+			TSCreated: ts,
+		}
+	}
+	// alice's comment was the last streamed event
+	streamed := []gerritssh.Event{comment(1000, "alice")}
+	tests := []struct {
+		name string
+		e    gerritssh.Event
+		skip bool
+	}{
+		{"streamed", comment(1000, "alice"), true},
+		{"same second", comment(1000, "bob"), false},
+		{"later", comment(1001, "alice"), false},
+		{"other patch set", func() gerritssh.Event {
+			e := comment(1000, "alice")
+			e.PatchSet.Number = 2
+			return e
+		}(), false},
+	}
+	for _, test := range tests {
+		evs := skipStreamed([]gerritssh.Event{test.e}, 1000, streamed)
+		if skipped := len(evs) == 0; skipped != test.skip {
+			t.Errorf("%s: skipped = %v, want %v", test.name, skipped, test.skip)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+)
+
+// spooledMessage is a pending message as it's written to the spool file.
+// events.Message doesn't unmarshal the way it marshals so the attachment is
+// stored separately.
+type spooledMessage struct {
+	Channel    string            `json:"channel"`
+	Attachment events.Attachment `json:"attachment"`
+	WebhookURL string            `json:"webhookURL"`
+	SourceType string            `json:"sourceType"`
+	Sink       string            `json:"sink,omitempty"`
+	// WebhookURLSecret is the name of the secret to resolve WebhookURL from
+	WebhookURLSecret string   `json:"webhookURLSecret,omitempty"`
+	Recipients       []string `json:"recipients,omitempty"`
+	// Change is the change the message is for, if any
+	Change         store.Change `json:"change"`
+	ThreadTS       string       `json:"threadTS,omitempty"`
+	ReplyBroadcast bool         `json:"replyBroadcast,omitempty"`
+	EditTS         string       `json:"editTS,omitempty"`
+}
+
+func newSpooledMessage(s webhookSubmit) spooledMessage {
+	return spooledMessage{
+		Channel:    s.Channel,
+		Attachment: s.Attachment,
+		WebhookURL: s.WebhookURL,
+		SourceType: s.SourceType,
+		Sink:       s.ProjectConfig.Sink,
+
+		WebhookURLSecret: s.ProjectConfig.WebhookURLSecret,
+		Recipients:       s.Recipients,
+		Change:           s.Change,
+		ThreadTS:         s.ThreadTS,
+		ReplyBroadcast:   s.ReplyBroadcast,
+		EditTS:           s.EditTS,
+	}
+}
+
+// submit returns the message to post. It only keeps its project's sink and
+// webhookurl-secret so it isn't held for quiet hours.
+func (sm spooledMessage) submit() webhookSubmit {
+	pcfg := project.DefaultConfig()
+	if sm.Sink != "" {
+		pcfg.Sink = sm.Sink
+	}
+	pcfg.WebhookURLSecret = sm.WebhookURLSecret
+	return webhookSubmit{
+		Message: events.Message{
+			Attachment:     sm.Attachment,
+			Channel:        sm.Channel,
+			ThreadTS:       sm.ThreadTS,
+			ReplyBroadcast: sm.ReplyBroadcast,
+		},
+		WebhookURL:    sm.WebhookURL,
+		SourceType:    sm.SourceType,
+		ProjectConfig: pcfg,
+		Recipients:    sm.Recipients,
+		Change:        sm.Change,
+		EditTS:        sm.EditTS,
+	}
+}
+
+// writeSpool writes the messages to the file at path, one per line, replacing
+// anything that was there. If there are no messages the file is removed.
+func writeSpool(path string, ss []webhookSubmit) error {
+	if len(ss) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return llog.ErrWithKV(err, llog.KV{"path": path})
+		}
+		return nil
+	}
+	tmp := path + ".tmp"
+	// the webhook urls are secret so only we can read the file
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": tmp})
+	}
+	enc := json.NewEncoder(f)
+	for _, s := range ss {
+		if err = enc.Encode(newSpooledMessage(s)); err != nil {
+			f.Close()
+			return llog.ErrWithKV(err, llog.KV{"path": tmp})
+		}
+	}
+	if err := f.Close(); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": tmp})
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	return nil
+}
+
+// readSpool reads the messages from the spool file at path and removes it, see
+// spooledMessage.submit
+func readSpool(path string) ([]webhookSubmit, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	defer f.Close()
+	var ss []webhookSubmit
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		var sm spooledMessage
+		if err := json.Unmarshal(sc.Bytes(), &sm); err != nil {
+			llog.Warn("skipping invalid spooled message", llog.ErrKV(err), llog.KV{"path": path})
+			continue
+		}
+		ss = append(ss, sm.submit())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	return ss, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+)
+
+// stateCleanupInterval is how often closed changes are expired from the state
+// store
+var stateCleanupInterval = time.Hour
+
+// stateCleanupLoop expires the changes in the state store that were merged or
+// abandoned more than ttl ago, and logs the store's size, until the context is
+// cancelled
+func stateCleanupLoop(ctx context.Context, changes *store.Store, ttl time.Duration) {
+	tick := time.NewTicker(stateCleanupInterval)
+	defer tick.Stop()
+	for {
+		n, err := changes.Expire(time.Now().Add(-ttl))
+		if err != nil {
+			llog.Error("error expiring changes from state store", llog.ErrKV(err))
+		}
+		st, err := changes.Stats()
+		if err != nil {
+			llog.Error("error getting state store stats", llog.ErrKV(err))
+		} else {
+			llog.Info("cleaned up state store", llog.KV{
+				"numExpired": n,
+				"numChanges": st.Changes,
+				"bytes":      st.Bytes,
+			})
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
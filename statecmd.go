@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/levenlabs/gerrit-slack/store"
+)
+
+// runState exports or imports the state store at path, to or from the file
+// argument or stdout/stdin, and returns the exit code. The daemon has to be
+// stopped since only one process can open the store.
+func runState(path, cmd, file string) int {
+	if path == "" {
+		fmt.Println("state-path isn't set")
+		return 2
+	}
+	if cmd != "export" && cmd != "import" {
+		fmt.Println("usage: gerrit-slack state export|import [file]")
+		return 2
+	}
+	s, err := store.Open(path)
+	if err != nil {
+		fmt.Printf("error opening state store: %s\n", err)
+		return 1
+	}
+	defer s.Close()
+
+	if cmd == "export" {
+		var w io.Writer = os.Stdout
+		if file != "" {
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				fmt.Printf("error creating %s: %s\n", file, err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := s.Export(w); err != nil {
+			fmt.Printf("error exporting state: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	var r io.Reader = os.Stdin
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Printf("error opening %s: %s\n", file, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := s.Import(r)
+	if err != nil {
+		fmt.Printf("error importing state: %s\n", err)
+		return 1
+	}
+	fmt.Printf("imported %d changes\n", n)
+	return 0
+}
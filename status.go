@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminClient returns an http client and base url for the admin api at addr
+func adminClient(addr string) (*http.Client, string) {
+	c := &http.Client{Timeout: 10 * time.Second}
+	if path := strings.TrimPrefix(addr, adminUnixPrefix); path != addr {
+		c.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return c, "http://unix"
+	}
+	return c, "http://" + addr
+}
+
+// runStatus prints the health of the daemon serving the admin api at addr and
+// returns the exit code, which is nonzero if it's unhealthy
+func runStatus(addr string) int {
+	if addr == "" {
+		fmt.Println("admin-address isn't set")
+		return 2
+	}
+	c, base := adminClient(addr)
+	resp, err := c.Get(base + "/healthz")
+	if err != nil {
+		fmt.Printf("error connecting to admin api: %s\n", err)
+		return 2
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK       bool `json:"ok"`
+		Pending  int  `json:"pending"`
+		Handling int  `json:"handling"`
+		Queued   int  `json:"queued"`
+		Stream   *struct {
+			Connected bool      `json:"connected"`
+			Since     time.Time `json:"since"`
+			LastEvent time.Time `json:"lastEvent"`
+		} `json:"stream"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		fmt.Printf("error decoding admin api response: %s\n", err)
+		return 2
+	}
+	if res.Stream != nil {
+		state := "disconnected"
+		if res.Stream.Connected {
+			state = "connected"
+		}
+		fmt.Printf("stream:     %s since %s\n", state, res.Stream.Since.Format(time.RFC3339))
+		if res.Stream.LastEvent.IsZero() {
+			fmt.Println("last event: never")
+		} else {
+			fmt.Printf("last event: %s (%s ago)\n", res.Stream.LastEvent.Format(time.RFC3339), time.Since(res.Stream.LastEvent).Round(time.Second))
+		}
+	}
+	fmt.Printf("pending:    %d\n", res.Pending)
+	fmt.Printf("handling:   %d (%d queued)\n", res.Handling, res.Queued)
+	if !res.OK {
+		fmt.Println("status:     unhealthy")
+		return 1
+	}
+	fmt.Println("status:     healthy")
+	return 0
+}
@@ -0,0 +1,410 @@
+// Package store persists what was posted for each change, and the change's
+// last known status, so that later messages can refer back to it
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/go-llog"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// changesBucket holds a Record for each change keyed by Change.key
+	changesBucket = []byte("changes")
+
+	// metaBucket holds things about the daemon itself, like heartbeatKey
+	metaBucket = []byte("meta")
+
+	// heartbeatKey is the last time the daemon was known to be running
+	heartbeatKey = []byte("heartbeat")
+)
+
+// Change identifies a change across projects
+type Change struct {
+	Project string `json:"project"`
+	Number  int64  `json:"number"`
+}
+
+// key is the same as gerrit's <project>~<number> change id
+func (c Change) key() []byte {
+	return []byte(fmt.Sprintf("%s~%d", c.Project, c.Number))
+}
+
+// Record is what's known about a change
+type Record struct {
+	// Channel and TS identify the first message posted for the change. They're
+	// empty unless it was posted to a sink that reports them, like slack-api.
+	// Destination is the name of the project's destination it was posted to.
+	Destination string    `json:"destination,omitempty"`
+	Channel     string    `json:"channel,omitempty"`
+	TS          string    `json:"ts,omitempty"`
+	Posted      time.Time `json:"posted,omitempty"`
+	// Attachment is the first message's content so it can be edited later
+	Attachment *events.Attachment `json:"attachment,omitempty"`
+	// Status is the change's status as of the last event, like NEW or MERGED
+	Status  string    `json:"status,omitempty"`
+	Updated time.Time `json:"updated"`
+	// SubmittablePatchSet is the last patch set the owner was told could be
+	// submitted
+	SubmittablePatchSet int64 `json:"submittablePatchSet,omitempty"`
+	// Escalation is how far the change was escalated for not being reviewed
+	Escalation int `json:"escalation,omitempty"`
+}
+
+// Store is a bolt database of Records. A nil Store stores nothing so callers
+// don't need to check if one is configured.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens, or creates, the database at path. Only one process can have it
+// open at a time.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{changesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, llog.ErrWithKV(err, llog.KV{"path": path})
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Get returns the change's Record and false if there isn't one
+func (s *Store) Get(c Change) (Record, bool, error) {
+	var r Record
+	var ok bool
+	if s == nil {
+		return r, ok, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(changesBucket).Get(c.key())
+		if b == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(b, &r)
+	})
+	if err != nil {
+		return r, false, llog.ErrWithKV(err, llog.KV{"project": c.Project, "change": c.Number})
+	}
+	return r, ok, nil
+}
+
+// update calls fn with the change's Record, or an empty one, and saves it
+func (s *Store) update(c Change, fn func(*Record)) error {
+	if s == nil {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(changesBucket)
+		var r Record
+		if b := bkt.Get(c.key()); b != nil {
+			if err := json.Unmarshal(b, &r); err != nil {
+				return err
+			}
+		}
+		fn(&r)
+		r.Updated = time.Now()
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(c.key(), b)
+	})
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"project": c.Project, "change": c.Number})
+	}
+	return nil
+}
+
+// FindMessage returns the change whose first message is the one at ts in the
+// channel and false if there isn't one
+func (s *Store) FindMessage(channel, ts string) (Change, bool, error) {
+	var c Change
+	var ok bool
+	if s == nil || ts == "" {
+		return c, ok, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(changesBucket).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			// most records can be skipped without unmarshaling them
+			if !bytes.Contains(v, []byte(ts)) {
+				continue
+			}
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return llog.ErrWithKV(err, llog.KV{"key": string(k)})
+			}
+			if r.TS != ts || r.Channel != channel {
+				continue
+			}
+			var err error
+			c, err = parseKey(k)
+			ok = err == nil
+			return err
+		}
+		return nil
+	})
+	return c, ok, err
+}
+
+// SetPosted records the Destination, Channel, TS and Attachment of a message
+// posted for the change unless one was already recorded, so the Record always
+// points at the first message. It returns true if this was the first message.
+func (s *Store) SetPosted(c Change, posted Record) (bool, error) {
+	var first bool
+	err := s.update(c, func(r *Record) {
+		if r.TS != "" {
+			return
+		}
+		first = true
+		r.Destination = posted.Destination
+		r.Channel = posted.Channel
+		r.TS = posted.TS
+		r.Attachment = posted.Attachment
+		r.Posted = time.Now()
+	})
+	return first, err
+}
+
+// SetStatus records the change's latest status
+func (s *Store) SetStatus(c Change, status string) error {
+	return s.update(c, func(r *Record) {
+		r.Status = status
+	})
+}
+
+// SetSubmittable records that the change's patch set can be submitted and
+// returns false if that was already recorded. It always returns true if there's
+// no Store.
+func (s *Store) SetSubmittable(c Change, patchSet int64) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	var first bool
+	err := s.update(c, func(r *Record) {
+		first = r.SubmittablePatchSet != patchSet
+		r.SubmittablePatchSet = patchSet
+	})
+	return first, err
+}
+
+// SetEscalation records how far the change was escalated
+func (s *Store) SetEscalation(c Change, level int) error {
+	return s.update(c, func(r *Record) {
+		r.Escalation = level
+	})
+}
+
+// Heartbeat returns the last time passed to SetHeartbeat or a zero time if it
+// was never called
+func (s *Store) Heartbeat() (time.Time, error) {
+	var t time.Time
+	if s == nil {
+		return t, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket).Get(heartbeatKey)
+		if b == nil {
+			return nil
+		}
+		return t.UnmarshalText(b)
+	})
+	return t, err
+}
+
+// SetHeartbeat records that the daemon was running at t
+func (s *Store) SetHeartbeat(t time.Time) error {
+	if s == nil {
+		return nil
+	}
+	b, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(heartbeatKey, b)
+	})
+}
+
+// closedStatuses are the statuses of changes that won't get any more events,
+// other than being restored
+var closedStatuses = map[string]bool{
+	"MERGED":    true,
+	"ABANDONED": true,
+}
+
+// Expire removes the Records of merged and abandoned changes that weren't
+// updated since before and returns how many were removed
+func (s *Store) Expire(before time.Time) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	var n int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(changesBucket)
+		// deleting while iterating skips keys so they're deleted after
+		var expired [][]byte
+		err := bkt.ForEach(func(k, v []byte) error {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return llog.ErrWithKV(err, llog.KV{"key": string(k)})
+			}
+			if closedStatuses[r.Status] && r.Updated.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// Stats describes the size of the Store
+type Stats struct {
+	Changes int   `json:"changes"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Stats returns the number of Records and the size of the database file
+func (s *Store) Stats() (Stats, error) {
+	var st Stats
+	if s == nil {
+		return st, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		st.Changes = tx.Bucket(changesBucket).Stats().KeyN
+		st.Bytes = tx.Size()
+		return nil
+	})
+	return st, err
+}
+
+// exported is the json format of Export and Import
+type exported struct {
+	Heartbeat time.Time        `json:"heartbeat"`
+	Changes   []exportedRecord `json:"changes"`
+}
+
+type exportedRecord struct {
+	Change
+	Record Record `json:"record"`
+}
+
+// parseKey is the opposite of Change.key
+func parseKey(k []byte) (Change, error) {
+	var c Change
+	s := string(k)
+	i := strings.LastIndex(s, "~")
+	if i < 0 {
+		return c, llog.ErrWithKV(errors.New("invalid change key"), llog.KV{"key": s})
+	}
+	n, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return c, llog.ErrWithKV(err, llog.KV{"key": s})
+	}
+	c.Project = s[:i]
+	c.Number = n
+	return c, nil
+}
+
+// Export writes every Record, and the heartbeat, to w as json
+func (s *Store) Export(w io.Writer) error {
+	var ex exported
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket).Get(heartbeatKey); b != nil {
+			if err := ex.Heartbeat.UnmarshalText(b); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(changesBucket).ForEach(func(k, v []byte) error {
+			c, err := parseKey(k)
+			if err != nil {
+				return err
+			}
+			er := exportedRecord{Change: c}
+			if err := json.Unmarshal(v, &er.Record); err != nil {
+				return llog.ErrWithKV(err, llog.KV{"key": string(k)})
+			}
+			ex.Changes = append(ex.Changes, er)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ex)
+}
+
+// Import reads the json written by Export from r and stores its Records,
+// replacing any that already exist, and its heartbeat. It returns how many
+// Records were imported.
+func (s *Store) Import(r io.Reader) (int, error) {
+	var ex exported
+	if err := json.NewDecoder(r).Decode(&ex); err != nil {
+		return 0, err
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(changesBucket)
+		for _, er := range ex.Changes {
+			b, err := json.Marshal(er.Record)
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(er.Change.key(), b); err != nil {
+				return err
+			}
+		}
+		if ex.Heartbeat.IsZero() {
+			return nil
+		}
+		b, err := ex.Heartbeat.MarshalText()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(heartbeatKey, b)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ex.Changes), nil
+}
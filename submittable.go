@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+)
+
+// submittableMaxChanges is the most changes whose submittable patch set is
+// remembered when there's no state-path store
+var submittableMaxChanges = 10000
+
+// submittablePatchSets remembers the last patch set of each change that its
+// owner was told could be submitted, in place of the state-path store when
+// there isn't one
+type submittablePatchSets struct {
+	l         sync.Mutex
+	patchSets map[store.Change]int64
+}
+
+func newSubmittablePatchSets() *submittablePatchSets {
+	return &submittablePatchSets{patchSets: map[store.Change]int64{}}
+}
+
+// set records that the change's patch set can be submitted and returns false
+// if that was already recorded
+func (sp *submittablePatchSets) set(c store.Change, patchSet int64) bool {
+	sp.l.Lock()
+	defer sp.l.Unlock()
+	if sp.patchSets[c] == patchSet {
+		return false
+	}
+	// forget an arbitrary change to make room, at worst its owner is told
+	// again
+	if _, ok := sp.patchSets[c]; !ok && len(sp.patchSets) >= submittableMaxChanges {
+		for old := range sp.patchSets {
+			delete(sp.patchSets, old)
+			break
+		}
+	}
+	sp.patchSets[c] = patchSet
+	return true
+}
+
+// handleSubmittable notifies the change's owner if the event's vote made the
+// change submittable, as set by notify-owner-on-submittable. Each patch set is
+// only announced once.
+func (eh eventHandler) handleSubmittable(ctx context.Context, e gerritssh.Event, pcfg project.Config) {
+	if !events.MaybeSubmittable(e) {
+		return
+	}
+	ok, err := e.Submittable(eh.client)
+	if err != nil {
+		llog.Error("error checking if change is submittable", llog.ErrKV(err), e.KV())
+		return
+	} else if !ok {
+		return
+	}
+	change := store.Change{Project: e.Change.Project, Number: e.Change.Number}
+	if eh.changes == nil {
+		if !eh.submittable.set(change, e.PatchSet.Number) {
+			return
+		}
+	} else if first, err := eh.changes.SetSubmittable(change, e.PatchSet.Number); err != nil {
+		llog.Error("error recording change as submittable", llog.ErrKV(err), e.KV())
+	} else if !first {
+		return
+	}
+	eh.notifyOwner(ctx, e.Type, e.Change, pcfg, pcfg.NotifyOwnerOnSubmittable, func(mention string) events.Message {
+		return events.SubmittableMessage(e, mention)
+	})
+}
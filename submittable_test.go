@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/levenlabs/gerrit-slack/store"
+)
+
+func TestSubmittablePatchSetsSet(t *testing.T) {
+	defer func(n int) { submittableMaxChanges = n }(submittableMaxChanges)
+	submittableMaxChanges = 2
+	a := store.Change{Project: "proj", Number: 1}
+	b := store.Change{Project: "proj", Number: 2}
+	c := store.Change{Project: "other", Number: 1}
+	tests := []struct {
+		change   store.Change
+		patchSet int64
+		first    bool
+	}{
+		{a, 1, true},
+		{a, 1, false},
+		{a, 2, true},
+		{b, 1, true},
+		{b, 1, false},
+		{a, 2, false},
+		// one of a or b is forgotten to make room
+		{c, 1, true},
+		{c, 1, false},
+	}
+	sp := newSubmittablePatchSets()
+	for i, test := range tests {
+		if first := sp.set(test.change, test.patchSet); first != test.first {
+			t.Errorf("%d: set(%v, %d) = %v, want %v", i, test.change, test.patchSet, first, test.first)
+		}
+	}
+	if len(sp.patchSets) != submittableMaxChanges {
+		t.Errorf("remembered %d changes, want %d", len(sp.patchSets), submittableMaxChanges)
+	}
+}
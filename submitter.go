@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/project"
+	"github.com/levenlabs/gerrit-slack/sink"
+	"github.com/levenlabs/gerrit-slack/store"
+	"github.com/levenlabs/go-llog"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type webhookSubmit struct {
+	events.Message
+	WebhookURL    string
+	SourceType    string
+	ProjectConfig project.Config
+
+	// Recipients are who the message is for if the project's sink needs them
+	Recipients []string
+
+	// Change is the change the message is for, if any. Where the first message
+	// for a change is posted is recorded in the state store.
+	Change store.Change
+	// EditTS, if set, is the ts of the message in Channel to replace instead of
+	// posting a new one
+	EditTS string
+
+	// ctx holds the span of the event the message is for, if any
+	ctx context.Context
+
+	// failures is how many times posting the message has failed
+	failures int
+}
+
+// submitter delivers messages to their sinks and retries the ones that fail.
+// Each destination is posted to concurrently with the others.
+type submitter struct {
+	l        sync.Mutex
+	dests    map[string]*destination
+	destKeys []string
+
+	// concurrency is how many messages can be posted to a destination at once
+	concurrency int
+	workers     sync.WaitGroup
+
+	// spillDir is where each destination's oldest pending messages are
+	// written once it has more than maxPending, if set
+	spillDir   string
+	maxPending int
+
+	// muted is 1 if messages should be dropped instead of posted
+	muted   int32
+	flushCh chan struct{}
+
+	// stopping is closed by Stop and loopDone is closed once run stops taking
+	// messages from sch
+	stopping chan struct{}
+	loopDone chan struct{}
+
+	// dryRun logs messages instead of posting them
+	dryRun bool
+
+	// sinks are the sinks messages can be delivered to keyed by name
+	sinks map[string]sink.Sink
+
+	// secrets resolves webhookurl-secret
+	secrets *secretStore
+
+	// changes records where messages for changes were posted, it's nil unless
+	// state-path is set
+	changes *store.Store
+
+	// spoolPath is where messages that are still pending when we shut down
+	// are written, if set
+	spoolPath string
+	// spoolL is held while writing the spool file since both shutdown and
+	// main, if shutting down times out, write it
+	spoolL sync.Mutex
+
+	// permalinks posts the permalinks of the first messages for changes back
+	// to gerrit for projects with post-permalink set
+	permalinks *permalinker
+}
+
+// newSubmitter returns a submitter for the sinks with the spooled messages
+// pending
+func newSubmitter(sinks map[string]sink.Sink, cfg config) *submitter {
+	sub := &submitter{
+		dests:       map[string]*destination{},
+		concurrency: cfg.DestinationConcurrency,
+		spillDir:    cfg.PendingSpillDir,
+		maxPending:  cfg.MaxPendingMessages,
+		flushCh:     make(chan struct{}, 1),
+		stopping:    make(chan struct{}),
+		loopDone:    make(chan struct{}),
+		sinks:       sinks,
+		spoolPath:   cfg.SpoolPath,
+	}
+	if sub.spoolPath != "" {
+		ss, err := readSpool(sub.spoolPath)
+		if err != nil {
+			llog.Error("error reading spooled messages", llog.ErrKV(err))
+		} else if len(ss) > 0 {
+			llog.Info("loaded spooled messages", llog.KV{"numMessages": len(ss)})
+			sub.addPending(ss)
+		}
+	}
+	if sub.spillDir != "" {
+		// there are only spill files left over if we didn't shut down cleanly
+		ss, err := readPendingSpills(sub.spillDir)
+		if err != nil {
+			llog.Error("error reading spilled messages", llog.ErrKV(err))
+		}
+		if len(ss) > 0 {
+			llog.Info("loaded spilled messages", llog.KV{"numMessages": len(ss)})
+			sub.addPending(ss)
+		}
+	}
+	return sub
+}
+
+// addPending adds the messages to their destinations' pending messages
+func (sub *submitter) addPending(ss []webhookSubmit) {
+	for _, s := range ss {
+		sub.destination(s).add(s)
+	}
+}
+
+// Spool writes the pending messages, including the spilled ones, to the spool
+// file so they're sent once we start again. If there's no spool file they're
+// dropped.
+func (sub *submitter) Spool() {
+	sub.spoolL.Lock()
+	defer sub.spoolL.Unlock()
+	pending := sub.Pending()
+	if sub.spoolPath == "" {
+		if len(pending) > 0 {
+			llog.Warn("dropped pending messages", llog.KV{"numMessages": len(pending)})
+		}
+		sub.closeSpills()
+		return
+	}
+	if err := writeSpool(sub.spoolPath, pending); err != nil {
+		llog.Error("error spooling pending messages", llog.ErrKV(err), llog.KV{"numMessages": len(pending)})
+		return
+	}
+	if len(pending) > 0 {
+		llog.Info("spooled pending messages", llog.KV{"numMessages": len(pending), "path": sub.spoolPath})
+	}
+	sub.closeSpills()
+}
+
+// closeSpills removes the destinations' spill files once their messages were
+// spooled or dropped
+func (sub *submitter) closeSpills() {
+	for _, d := range sub.destinations() {
+		d.l.Lock()
+		if d.spill != nil {
+			d.spill.close()
+		}
+		d.l.Unlock()
+	}
+}
+
+// Pending returns a copy of the messages waiting to be retried
+func (sub *submitter) Pending() []webhookSubmit {
+	var pending []webhookSubmit
+	for _, d := range sub.destinations() {
+		pending = append(pending, d.allPending()...)
+	}
+	return pending
+}
+
+// Clear drops all of the pending messages and returns how many were dropped
+func (sub *submitter) Clear() int {
+	var n int
+	for _, d := range sub.destinations() {
+		n += d.clear()
+	}
+	return n
+}
+
+// Flush retries the pending messages now instead of waiting for the next retry
+func (sub *submitter) Flush() {
+	select {
+	case sub.flushCh <- struct{}{}:
+	default:
+		// a flush is already queued
+	}
+}
+
+// SetMuted sets whether messages are dropped instead of posted
+func (sub *submitter) SetMuted(muted bool) {
+	var v int32
+	if muted {
+		v = 1
+	}
+	atomic.StoreInt32(&sub.muted, v)
+}
+
+// Muted returns true if messages are being dropped instead of posted
+func (sub *submitter) Muted() bool {
+	return atomic.LoadInt32(&sub.muted) == 1
+}
+
+// failed records that posting the message failed and reports it once it has
+// failed too many times
+func failed(s webhookSubmit) webhookSubmit {
+	s.failures++
+	if s.failures == deliveryFailureThreshold {
+		reportError(errors.New("repeatedly failed to post message"), llog.KV{
+			"channel":  s.Channel,
+			"source":   s.SourceType,
+			"failures": s.failures,
+		})
+	}
+	return s
+}
+
+// sinkName returns the name of the sink the message is delivered to. Messages
+// without a project, like health alerts, go to slack.
+func sinkName(s webhookSubmit) string {
+	if s.ProjectConfig.Sink == "" {
+		return project.SinkSlack
+	}
+	return s.ProjectConfig.Sink
+}
+
+// publish delivers the message to its sink and returns false if it should be
+// retried
+func (sub *submitter) publish(s webhookSubmit) bool {
+	kv := llog.KV{
+		"channel": s.Channel,
+		"source":  s.SourceType,
+		"sink":    sinkName(s),
+	}
+	if sub.Muted() {
+		llog.Info("dropping message while muted", kv)
+		return true
+	}
+	sk, ok := sub.sinks[sinkName(s)]
+	if !ok {
+		llog.Error("unknown sink for message", kv)
+		return true
+	}
+	webhookURL := s.WebhookURL
+	if name := s.ProjectConfig.WebhookURLSecret; name != "" {
+		var err error
+		if webhookURL, err = sub.secrets.Secret(name); err != nil {
+			llog.Error("error resolving webhookurl-secret", llog.ErrKV(err), kv)
+			return false
+		}
+	}
+	if sub.dryRun {
+		b, _ := json.Marshal(s.Message)
+		llog.Info("dry run, not delivering message", kv, llog.KV{"payload": string(b)})
+		return true
+	}
+	_, span := startSpan(s.ctx, "post",
+		attribute.String("slack.channel", s.Channel),
+		attribute.String("sink", sinkName(s)),
+	)
+	defer span.End()
+	m := sink.Message{
+		Message:    s.Message,
+		WebhookURL: webhookURL,
+		Username:   s.ProjectConfig.Username,
+		Recipients: s.Recipients,
+	}
+	var err error
+	if s.EditTS != "" {
+		ed, ok := sk.(sink.Editor)
+		if !ok {
+			llog.Error("sink can't edit messages", kv)
+			return true
+		}
+		err = ed.Edit(sink.Posted{Channel: s.Channel, TS: s.EditTS}, m)
+	} else if p, ok := sk.(sink.Poster); ok && s.Change.Number > 0 {
+		var posted sink.Posted
+		if posted, err = p.Post(m); err == nil {
+			first, err := sub.changes.SetPosted(s.Change, store.Record{
+				Destination: s.ProjectConfig.DestinationName(),
+				Channel:     posted.Channel,
+				TS:          posted.TS,
+				Attachment:  &s.Attachment,
+			})
+			if err != nil {
+				llog.Error("error recording posted message", llog.ErrKV(err), kv)
+			} else if first && s.ProjectConfig.PostPermalink && sub.permalinks != nil {
+				go sub.permalinks.post(s.Change, posted)
+			}
+		}
+	} else {
+		err = sk.Deliver(m)
+	}
+	if err == nil {
+		llog.Info("delivered message", kv)
+		return true
+	}
+	span.RecordError(err)
+	llog.Error("error delivering message", llog.ErrKV(err), kv)
+	if sink.IsPermanent(err) {
+		reportError(err, kv)
+		return true
+	}
+	return false
+}
+
+// retry makes each destination retry its pending messages
+func (sub *submitter) retry() {
+	for _, d := range sub.destinations() {
+		d.signalRetry()
+	}
+}
+
+// run posts the messages sent on sch until sch is closed or Stop is called
+func (sub *submitter) run(sch <-chan webhookSubmit) {
+	closed := sub.loop(sch)
+	close(sub.loopDone)
+	if closed {
+		sub.shutdown()
+	}
+}
+
+// loop queues the messages sent on sch for their destinations and returns
+// true once sch is closed or false if Stop was called
+func (sub *submitter) loop(sch <-chan webhookSubmit) bool {
+	// retry pending messages every minute, this also sends any messages that
+	// were held during quiet hours
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			sub.retry()
+		case <-sub.flushCh:
+			sub.retry()
+		case <-sub.stopping:
+			return false
+		case s, ok := <-sch:
+			if !ok {
+				return true
+			}
+			d := sub.destination(s)
+			if s.ProjectConfig.Quiet(time.Now()) {
+				llog.Debug("holding message during quiet hours", llog.KV{
+					"channel": s.Channel,
+					"source":  s.SourceType,
+				})
+				d.add(s)
+				continue
+			}
+			// this only blocks if the destination is far behind
+			select {
+			case d.queue <- s:
+			case <-sub.stopping:
+				// the queued messages are older
+				d.drain()
+				d.add(s)
+				return false
+			}
+		}
+	}
+}
+
+// Stop stops posting messages, other than the ones that are already being
+// posted, and moves the queued messages, including the ones still in sch, to
+// the pending messages so Spool includes them
+func (sub *submitter) Stop(sch <-chan webhookSubmit) {
+	close(sub.stopping)
+	<-sub.loopDone
+	for _, d := range sub.destinations() {
+		d.drain()
+	}
+	for {
+		select {
+		case s, ok := <-sch:
+			if !ok {
+				return
+			}
+			sub.destination(s).add(s)
+		default:
+			return
+		}
+	}
+}
+
+// shutdown waits for the queued messages to be posted, makes one last attempt
+// at sending everything that's pending and spools whatever is left
+func (sub *submitter) shutdown() {
+	ds := sub.destinations()
+	for _, d := range ds {
+		close(d.queue)
+	}
+	sub.workers.Wait()
+	var wg sync.WaitGroup
+	for _, d := range ds {
+		wg.Add(1)
+		go func(d *destination) {
+			defer wg.Done()
+			sub.retryDestination(d, true)
+		}(d)
+	}
+	wg.Wait()
+	sub.Spool()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/levenlabs/gerrit-slack/events"
+	"github.com/levenlabs/gerrit-slack/sink"
+)
+
+// blockingSink blocks delivering messages until unblock is closed
+type blockingSink struct {
+	delivering chan struct{}
+	unblock    chan struct{}
+}
+
+func (bs blockingSink) Deliver(sink.Message) error {
+	bs.delivering <- struct{}{}
+	<-bs.unblock
+	return nil
+}
+
+func (bs blockingSink) Capabilities() sink.Capabilities {
+	return sink.Capabilities{}
+}
+
+func TestSubmitterStop(t *testing.T) {
+	bs := blockingSink{delivering: make(chan struct{}, 10), unblock: make(chan struct{})}
+	defer close(bs.unblock)
+	sub := newSubmitter(map[string]sink.Sink{"slack": bs}, config{DestinationConcurrency: 1})
+	sch := make(chan webhookSubmit, 10)
+	go sub.run(sch)
+
+	msg := func(text string) webhookSubmit {
+		return webhookSubmit{Message: events.Message{Attachment: events.Attachment{Text: text}}}
+	}
+	// the first is stuck being delivered, the second is queued for the
+	// destination and the third is still in sch
+	sch <- msg("delivering")
+	select {
+	case <-bs.delivering:
+	case <-time.After(time.Second):
+		t.Fatal("message wasn't delivered")
+	}
+	sch <- msg("queued")
+	for len(sch) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sch <- msg("buffered")
+
+	sub.Stop(sch)
+	var texts []string
+	for _, s := range sub.Pending() {
+		texts = append(texts, s.Text)
+	}
+	if len(texts) != 2 || texts[0] != "queued" || texts[1] != "buffered" {
+		t.Fatalf("Pending() after Stop = %q, want [queued buffered]", texts)
+	}
+}
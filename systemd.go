@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// sdNotify sends the state, like READY=1, to systemd's notify socket. It does
+// nothing if we weren't started by systemd with Type=notify.
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	// a leading @ means the socket is in the abstract namespace
+	if sock[0] == '@' {
+		sock = "\x00" + sock[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return llog.ErrWithKV(err, llog.KV{"socket": sock})
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval systemd expects watchdog pings at, or
+// 0 if the watchdog isn't enabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// eventTracker tracks the events that are being handled so we can tell if the
+// pipeline is stuck
+type eventTracker struct {
+	l        sync.Mutex
+	next     uint64
+	inflight map[uint64]time.Time
+}
+
+func newEventTracker() *eventTracker {
+	return &eventTracker{inflight: map[uint64]time.Time{}}
+}
+
+// start records that an event started being handled and returns a function to
+// call once it's done
+func (t *eventTracker) start() func() {
+	t.l.Lock()
+	id := t.next
+	t.next++
+	t.inflight[id] = time.Now()
+	t.l.Unlock()
+	return func() {
+		t.l.Lock()
+		delete(t.inflight, id)
+		t.l.Unlock()
+	}
+}
+
+// oldest returns how long the oldest event has been handled for, or 0 if no
+// events are being handled
+func (t *eventTracker) oldest() time.Duration {
+	t.l.Lock()
+	defer t.l.Unlock()
+	var oldest time.Duration
+	for _, started := range t.inflight {
+		if d := time.Since(started); d > oldest {
+			oldest = d
+		}
+	}
+	return oldest
+}
+
+// sdWatchdog pings systemd's watchdog at half of the interval it expects as
+// long as no event has been stuck in the pipeline for longer than the
+// interval. If one has then it stops pinging so that systemd restarts us.
+func sdWatchdog(ctx context.Context, t *eventTracker) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	tick := time.NewTicker(interval / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		if d := t.oldest(); d > interval {
+			llog.Error("event pipeline is stuck, skipping watchdog", llog.KV{"oldest": d})
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			llog.Warn("error notifying systemd watchdog", llog.ErrKV(err))
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/levenlabs/gerrit-slack/gerritssh"
+)
+
+// tracer is used for all of the spans, it's a no-op unless tracing is set up
+var tracer = otel.Tracer("github.com/levenlabs/gerrit-slack")
+
+// initTracing sets up exporting spans over OTLP/HTTP to the endpoint, like
+// localhost:4318. The returned function flushes and stops the exporter.
+func initTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exp, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName("gerrit-slack"),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// eventAttributes returns the span attributes for an event
+func eventAttributes(e gerritssh.Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gerrit.event.type", e.Type),
+		attribute.String("gerrit.project", e.Change.Project),
+		attribute.Int64("gerrit.change.number", e.Change.Number),
+		attribute.Int64("gerrit.patchset.number", e.PatchSet.Number),
+	}
+}
+
+// startSpan starts a child span of the span in ctx, if ctx is nil a new trace
+// is started
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
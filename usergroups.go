@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/levenlabs/go-llog"
+)
+
+// usergroupSyncInterval is how often the slack usergroups are synced from their
+// gerrit groups
+var usergroupSyncInterval = time.Hour
+
+// usergroupSync keeps the members of slack usergroups, like the ones projects
+// escalate to, the same as the members of gerrit groups
+type usergroupSync struct {
+	client *gerrit.Client
+	state  *slackState
+	// groups maps the name of each gerrit group to the id of its usergroup
+	groups map[string]string
+}
+
+// parseUsergroupSync parses a comma separated list of gerrit groups and the ids
+// of the slack usergroups they're synced to, like
+// `Backend=S0123ABCD, Frontend Reviewers=S0456EFGH`
+func parseUsergroupSync(s string) (map[string]string, error) {
+	groups := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		// group names can have an = but usergroup ids can't
+		i := strings.LastIndex(pair, "=")
+		var group, usergroup string
+		if i != -1 {
+			group, usergroup = strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		}
+		if group == "" || usergroup == "" {
+			return nil, llog.ErrWithKV(errors.New("invalid usergroup sync"), llog.KV{"usergroupSync": pair})
+		}
+		groups[group] = usergroup
+	}
+	return groups, nil
+}
+
+// run syncs the usergroups now and then every usergroupSyncInterval until the
+// context is cancelled
+func (us usergroupSync) run(ctx context.Context) {
+	if len(us.groups) == 0 {
+		return
+	}
+	tick := time.NewTicker(usergroupSyncInterval)
+	defer tick.Stop()
+	for {
+		for group, usergroup := range us.groups {
+			kv := llog.KV{"group": group, "usergroup": usergroup}
+			if changed, err := us.sync(group, usergroup); err != nil {
+				llog.Error("error syncing slack usergroup", llog.ErrKV(err), kv)
+			} else if changed {
+				llog.Info("synced slack usergroup", kv)
+			}
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync sets the members of the usergroup to the slack users of the gerrit
+// group's members and returns true if it changed. Members without a slack user
+// are left out but if any of them can't be looked up then the usergroup isn't
+// changed, so nobody is removed just because slack was having problems.
+func (us usergroupSync) sync(group, usergroup string) (bool, error) {
+	as, _, err := us.client.Groups.ListGroupMembers(url.PathEscape(group), &gerrit.ListGroupMembersOptions{
+		Recursive: true,
+	})
+	if err != nil {
+		return false, llog.ErrWithKV(err, llog.KV{"group": group})
+	}
+	set := map[string]bool{}
+	for _, a := range *as {
+		if a.Email == "" {
+			continue
+		}
+		id, err := us.state.LookupUserID(a.Email)
+		if err != nil {
+			return false, err
+		} else if id == "" {
+			llog.Debug("no slack user for group member", llog.KV{"group": group, "email": a.Email})
+			continue
+		}
+		set[id] = true
+	}
+	// slack doesn't allow a usergroup to be emptied
+	if len(set) == 0 {
+		return false, llog.ErrWithKV(errors.New("no group members have a slack user"), llog.KV{"group": group})
+	}
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	current, err := us.state.UsergroupMembers(usergroup)
+	if err != nil {
+		return false, err
+	}
+	sort.Strings(current)
+	if strings.Join(current, ",") == strings.Join(ids, ",") {
+		return false, nil
+	}
+	return true, us.state.SetUsergroupMembers(usergroup, ids)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUsergroupSync(t *testing.T) {
+	tests := []struct {
+		s      string
+		groups map[string]string
+		err    bool
+	}{
+		{s: "", groups: map[string]string{}},
+		{s: " , ", groups: map[string]string{}},
+		{s: "Backend=S0123ABCD", groups: map[string]string{"Backend": "S0123ABCD"}},
+		{
+			s: "Backend=S0123ABCD, Frontend Reviewers = S0456EFGH",
+			groups: map[string]string{
+				"Backend":            "S0123ABCD",
+				"Frontend Reviewers": "S0456EFGH",
+			},
+		},
+		{s: "a=b=S0123ABCD", groups: map[string]string{"a=b": "S0123ABCD"}},
+		{s: "Backend", err: true},
+		{s: "Backend=", err: true},
+		{s: "=S0123ABCD", err: true},
+		{s: "Backend=S0123ABCD,Frontend", err: true},
+	}
+	for _, test := range tests {
+		groups, err := parseUsergroupSync(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseUsergroupSync(%q) didn't return an error", test.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUsergroupSync(%q) returned error: %v", test.s, err)
+		} else if !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("parseUsergroupSync(%q) = %v, want %v", test.s, groups, test.groups)
+		}
+	}
+}